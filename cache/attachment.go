@@ -0,0 +1,401 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// An Attachment is a generic representation for an attachment downloaded from
+// the Discord API. Its content is either held in memory or, if larger than
+// Options.SpillSize, kept in a file on disk. The content is shared by every
+// lookup of the attachment, so must not be modified.
+type Attachment struct {
+	Name, Type string
+	// Size is the size of the content in bytes.
+	Size int64
+	// Content is the content of the attachment if held in memory, else
+	// nil.
+	Content []byte
+	// Path is the file holding the content of the attachment if it was
+	// spilled to disk or is in the persistent store, else empty. Spilled
+	// files are removed once the attachment is evicted from the cache and
+	// no longer held (see Cache.Hold), while files in the store have a
+	// stable path, being kept until removed by its retention policy.
+	Path string
+	// Hash is the hex encoded SHA-256 hash of the content.
+	Hash          string
+	LastReference time.Time
+
+	// Position in Cache.lru, if held in memory
+	elem *list.Element
+}
+
+// Attachment looks up and returns the content and info for a remote attachment
+// from the Discord API. Lookups from the same url are guaranteed not to cause
+// an API hit while the attachment remains cached. Errors are not cached and
+// the attachment is assumed to not exist.
+//
+// Attachments larger than Options.MaxAttachmentSize are not downloaded and
+// ErrTooLarge is returned, while those of types not in Options.AllowedTypes
+// are refused with ErrContentType.
+func (c *Cache) Attachment(at *discordgo.MessageAttachment) (Attachment, error) {
+	return c.AttachmentContext(context.Background(), at)
+}
+
+// AttachmentContext is like Attachment, but stops waiting for the download
+// once ctx is done, returning the error from ctx. The download carries on in
+// the background, such that the attachment is still cached for later lookups.
+func (c *Cache) AttachmentContext(ctx context.Context, at *discordgo.MessageAttachment) (Attachment, error) {
+	a, err := c.attachments.getContext(ctx, at.URL, func() (*Attachment, error) {
+		return c.download(at)
+	})
+	if err != nil {
+		return Attachment{Name: at.Filename, Type: at.ContentType}, err
+	}
+
+	// Attachments are shared, so must be referenced under lock
+	c.attachments.mu.Lock()
+	defer c.attachments.mu.Unlock()
+
+	a.LastReference = time.Now()
+	if a.elem != nil {
+		c.lru.MoveToFront(a.elem)
+	}
+	return *a, nil
+}
+
+// download fetches the content of an attachment from the Discord CDN, retrying
+// failed requests up to Options.FetchAttempts times.
+func (c *Cache) download(at *discordgo.MessageAttachment) (*Attachment, error) {
+	ret := &Attachment{
+		Name: at.Filename,
+		Type: at.ContentType,
+	}
+	if int64(at.Size) > c.opts.MaxAttachmentSize {
+		return ret, fmt.Errorf("%w: %d bytes", ErrTooLarge, at.Size)
+	}
+	if at.ContentType != "" && !c.allowed(at.ContentType) {
+		return ret, fmt.Errorf("%w: %s", ErrContentType, at.ContentType)
+	}
+	if c.disk != nil {
+		if a, ok := c.disk.lookup(at.URL); ok && a.Size <= c.opts.MaxAttachmentSize {
+			return a, nil
+		}
+	}
+
+	delay := c.opts.FetchBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := c.fetch(ret, at.URL)
+		if err == nil && c.disk != nil {
+			if err := c.disk.add(at.URL, ret); err != nil {
+				return ret, storeError(err)
+			}
+		}
+		if err == nil || !retry || attempt >= c.opts.FetchAttempts {
+			return ret, err
+		}
+
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-c.ctx.Done():
+			return ret, fmt.Errorf("%w: %s", ErrRequest, c.ctx.Err().Error())
+		}
+	}
+}
+
+// fetch makes a single attempt to download the content at url into a, holding
+// it in memory if small enough, else streaming it to a file. If the attempt
+// fails, an error is returned alongside true if it is worth retrying.
+func (c *Cache) fetch(a *Attachment, url string) (bool, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, c.opts.FetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, fmt.Errorf("%w: %s", ErrRequest, err.Error())
+	}
+	r, err := c.opts.Fetcher.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("%w: %s", ErrRequest, err.Error())
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		retry := r.StatusCode >= 500 || r.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("%w: %s", ErrGetFailed, r.Status)
+	}
+	typ := r.Header.Get("Content-Type")
+	if !c.allowed(typ) {
+		return false, fmt.Errorf("%w: %q", ErrContentType, typ)
+	}
+	max := c.opts.MaxAttachmentSize
+	if r.ContentLength > max {
+		return false, fmt.Errorf("%w: %d bytes", ErrTooLarge, r.ContentLength)
+	}
+
+	// Read one byte more than fits in memory to find if it must spill
+	buf, err := io.ReadAll(io.LimitReader(r.Body, c.opts.SpillSize+1))
+	if err != nil {
+		return true, fmt.Errorf("%w: %s", ErrIO, err.Error())
+	}
+	if int64(len(buf)) <= c.opts.SpillSize {
+		sum := sha256.Sum256(buf)
+		a.Content = buf
+		a.Size = int64(len(buf))
+		a.Hash = hex.EncodeToString(sum[:])
+		a.LastReference = time.Now()
+		return false, nil
+	}
+
+	dir, err := c.spillDir()
+	if err != nil {
+		return false, err
+	}
+	f, err := os.CreateTemp(dir, "attachment-*")
+	if err != nil {
+		return false, fmt.Errorf("%w: %s", ErrIO, err.Error())
+	}
+
+	// Likewise, read one byte more than allowed to find if it is too large
+	h := sha256.New()
+	rest := io.LimitReader(r.Body, max-int64(len(buf))+1)
+	n, err := io.Copy(io.MultiWriter(f, h), io.MultiReader(bytes.NewReader(buf), rest))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return true, fmt.Errorf("%w: %s", ErrIO, err.Error())
+	}
+	if n > max {
+		os.Remove(f.Name())
+		return false, fmt.Errorf("%w: over %d bytes", ErrTooLarge, max)
+	}
+
+	a.Path = f.Name()
+	a.Size = n
+	a.Hash = hex.EncodeToString(h.Sum(nil))
+	a.LastReference = time.Now()
+	return false, nil
+}
+
+// allowed returns true if attachments of content type typ may be downloaded.
+func (c *Cache) allowed(typ string) bool {
+	if len(c.opts.AllowedTypes) == 0 {
+		return true
+	}
+	if mt, _, err := mime.ParseMediaType(typ); err == nil {
+		typ = mt
+	}
+
+	for _, t := range c.opts.AllowedTypes {
+		t = strings.ToLower(strings.TrimSuffix(t, "*"))
+		if typ == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(typ, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// spillDir returns the directory to which attachments are spilled, creating a
+// temporary directory if none was given.
+func (c *Cache) spillDir() (string, error) {
+	c.dirMu.Lock()
+	defer c.dirMu.Unlock()
+
+	if c.disk != nil {
+		if err := os.MkdirAll(c.dir, 0o755); err != nil {
+			return "", fmt.Errorf("%w: %s", ErrIO, err.Error())
+		}
+	}
+	if c.dir != "" {
+		return c.dir, nil
+	}
+
+	dir, err := os.MkdirTemp("", "disdup-attachments-")
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrIO, err.Error())
+	}
+	c.dir, c.tempDir = dir, true
+	return dir, nil
+}
+
+// addAttachment accounts for a newly cached attachment, evicting the least
+// recently used attachments if those in memory now exceed the budget. It is
+// called with attachments.mu held.
+func (c *Cache) addAttachment(url string, a *Attachment) {
+	if a.Content == nil {
+		return
+	}
+
+	a.elem = c.lru.PushFront(url)
+	c.used += a.Size
+	for c.used > c.opts.MemoryBudget && c.lru.Len() > 0 {
+		c.attachments.evict(c.lru.Back().Value.(string))
+	}
+}
+
+// removeAttachment releases an attachment evicted from the cache. It is called
+// with attachments.mu held.
+func (c *Cache) removeAttachment(url string, a *Attachment) {
+	if a.elem != nil {
+		c.lru.Remove(a.elem)
+		c.used -= a.Size
+		a.elem = nil
+	}
+	// Files in the persistent store are only removed by its retention
+	// policy
+	if a.Path == "" || c.disk != nil {
+		return
+	}
+	if h, ok := c.held[a.Path]; ok {
+		h.evicted = true
+		return
+	}
+	os.Remove(a.Path)
+}
+
+// hold is the use of a spilled file by callers of Cache.Hold.
+type hold struct {
+	refs int
+	// Whether the attachment was evicted or pruned from the store while
+	// held, such that the file is removed once released
+	evicted bool
+}
+
+// Hold prevents the file at path, holding the content of an attachment, from
+// being removed if the attachment is evicted from the cache, until Release has
+// been called with path as many times as Hold. This keeps the file valid while
+// messages referring to it wait to be written. Files in the persistent store
+// are likewise kept by its retention policy, which is applied again once they
+// are released. Spilled files are still removed by Close.
+func (c *Cache) Hold(path string) {
+	if path == "" {
+		return
+	}
+
+	c.attachments.mu.Lock()
+	defer c.attachments.mu.Unlock()
+
+	h, ok := c.held[path]
+	if !ok {
+		h = &hold{}
+		c.held[path] = h
+	}
+	h.refs++
+}
+
+// Release releases a hold on the file at path taken by Hold, removing the file
+// if its attachment was evicted or pruned while held and no holds remain.
+func (c *Cache) Release(path string) {
+	c.attachments.mu.Lock()
+	defer c.attachments.mu.Unlock()
+
+	h, ok := c.held[path]
+	if !ok {
+		return
+	}
+	if h.refs--; h.refs > 0 {
+		return
+	}
+	delete(c.held, path)
+	switch {
+	case !h.evicted:
+	case c.disk != nil:
+		c.disk.retry()
+	default:
+		os.Remove(path)
+	}
+}
+
+// InvalidateAttachment invalidates the cache entry for the attachment at a
+// given URL, removing its file if it was spilled to disk. Attachments in the
+// persistent store are not removed from it.
+func (c *Cache) InvalidateAttachment(url string) error {
+	return c.attachments.remove(url)
+}
+
+// Clean walks the cache, freeing any bulky cached items which are deemed not
+// particularly useful (e.g attachments which have not been reused in a while).
+// Attachments held in memory are additionally kept within the memory budget
+// as they are added. If there is a persistent store, its retention policy is
+// applied, at most once per StorePruneInterval.
+func (c *Cache) Clean() error {
+	c.attachments.mu.Lock()
+	for key, val := range c.attachments.entries {
+		if time.Since(val.LastReference) > AttachmentLifetime {
+			c.attachments.evict(key)
+		}
+	}
+	var held map[string]bool
+	if c.disk != nil {
+		held = make(map[string]bool, len(c.held))
+		for path := range c.held {
+			held[path] = true
+		}
+	}
+	c.attachments.mu.Unlock()
+
+	if c.disk == nil {
+		return nil
+	}
+	// Walks the whole store, so must not hold up lookups meanwhile
+	removed, deferred, err := c.disk.prune(time.Now(), held)
+	if len(removed)+len(deferred) > 0 {
+		c.attachments.mu.Lock()
+		for _, url := range removed {
+			c.attachments.evict(url)
+		}
+		// Pruned again once released
+		for _, path := range deferred {
+			if h, ok := c.held[path]; ok {
+				h.evicted = true
+			}
+		}
+		c.attachments.mu.Unlock()
+	}
+	if err != nil {
+		return storeError(err)
+	}
+	return nil
+}
+
+// Close cancels any attachment downloads in progress and evicts every
+// attachment from the cache, removing those spilled to disk and the temporary
+// directory holding them, if one was created. The cache may still be used
+// after closing, but attachments can no longer be downloaded.
+func (c *Cache) Close() error {
+	c.cancel()
+
+	c.attachments.mu.Lock()
+	for key := range c.attachments.entries {
+		c.attachments.evict(key)
+	}
+	c.attachments.mu.Unlock()
+
+	c.dirMu.Lock()
+	defer c.dirMu.Unlock()
+
+	if !c.tempDir {
+		return nil
+	}
+	dir := c.dir
+	c.dir, c.tempDir = "", false
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("%w: %s", ErrIO, err.Error())
+	}
+	return nil
+}
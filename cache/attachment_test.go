@@ -0,0 +1,172 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// flakyFetcher fails the first fails requests, then makes them using the
+// default client.
+type flakyFetcher struct {
+	fails int32
+	calls atomic.Int32
+}
+
+func (f *flakyFetcher) Do(req *http.Request) (*http.Response, error) {
+	if f.calls.Add(1) <= f.fails {
+		return nil, errors.New("connection reset")
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// stalledServer accepts requests but never responds to them.
+func stalledServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func testFetcherRetry(t *testing.T) {
+	srv, _ := attachmentServer(t)
+	cases := []struct {
+		Name   string
+		Fails  int32
+		Expect error
+	}{
+		{"Recovers", 2, nil},
+		{"GivesUp", 3, ErrRequest},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			f := &flakyFetcher{fails: c.Fails}
+			cache := NewCacheOptions(MockProvider{}, Options{Fetcher: f, FetchAttempts: 3, FetchBackoff: time.Millisecond})
+
+			if _, err := cache.Attachment(attachmentAt(srv, "/100")); !errors.Is(err, c.Expect) {
+				t.Errorf("expected %v, got %v", c.Expect, err)
+			}
+			if n := f.calls.Load(); n != 3 {
+				t.Errorf("expected 3 attempts, got %d", n)
+			}
+		})
+	}
+}
+
+func testFetcherStatus(t *testing.T) {
+	srv, requests := attachmentServer(t)
+	cases := []struct {
+		Status   string
+		Attempts int32
+	}{
+		{"503", 3},
+		{"429", 3},
+		{"404", 1},
+		{"403", 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Status, func(t *testing.T) {
+			cache := NewCacheOptions(MockProvider{}, Options{FetchAttempts: 3, FetchBackoff: time.Millisecond})
+
+			before := requests.Load()
+			if _, err := cache.Attachment(attachmentAt(srv, "/100?status="+c.Status)); !errors.Is(err, ErrGetFailed) {
+				t.Errorf("expected %v, got %v", ErrGetFailed, err)
+			}
+			if n := requests.Load() - before; n != c.Attempts {
+				t.Errorf("expected %d attempts, got %d", c.Attempts, n)
+			}
+		})
+	}
+}
+
+func testFetcherTimeout(t *testing.T) {
+	srv := stalledServer(t)
+	cache := NewCacheOptions(MockProvider{}, Options{FetchTimeout: 50 * time.Millisecond, FetchAttempts: 2, FetchBackoff: time.Millisecond})
+
+	start := time.Now()
+	if _, err := cache.Attachment(attachmentAt(srv, "/100")); !errors.Is(err, ErrRequest) {
+		t.Errorf("expected %v, got %v", ErrRequest, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("stalled download not timed out, took %s", elapsed)
+	}
+}
+
+func testFetcherContext(t *testing.T) {
+	srv := stalledServer(t)
+	cache := NewCache(MockProvider{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := cache.AttachmentContext(ctx, attachmentAt(srv, "/100")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// The download carries on until the cache is closed
+	done := make(chan error)
+	go func() {
+		_, err := cache.Attachment(attachmentAt(srv, "/100"))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cache.Close()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrRequest) {
+			t.Errorf("expected %v, got %v", ErrRequest, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("download not cancelled by close")
+	}
+}
+
+func testFetcherContentType(t *testing.T) {
+	srv, requests := attachmentServer(t)
+	cache := NewCacheOptions(MockProvider{}, Options{AllowedTypes: []string{"image/*", "text/plain"}})
+
+	cases := []struct {
+		Path   string
+		Expect error
+	}{
+		{"/100?type=image/png", nil},
+		{"/100?type=IMAGE/JPEG", nil},
+		{"/100?type=text/plain;+charset=utf-8", nil},
+		{"/100?type=text/html", ErrContentType},
+		{"/100?type=application/zip", ErrContentType},
+		{"/100?type=not+a+type", ErrContentType},
+	}
+	for _, c := range cases {
+		if _, err := cache.Attachment(attachmentAt(srv, c.Path)); !errors.Is(err, c.Expect) {
+			t.Errorf("%s: expected %v, got %v", c.Path, c.Expect, err)
+		}
+	}
+
+	// Known to be of the wrong type, so not requested
+	before := requests.Load()
+	at := &discordgo.MessageAttachment{URL: srv.URL + "/101?type=image/png", ContentType: "video/mp4"}
+	if _, err := cache.Attachment(at); !errors.Is(err, ErrContentType) {
+		t.Errorf("expected %v, got %v", ErrContentType, err)
+	}
+	if requests.Load() != before {
+		t.Error("Attachment known to be of the wrong type was requested")
+	}
+}
+
+func TestFetcher(t *testing.T) {
+	t.Run("Retry", testFetcherRetry)
+	t.Run("Status", testFetcherStatus)
+	t.Run("Timeout", testFetcherTimeout)
+	t.Run("Context", testFetcherContext)
+	t.Run("ContentType", testFetcherContentType)
+}
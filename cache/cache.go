@@ -1,7 +1,8 @@
 // Package cache implements a simple cache of Discord objects which require a
 // remote API or web request such that their details be discovered. It can also
-// be used to cache web requests to the Discord CDN. It is not designed to be
-// concurrency safe.
+// be used to cache web requests to the Discord CDN. A Cache is safe for
+// concurrent use, and concurrent lookups of the same uncached object are
+// coalesced into a single request.
 //
 // The Cache object takes a provider as its main source of truth, being an
 // abstract representation of the Discord API. Out of the box, it is intended
@@ -10,10 +11,11 @@
 package cache
 
 import (
+	"container/list"
+	"context"
 	"errors"
-	"fmt"
-	"io"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
@@ -26,55 +28,200 @@ var (
 	ErrIO          = errors.New("cache: attachment download: I/O error")
 	ErrRequest     = errors.New("cache: attachment download: network request failed")
 	ErrGetFailed   = errors.New("cache: attachment download: http error")
+	ErrTooLarge    = errors.New("cache: attachment download: attachment too large")
+	ErrContentType = errors.New("cache: attachment download: content type not allowed")
 )
 
 // Cache cleanup constants.
 const (
 	// Approximate maximum lifetime an attachment can live for without being cleaned up.
 	AttachmentLifetime = time.Minute * 5
-	// Threshold at which the attachments cache will begin to prune excess elements.
-	AttachmentPruneThreshold = 1000
 )
 
-// Cache represents a cache of Discord API data objects.
-type Cache struct {
-	provider        Provider
-	channelCache    map[string]*discordgo.Channel
-	userCache       map[string]*discordgo.User
-	guildCache      map[string]*discordgo.Guild
-	attachmentCache map[string]*Attachment
+// Default attachment limits, used where Options leaves a limit zero.
+const (
+	DefaultMemoryBudget      = 64 << 20
+	DefaultMaxAttachmentSize = 100 << 20
+	DefaultSpillSize         = 1 << 20
+	DefaultFetchTimeout      = 30 * time.Second
+	DefaultFetchAttempts     = 3
+	DefaultFetchBackoff      = 500 * time.Millisecond
+)
+
+// A Fetcher performs the HTTP requests used to download attachments. It is
+// satisfied by *http.Client.
+type Fetcher interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Options are the limits on the entries kept by a Cache. Zero values are
+// replaced by their defaults.
+type Options struct {
+	// ChannelTTL, GuildTTL, UserTTL, MemberTTL and RoleTTL are how long
+	// entries of each kind are kept before being looked up again. If
+	// zero, entries are kept until invalidated, either explicitly or by
+	// an event passed to Handle.
+	ChannelTTL time.Duration
+	GuildTTL   time.Duration
+	UserTTL    time.Duration
+	MemberTTL  time.Duration
+	RoleTTL    time.Duration
+
+	// MemoryBudget is the total size in bytes of the attachment content
+	// held in memory. Once exceeded, the least recently used attachments
+	// are evicted until the content fits again.
+	MemoryBudget int64
+	// MaxAttachmentSize is the size in bytes above which attachments are
+	// not downloaded, ErrTooLarge being returned instead.
+	MaxAttachmentSize int64
+	// SpillSize is the size in bytes above which attachments are written
+	// to a file in Dir instead of being held in memory. It is capped to
+	// MemoryBudget.
+	SpillSize int64
+	// Dir is the directory to which large attachments are written. If
+	// empty, a temporary directory is created when first needed and
+	// removed by Close. Unused if StoreDir is set.
+	Dir string
+
+	// StoreDir, if set, is the directory of a persistent store of every
+	// attachment downloaded, which outlives the cache. Attachments are
+	// stored by the SHA-256 hash of their content, such that identical
+	// attachments are stored once, and are looked up in the store before
+	// being downloaded. Stored attachments are kept until removed by the
+	// retention policy, given by Retention and MaxStoreSize.
+	StoreDir string
+	// Retention is how long stored attachments are kept after they were
+	// last used. If zero, they are kept regardless of age.
+	Retention time.Duration
+	// MaxStoreSize is the total size in bytes of the stored attachments,
+	// beyond which the least recently used are removed. If zero, the size
+	// of the store is not limited.
+	MaxStoreSize int64
+
+	// Fetcher downloads attachments. If nil, http.DefaultClient is used.
+	Fetcher Fetcher
+	// FetchTimeout bounds each attempt to download an attachment,
+	// including reading its content.
+	FetchTimeout time.Duration
+	// FetchAttempts is the number of times a download is attempted before
+	// giving up. Only failed requests and server errors are retried.
+	FetchAttempts int
+	// FetchBackoff is the delay before the first retry of a download,
+	// which doubles with each further retry.
+	FetchBackoff time.Duration
+	// AllowedTypes are the content types of attachments which may be
+	// downloaded, such as "image/png". Entries ending in "/" or "/*"
+	// allow every subtype, such as "image/". If empty, attachments of any
+	// type are downloaded, else others are refused with ErrContentType.
+	AllowedTypes []string
+}
+
+// withDefaults returns o with zero limits replaced by their defaults.
+func (o Options) withDefaults() Options {
+	if o.MemoryBudget == 0 {
+		o.MemoryBudget = DefaultMemoryBudget
+	}
+	if o.MaxAttachmentSize == 0 {
+		o.MaxAttachmentSize = DefaultMaxAttachmentSize
+	}
+	if o.SpillSize == 0 {
+		o.SpillSize = DefaultSpillSize
+	}
+	if o.SpillSize > o.MemoryBudget {
+		o.SpillSize = o.MemoryBudget
+	}
+	if o.Fetcher == nil {
+		o.Fetcher = http.DefaultClient
+	}
+	if o.FetchTimeout == 0 {
+		o.FetchTimeout = DefaultFetchTimeout
+	}
+	if o.FetchAttempts == 0 {
+		o.FetchAttempts = DefaultFetchAttempts
+	}
+	if o.FetchBackoff == 0 {
+		o.FetchBackoff = DefaultFetchBackoff
+	}
+	return o
 }
 
-// An Attachment is a generic representation for an attachment downloaded from
-// the Discord API.
-type Attachment struct {
-	Name, Type    string
-	Content       []byte
-	LastReference time.Time
+// Cache represents a cache of Discord API data objects.
+type Cache struct {
+	provider    Provider
+	channels    *store[*discordgo.Channel]
+	users       *store[*discordgo.User]
+	guilds      *store[*discordgo.Guild]
+	members     *store[*discordgo.Member]
+	roles       *store[[]*discordgo.Role]
+	attachments *store[*Attachment]
+
+	opts Options
+	// Context of attachment downloads, cancelled by Close
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Attachments held in memory, most recently used first, and the total
+	// size of their content. Guarded by attachments.mu.
+	lru  *list.List
+	used int64
+	// Spilled files in use by callers of Hold. Guarded by attachments.mu.
+	held map[string]*hold
+
+	// Directory to which attachments are spilled, created when first
+	// needed if not given in opts
+	dirMu   sync.Mutex
+	dir     string
+	tempDir bool
+
+	// Persistent store of attachments, if enabled
+	disk *disk
 }
 
 // Provider is a data provider for discord users and channels. This is mainly
 // for testing and is designed for use with either a mock or
 // *discordgo.Session.
 type Provider interface {
-	Channel(channelID string) (c *discordgo.Channel, err error)
-	User(userID string) (u *discordgo.User, err error)
-	Guild(guildID string) (st *discordgo.Guild, err error)
+	Channel(channelID string, options ...discordgo.RequestOption) (c *discordgo.Channel, err error)
+	User(userID string, options ...discordgo.RequestOption) (u *discordgo.User, err error)
+	Guild(guildID string, options ...discordgo.RequestOption) (st *discordgo.Guild, err error)
+	GuildMember(guildID, userID string, options ...discordgo.RequestOption) (st *discordgo.Member, err error)
+	GuildRoles(guildID string, options ...discordgo.RequestOption) (st []*discordgo.Role, err error)
 }
 
-// NewCache creates a new cache object with provider p.
+// NewCache creates a new cache object with provider p, using the default
+// Options. The cache should be closed once finished with to remove any
+// attachments written to disk.
 func NewCache(p Provider) *Cache {
+	return NewCacheOptions(p, Options{})
+}
+
+// NewCacheOptions is like NewCache, but keeps entries within the limits given
+// by opts.
+func NewCacheOptions(p Provider, opts Options) *Cache {
 	if p == nil {
 		panic(ErrNilProvider)
 	}
 
-	return &Cache{
-		provider:        p,
-		channelCache:    make(map[string]*discordgo.Channel),
-		userCache:       make(map[string]*discordgo.User),
-		guildCache:      make(map[string]*discordgo.Guild),
-		attachmentCache: make(map[string]*Attachment),
+	c := &Cache{
+		provider:    p,
+		channels:    newStore[*discordgo.Channel](opts.ChannelTTL),
+		users:       newStore[*discordgo.User](opts.UserTTL),
+		guilds:      newStore[*discordgo.Guild](opts.GuildTTL),
+		members:     newStore[*discordgo.Member](opts.MemberTTL),
+		roles:       newStore[[]*discordgo.Role](opts.RoleTTL),
+		attachments: newStore[*Attachment](0),
+		opts:        opts.withDefaults(),
+		lru:         list.New(),
+		held:        make(map[string]*hold),
+		dir:         opts.Dir,
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if opts.StoreDir != "" {
+		c.disk = &disk{dir: opts.StoreDir, retention: opts.Retention, maxSize: opts.MaxStoreSize}
+		c.dir = c.disk.tempDir()
 	}
+	c.attachments.added = c.addAttachment
+	c.attachments.removed = c.removeAttachment
+	return c
 }
 
 // Channel looks up and returns a channel's data from the discord API, or
@@ -82,34 +229,65 @@ func NewCache(p Provider) *Cache {
 // found, error is returned from the discord API. Errors are not cached and
 // failed lookups cause a new API hit.
 func (c *Cache) Channel(ID string) (discordgo.Channel, error) {
-	if ch, ok := c.channelCache[ID]; ok {
-		return *ch, nil
-	}
-
-	newchan, err := c.provider.Channel(ID)
+	newchan, err := c.channels.get(ID, func() (*discordgo.Channel, error) {
+		return c.provider.Channel(ID)
+	})
 	if err != nil {
 		return discordgo.Channel{}, err
 	}
 
-	c.channelCache[ID] = newchan
 	return *newchan, nil
 }
 
+// Parent looks up and returns the parent channel of ch if ch is a thread or
+// forum post, using the cache in the same way as Channel. If ch is not a
+// thread, the zero value and false are returned.
+func (c *Cache) Parent(ch discordgo.Channel) (discordgo.Channel, bool, error) {
+	if !ch.IsThread() || ch.ParentID == "" {
+		return discordgo.Channel{}, false, nil
+	}
+
+	p, err := c.Channel(ch.ParentID)
+	if err != nil {
+		return discordgo.Channel{}, false, err
+	}
+	return p, true, nil
+}
+
+// Category looks up and returns the category containing ch, using the cache
+// in the same way as Channel. Threads are in the category of their parent
+// channel. If ch is not in a category, the zero value and false are returned.
+func (c *Cache) Category(ch discordgo.Channel) (discordgo.Channel, bool, error) {
+	if ch.IsThread() {
+		p, ok, err := c.Parent(ch)
+		if !ok {
+			return discordgo.Channel{}, false, err
+		}
+		ch = p
+	}
+	if ch.ParentID == "" || ch.Type == discordgo.ChannelTypeGuildCategory {
+		return discordgo.Channel{}, false, nil
+	}
+
+	cat, err := c.Channel(ch.ParentID)
+	if err != nil {
+		return discordgo.Channel{}, false, err
+	}
+	return cat, true, nil
+}
+
 // User looks up and returns a user's data from the discord API, or returns the
 // cached value if already found. If the user could not be found, error is
 // returned from the discord API. Errors are not cached and failed lookups
 // cause a new API hit.
 func (c *Cache) User(ID string) (discordgo.User, error) {
-	if u, ok := c.userCache[ID]; ok {
-		return *u, nil
-	}
-
-	newuser, err := c.provider.User(ID)
+	newuser, err := c.users.get(ID, func() (*discordgo.User, error) {
+		return c.provider.User(ID)
+	})
 	if err != nil {
 		return discordgo.User{}, err
 	}
 
-	c.userCache[ID] = newuser
 	return *newuser, nil
 }
 
@@ -118,100 +296,76 @@ func (c *Cache) User(ID string) (discordgo.User, error) {
 // returned from the discord API. Errors are not cached and failed lookups
 // cause a new API hit.
 func (c *Cache) Guild(ID string) (discordgo.Guild, error) {
-	if g, ok := c.guildCache[ID]; ok {
-		return *g, nil
-	}
-
-	newuser, err := c.provider.Guild(ID)
+	newguild, err := c.guilds.get(ID, func() (*discordgo.Guild, error) {
+		return c.provider.Guild(ID)
+	})
 	if err != nil {
 		return discordgo.Guild{}, err
 	}
 
-	c.guildCache[ID] = newuser
-	return *newuser, nil
+	return *newguild, nil
 }
 
-// Attachment looks up and returns the content and info for a remote attachment
-// from the Discord API. Lookups from the same url are guaranteed not to cause
-// an API hit. Errors are not cached and the attachment is assumed to not
-// exist.
-func (c *Cache) Attachment(at *discordgo.MessageAttachment) (Attachment, error) {
-	if a, ok := c.attachmentCache[at.URL]; ok {
-		a.LastReference = time.Now()
-		return *a, nil
-	}
-
-	ret := Attachment{
-		Name: at.Filename,
-		Type: at.ContentType,
-	}
+// memberKey returns the key of the member cache entry for a user in a guild.
+func memberKey(guildID, userID string) string {
+	return guildID + "/" + userID
+}
 
-	r, err := http.Get(at.URL)
+// Member looks up and returns a user's membership of a guild from the discord
+// API, or returns the cached value if already found. If the member could not
+// be found, error is returned from the discord API. Errors are not cached and
+// failed lookups cause a new API hit.
+func (c *Cache) Member(guildID, userID string) (discordgo.Member, error) {
+	newmember, err := c.members.get(memberKey(guildID, userID), func() (*discordgo.Member, error) {
+		return c.provider.GuildMember(guildID, userID)
+	})
 	if err != nil {
-		return ret, fmt.Errorf("%w: %s", ErrRequest, err.Error())
+		return discordgo.Member{}, err
 	}
-	if r.StatusCode != 200 {
-		return ret, ErrGetFailed
-	}
-	defer r.Body.Close()
 
-	buf, err := io.ReadAll(r.Body)
+	return *newmember, nil
+}
+
+// Roles looks up and returns the roles of a guild from the discord API, or
+// returns the cached value if already found. If the roles could not be found,
+// error is returned from the discord API. Errors are not cached and failed
+// lookups cause a new API hit.
+func (c *Cache) Roles(guildID string) ([]discordgo.Role, error) {
+	roles, err := c.roles.get(guildID, func() ([]*discordgo.Role, error) {
+		return c.provider.GuildRoles(guildID)
+	})
 	if err != nil {
-		return ret, fmt.Errorf("%w: %s", ErrIO, err.Error())
+		return nil, err
 	}
-	ret.Content = buf
-	ret.LastReference = time.Now()
 
-	c.attachmentCache[at.URL] = &ret
+	ret := make([]discordgo.Role, len(roles))
+	for i, r := range roles {
+		ret[i] = *r
+	}
 	return ret, nil
 }
 
 // InvalidateChannel invalidates the cache entry for a given channel ID.
 func (c *Cache) InvalidateChannel(ID string) error {
-	if _, ok := c.channelCache[ID]; !ok {
-		return ErrMissing
-	}
-
-	delete(c.channelCache, ID)
-	return nil
+	return c.channels.remove(ID)
 }
 
 // InvalidateUser invalidates the cache entry for a given user ID.
 func (c *Cache) InvalidateUser(ID string) error {
-	if _, ok := c.userCache[ID]; !ok {
-		return ErrMissing
-	}
-
-	delete(c.userCache, ID)
-	return nil
+	return c.users.remove(ID)
 }
 
 // InvalidateGuild invalidates the cache entry for a given guild ID.
 func (c *Cache) InvalidateGuild(ID string) error {
-	if _, ok := c.guildCache[ID]; !ok {
-		return ErrMissing
-	}
-
-	delete(c.guildCache, ID)
-	return nil
+	return c.guilds.remove(ID)
 }
 
-// Clean walks the cache, freeing any bulky cached items which are deemed not
-// particularly useful (e.g attachments which have not been reused in a while).
-func (c *Cache) Clean() {
-	delfirst := 0
-	if len(c.attachmentCache) > AttachmentPruneThreshold {
-		delfirst = len(c.attachmentCache) - AttachmentPruneThreshold
-	}
-
-	i := 0
-	for key, val := range c.attachmentCache {
-		if i < delfirst {
-			delete(c.attachmentCache, key)
-		} else if time.Since(val.LastReference) > AttachmentLifetime {
-			delete(c.attachmentCache, key)
-		}
+// InvalidateMember invalidates the cache entry for a user in a given guild.
+func (c *Cache) InvalidateMember(guildID, userID string) error {
+	return c.members.remove(memberKey(guildID, userID))
+}
 
-		i++
-	}
+// InvalidateRoles invalidates the cache entry for the roles of a given guild.
+func (c *Cache) InvalidateRoles(guildID string) error {
+	return c.roles.remove(guildID)
 }
@@ -1,8 +1,16 @@
 package cache
 
 import (
+	"bytes"
 	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
@@ -12,19 +20,37 @@ import (
 
 type MockProvider struct{}
 
-func (m MockProvider) Channel(channelID string) (c *discordgo.Channel, err error) {
+func (m MockProvider) Channel(channelID string, options ...discordgo.RequestOption) (c *discordgo.Channel, err error) {
 	if channelID == "1234" {
 		return &discordgo.Channel{
-			ID:      "1234",
-			Name:    "Testing Channel",
+			ID:       "1234",
+			Name:     "Testing Channel",
+			GuildID:  "9101112",
+			ParentID: "1111",
+		}, nil
+	}
+	if channelID == "1111" {
+		return &discordgo.Channel{
+			ID:      "1111",
+			Name:    "Testing Category",
 			GuildID: "9101112",
+			Type:    discordgo.ChannelTypeGuildCategory,
+		}, nil
+	}
+	if channelID == "4321" {
+		return &discordgo.Channel{
+			ID:       "4321",
+			Name:     "Testing Thread",
+			GuildID:  "9101112",
+			ParentID: "1234",
+			Type:     discordgo.ChannelTypeGuildPublicThread,
 		}, nil
 	}
 
 	return nil, ErrMissing
 }
 
-func (m MockProvider) User(userID string) (u *discordgo.User, err error) {
+func (m MockProvider) User(userID string, options ...discordgo.RequestOption) (u *discordgo.User, err error) {
 	if userID == "5678" {
 		return &discordgo.User{
 			ID:       "5678",
@@ -35,7 +61,7 @@ func (m MockProvider) User(userID string) (u *discordgo.User, err error) {
 	return nil, ErrMissing
 }
 
-func (m MockProvider) Guild(guildID string) (st *discordgo.Guild, err error) {
+func (m MockProvider) Guild(guildID string, options ...discordgo.RequestOption) (st *discordgo.Guild, err error) {
 	if guildID == "9101112" {
 		return &discordgo.Guild{
 			ID:      "9101112",
@@ -47,6 +73,29 @@ func (m MockProvider) Guild(guildID string) (st *discordgo.Guild, err error) {
 	return nil, ErrMissing
 }
 
+func (m MockProvider) GuildMember(guildID, userID string, options ...discordgo.RequestOption) (st *discordgo.Member, err error) {
+	if guildID == "9101112" && userID == "5678" {
+		return &discordgo.Member{
+			GuildID: "9101112",
+			User:    &discordgo.User{ID: "5678", Username: "Testing User"},
+			Roles:   []string{"1314"},
+		}, nil
+	}
+
+	return nil, ErrMissing
+}
+
+func (m MockProvider) GuildRoles(guildID string, options ...discordgo.RequestOption) (st []*discordgo.Role, err error) {
+	if guildID == "9101112" {
+		return []*discordgo.Role{
+			{ID: "1314", Name: "Testing Role"},
+			{ID: "1516", Name: "Other Role"},
+		}, nil
+	}
+
+	return nil, ErrMissing
+}
+
 func testChannel(t *testing.T) {
 	provider := MockProvider{}
 	cache := NewCache(provider)
@@ -60,7 +109,7 @@ func testChannel(t *testing.T) {
 		t.Error("Incorrect channel returned from retrieval")
 	}
 
-	cr, ok := cache.channelCache["1234"]
+	cr, ok := cache.channels.entries["1234"]
 	if !ok {
 		t.Error("Failed to insert channel into lookup cache")
 		return
@@ -73,7 +122,7 @@ func testChannel(t *testing.T) {
 		ID:   "testcache",
 		Name: "test channel",
 	}
-	cache.channelCache["testcache"] = &testchan
+	cache.channels.entries["testcache"] = &testchan
 	if hc, err := cache.Channel("testcache"); hc.ID != testchan.ID || err != nil {
 		t.Error("Failed to hit cache for cached channel value")
 	}
@@ -89,11 +138,54 @@ func testChannelError(t *testing.T) {
 		return
 	}
 
-	if _, ok := cache.channelCache["abcd"]; ok {
+	if _, ok := cache.channels.entries["abcd"]; ok {
 		t.Error("Channel cache contains non-existent channel `abcd`")
 	}
 }
 
+func testParent(t *testing.T) {
+	provider := MockProvider{}
+	cache := NewCache(provider)
+
+	thread, _ := provider.Channel("4321")
+	p, ok, err := cache.Parent(*thread)
+	if err != nil || !ok {
+		t.Fatal("Unexpected failure from parent retrieval:", ok, err)
+	}
+	if p.ID != "1234" {
+		t.Error("Incorrect parent returned from retrieval")
+	}
+	if _, ok := cache.channels.entries["1234"]; !ok {
+		t.Error("Failed to insert parent into lookup cache")
+	}
+
+	ch, _ := provider.Channel("1234")
+	if _, ok, err := cache.Parent(*ch); ok || err != nil {
+		t.Error("Got parent for channel which is not a thread:", ok, err)
+	}
+}
+
+func testCategory(t *testing.T) {
+	provider := MockProvider{}
+	cache := NewCache(provider)
+
+	for _, id := range []string{"1234", "4321"} {
+		ch, _ := provider.Channel(id)
+		cat, ok, err := cache.Category(*ch)
+		if err != nil || !ok {
+			t.Fatal("Unexpected failure from category retrieval:", ok, err)
+		}
+		if cat.ID != "1111" {
+			t.Error("Incorrect category returned from retrieval for", id)
+		}
+	}
+
+	cat, _ := provider.Channel("1111")
+	if _, ok, err := cache.Category(*cat); ok || err != nil {
+		t.Error("Got category for a category:", ok, err)
+	}
+}
+
 func testUser(t *testing.T) {
 	provider := MockProvider{}
 	cache := NewCache(provider)
@@ -107,7 +199,7 @@ func testUser(t *testing.T) {
 		t.Error("Incorrect user returned from retrieval")
 	}
 
-	ur, ok := cache.userCache["5678"]
+	ur, ok := cache.users.entries["5678"]
 	if !ok {
 		t.Error("Failed to insert user into lookup cache")
 		return
@@ -120,7 +212,7 @@ func testUser(t *testing.T) {
 		ID:       "testuser",
 		Username: "test user",
 	}
-	cache.userCache["testcache"] = &testuser
+	cache.users.entries["testcache"] = &testuser
 	if hc, err := cache.User("testcache"); hc.ID != testuser.ID || err != nil {
 		t.Error("Failed to hit cache for cached user value")
 	}
@@ -136,7 +228,7 @@ func testUserError(t *testing.T) {
 		return
 	}
 
-	if _, ok := cache.userCache["abcd"]; ok {
+	if _, ok := cache.users.entries["abcd"]; ok {
 		t.Error("Channel cache contains non-existent user `abcd`")
 	}
 }
@@ -154,7 +246,7 @@ func testGuild(t *testing.T) {
 		t.Error("Incorrect guild returned from retrieval")
 	}
 
-	gr, ok := cache.guildCache["9101112"]
+	gr, ok := cache.guilds.entries["9101112"]
 	if !ok {
 		t.Error("Failed to insert user into lookup cache")
 		return
@@ -167,7 +259,7 @@ func testGuild(t *testing.T) {
 		ID:   "testguild",
 		Name: "test guild",
 	}
-	cache.guildCache["testcache"] = &testguild
+	cache.guilds.entries["testcache"] = &testguild
 	if hc, err := cache.Guild("testcache"); hc.ID != testguild.ID || err != nil {
 		t.Error("Failed to hit cache for cached guild value")
 	}
@@ -183,24 +275,79 @@ func testGuildError(t *testing.T) {
 		return
 	}
 
-	if _, ok := cache.guildCache["abcd"]; ok {
+	if _, ok := cache.guilds.entries["abcd"]; ok {
 		t.Error("Guild cache contains non-existent user `abcd`")
 	}
 }
 
+func testMember(t *testing.T) {
+	provider := MockProvider{}
+	cache := NewCache(provider)
+
+	m, err := cache.Member("9101112", "5678")
+	if err != nil {
+		t.Fatal("Unexpected error from member retrieval:", err)
+	}
+	if m.User.ID != "5678" || len(m.Roles) != 1 {
+		t.Error("Incorrect member returned from retrieval")
+	}
+	if _, ok := cache.members.entries[memberKey("9101112", "5678")]; !ok {
+		t.Error("Failed to insert member into lookup cache")
+	}
+
+	if _, err := cache.Member("9101112", "abcd"); err == nil {
+		t.Error("Expected error from non-existent member `abcd`")
+	}
+	if err := cache.InvalidateMember("9101112", "5678"); err != nil {
+		t.Error("Unexpected error from member invalidation:", err)
+	}
+	if _, ok := cache.members.entries[memberKey("9101112", "5678")]; ok {
+		t.Error("Member cache contains invalidated member")
+	}
+}
+
+func testRoles(t *testing.T) {
+	provider := MockProvider{}
+	cache := NewCache(provider)
+
+	r, err := cache.Roles("9101112")
+	if err != nil {
+		t.Fatal("Unexpected error from role retrieval:", err)
+	}
+	if len(r) != 2 || r[0].Name != "Testing Role" {
+		t.Error("Incorrect roles returned from retrieval")
+	}
+	if _, ok := cache.roles.entries["9101112"]; !ok {
+		t.Error("Failed to insert roles into lookup cache")
+	}
+
+	if _, err := cache.Roles("abcd"); err == nil {
+		t.Error("Expected error from non-existent guild `abcd`")
+	}
+	if _, ok := cache.roles.entries["abcd"]; ok {
+		t.Error("Role cache contains non-existent guild `abcd`")
+	}
+}
+
 func TestRetrieval(t *testing.T) {
 	t.Run("Channel", testChannel)
 	t.Run("ChannelError", testChannelError)
+	t.Run("Parent", testParent)
+	t.Run("Category", testCategory)
 
 	t.Run("User", testUser)
 	t.Run("UserError", testUserError)
 
 	t.Run("Guild", testGuild)
 	t.Run("GuildError", testGuildError)
+
+	t.Run("Member", testMember)
+	t.Run("Roles", testRoles)
 }
 
 func testAttachment(t *testing.T) {
-	url := "https://imgs.xkcd.com/comics/circuit_diagram.png"
+	srv, _ := attachmentServer(t)
+	url := srv.URL + "/circuit_diagram/1024?type=image/png"
 	provider := MockProvider{}
 	cache := NewCache(provider)
 
@@ -216,7 +363,7 @@ func testAttachment(t *testing.T) {
 		t.Fatalf("Unexpected error from known good URL: %s", err.Error())
 	}
 
-	ret, ok := cache.attachmentCache[url]
+	ret, ok := cache.attachments.entries[url]
 	if !ok {
 		t.Errorf("Cache did not insert attachment correctly to cache map")
 	}
@@ -224,21 +371,25 @@ func testAttachment(t *testing.T) {
 
 	// After new reference, the current time should be later than
 	cache.Attachment(att)
-	nret := cache.attachmentCache[url]
+	nret := cache.attachments.entries[url]
 	if nret.LastReference.Sub(firstTime) <= 0 {
 		t.Errorf("Bad timing value after new reference\nexpect time after: %v\ngot: %v", firstTime, nret.LastReference)
 	}
 }
 
 func testAttachmentFailure(t *testing.T) {
+	srv, _ := attachmentServer(t)
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
 	provider := MockProvider{}
-	cache := NewCache(provider)
+	cache := NewCacheOptions(provider, Options{FetchBackoff: time.Millisecond})
 	cases := []struct {
 		URL    string
 		Expect error
 	}{
-		{"https://example.com/notexist.png", ErrGetFailed},
-		{"http://doesnotexist.gov.uk/", ErrRequest},
+		{srv.URL + "/notexist.png", ErrGetFailed},
+		{gone.URL + "/1024", ErrRequest},
 	}
 
 	for _, c := range cases {
@@ -257,7 +408,7 @@ func testAttachmentFailure(t *testing.T) {
 		if !errors.Is(err, c.Expect) {
 			t.Errorf("%s: wrong error\nexpect: %s\ngot: %s", c.URL, c.Expect.Error(), err.Error())
 		}
-		if _, ok := cache.attachmentCache[c.URL]; ok {
+		if _, ok := cache.attachments.entries[c.URL]; ok {
 			t.Errorf("%s: inserted into cache despite error in download", c.URL)
 		}
 	}
@@ -273,42 +424,394 @@ func testCacheCleanRef(t *testing.T) {
 	c := NewCache(MockProvider{})
 
 	// Attachment referenced 24 hours in the future - will not be deleted
-	c.attachmentCache["0"] = &Attachment{
+	c.attachments.entries["0"] = &Attachment{
 		Name:          "0",
 		LastReference: time.Now().Add(time.Hour * 24),
 	}
 	// Attachment last referenced two deletion cycles ago - *will* be deleted
-	c.attachmentCache["1"] = &Attachment{
+	c.attachments.entries["1"] = &Attachment{
 		Name:          "1",
 		LastReference: time.Now().Add(-2 * AttachmentLifetime),
 	}
 	c.Clean()
 
-	if _, ok := c.attachmentCache["0"]; !ok {
+	if _, ok := c.attachments.entries["0"]; !ok {
 		t.Error("element '0' was wrongfully removed from cache")
 	}
-	if _, ok := c.attachmentCache["1"]; ok {
+	if _, ok := c.attachments.entries["1"]; ok {
 		t.Error("element '1' was wrongfully saved from removal from cache")
 	}
 }
 
-// Tests cleaning the cache based on the count in the cache.
-func testCacheCleanLeak(t *testing.T) {
-	c := NewCache(MockProvider{})
+func TestCache_Clean(t *testing.T) {
+	t.Run("Time", testCacheCleanRef)
+}
+
+// attachmentServer serves attachments of any size from /size/N, counting the
+// requests made. Attachments under /chunked/N are served without a length.
+// The content type and status may be set by the type and status query
+// parameters.
+func attachmentServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		if typ := r.URL.Query().Get("type"); typ != "" {
+			w.Header().Set("Content-Type", typ)
+		}
+		if status, err := strconv.Atoi(r.URL.Query().Get("status")); err == nil {
+			w.WriteHeader(status)
+			return
+		}
+
+		dir, size := path.Split(r.URL.Path)
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if dir != "/chunked/" {
+			w.Header().Set("Content-Length", size)
+		}
+		w.Write(bytes.Repeat([]byte{'a'}, n))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &requests
+}
 
-	// 100 excess elements - should be pruned down to the prune threshold
-	for i := int64(2); i < AttachmentPruneThreshold+100; i++ {
-		str := strconv.FormatInt(i, 10)
-		c.attachmentCache[str] = &Attachment{Name: str}
+// attachmentAt returns an attachment to be downloaded from name on srv.
+func attachmentAt(srv *httptest.Server, name string) *discordgo.MessageAttachment {
+	return &discordgo.MessageAttachment{
+		URL:         srv.URL + name,
+		Filename:    "file.txt",
+		ContentType: "text/plain",
 	}
-	c.Clean()
+}
 
-	if len(c.attachmentCache) > AttachmentPruneThreshold {
-		t.Errorf("expected cache to reduce size to len() = %d, got len() = %d", AttachmentPruneThreshold, len(c.attachmentCache))
+func testBudget(t *testing.T) {
+	srv, _ := attachmentServer(t)
+	c := NewCacheOptions(MockProvider{}, Options{MemoryBudget: 100, SpillSize: 40})
+
+	for _, name := range []string{"/a/30", "/b/30", "/c/30"} {
+		if _, err := c.Attachment(attachmentAt(srv, name)); err != nil {
+			t.Fatal("Unexpected error from attachment download:", err)
+		}
+	}
+	// Now most recently used, so b is the least
+	c.Attachment(attachmentAt(srv, "/a/30"))
+	a, err := c.Attachment(attachmentAt(srv, "/d/30"))
+	if err != nil {
+		t.Fatal("Unexpected error from attachment download:", err)
+	}
+
+	if a.Size != 30 || len(a.Content) != 30 || a.Path != "" {
+		t.Errorf("Attachment not held in memory: size %d, content %d bytes, path %q", a.Size, len(a.Content), a.Path)
+	}
+	for _, name := range []string{"/a/30", "/c/30", "/d/30"} {
+		if _, ok := c.attachments.load(srv.URL + name); !ok {
+			t.Errorf("%s wrongfully evicted", name)
+		}
+	}
+	if _, ok := c.attachments.load(srv.URL + "/b/30"); ok {
+		t.Error("Least recently used attachment not evicted")
+	}
+	if c.used != 90 {
+		t.Errorf("Expected 90 bytes used, got %d", c.used)
 	}
 }
 
-func TestCache_Clean(t *testing.T) {
-	t.Run("Time", testCacheCleanRef)
-	t.Run("Count", testCacheCleanLeak)
+func testSpill(t *testing.T) {
+	srv, _ := attachmentServer(t)
+	dir := t.TempDir()
+	c := NewCacheOptions(MockProvider{}, Options{SpillSize: 10, Dir: dir})
+
+	for _, name := range []string{"/50", "/chunked/50"} {
+		a, err := c.Attachment(attachmentAt(srv, name))
+		if err != nil {
+			t.Fatal("Unexpected error from attachment download:", err)
+		}
+		if a.Content != nil || a.Path == "" || filepath.Dir(a.Path) != dir {
+			t.Fatalf("%s: attachment not spilled to %s: content %d bytes, path %q", name, dir, len(a.Content), a.Path)
+		}
+		if info, err := os.Stat(a.Path); err != nil || info.Size() != 50 || a.Size != 50 {
+			t.Errorf("%s: wrong size of spilled attachment: %d (%v)", name, a.Size, err)
+		}
+		if c.used != 0 {
+			t.Errorf("%s: spilled attachment counted against memory budget", name)
+		}
+
+		c.InvalidateAttachment(srv.URL + name)
+		if _, err := os.Stat(a.Path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: spilled file not removed on eviction", name)
+		}
+	}
+}
+
+func testHold(t *testing.T) {
+	srv, _ := attachmentServer(t)
+	c := NewCacheOptions(MockProvider{}, Options{SpillSize: 10, Dir: t.TempDir()})
+
+	a, err := c.Attachment(attachmentAt(srv, "/50"))
+	if err != nil {
+		t.Fatal("Unexpected error from attachment download:", err)
+	}
+	c.Hold(a.Path)
+	c.Hold(a.Path)
+
+	c.InvalidateAttachment(srv.URL + "/50")
+	for i := 0; i < 2; i++ {
+		if _, err := os.Stat(a.Path); err != nil {
+			t.Fatalf("Held file removed on eviction with %d holds remaining: %v", 2-i, err)
+		}
+		c.Release(a.Path)
+	}
+	if _, err := os.Stat(a.Path); !errors.Is(err, os.ErrNotExist) {
+		t.Error("Evicted file not removed once released")
+	}
+
+	// Released before eviction, so removed as normal
+	a, _ = c.Attachment(attachmentAt(srv, "/50"))
+	c.Hold(a.Path)
+	c.Release(a.Path)
+	c.InvalidateAttachment(srv.URL + "/50")
+	if _, err := os.Stat(a.Path); !errors.Is(err, os.ErrNotExist) {
+		t.Error("Released file not removed on eviction")
+	}
+}
+
+func testTooLarge(t *testing.T) {
+	srv, requests := attachmentServer(t)
+	dir := t.TempDir()
+	c := NewCacheOptions(MockProvider{}, Options{MaxAttachmentSize: 20, SpillSize: 10, Dir: dir})
+
+	for _, name := range []string{"/50", "/chunked/50"} {
+		if _, err := c.Attachment(attachmentAt(srv, name)); !errors.Is(err, ErrTooLarge) {
+			t.Errorf("%s: expected %v, got %v", name, ErrTooLarge, err)
+		}
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Error("Files left behind by oversized attachments:", files)
+	}
+
+	// Known to be too large, so not requested
+	before := requests.Load()
+	at := attachmentAt(srv, "/50")
+	at.Size = 50
+	if _, err := c.Attachment(at); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expected %v, got %v", ErrTooLarge, err)
+	}
+	if requests.Load() != before {
+		t.Error("Attachment known to be too large was requested")
+	}
+
+	if _, err := c.Attachment(attachmentAt(srv, "/20")); err != nil {
+		t.Error("Unexpected error from attachment of maximum size:", err)
+	}
+}
+
+func testClose(t *testing.T) {
+	srv, _ := attachmentServer(t)
+	c := NewCacheOptions(MockProvider{}, Options{SpillSize: 10})
+
+	a, err := c.Attachment(attachmentAt(srv, "/50"))
+	if err != nil {
+		t.Fatal("Unexpected error from attachment download:", err)
+	}
+	dir := filepath.Dir(a.Path)
+	if err := c.Close(); err != nil {
+		t.Error("Unexpected error from close:", err)
+	}
+	if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Error("Temporary directory not removed on close")
+	}
+}
+
+func TestCache_Limits(t *testing.T) {
+	t.Run("Budget", testBudget)
+	t.Run("Spill", testSpill)
+	t.Run("Hold", testHold)
+	t.Run("TooLarge", testTooLarge)
+	t.Run("Close", testClose)
+}
+
+// countingProvider wraps MockProvider, counting the lookups made and holding
+// each until release is closed, such that concurrent lookups overlap.
+type countingProvider struct {
+	MockProvider
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func newCountingProvider() *countingProvider {
+	return &countingProvider{release: make(chan struct{})}
+}
+
+func (p *countingProvider) Channel(channelID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	p.calls.Add(1)
+	<-p.release
+	return p.MockProvider.Channel(channelID)
+}
+
+func (p *countingProvider) User(userID string, options ...discordgo.RequestOption) (*discordgo.User, error) {
+	p.calls.Add(1)
+	<-p.release
+	return p.MockProvider.User(userID)
+}
+
+func (p *countingProvider) Guild(guildID string, options ...discordgo.RequestOption) (*discordgo.Guild, error) {
+	p.calls.Add(1)
+	<-p.release
+	return p.MockProvider.Guild(guildID)
+}
+
+// concurrently runs f from n goroutines at once, waiting for all of them to
+// start before closing release and for all of them to finish before returning.
+func concurrently(n int, release chan struct{}, f func()) {
+	var started, done sync.WaitGroup
+	started.Add(n)
+	done.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer done.Done()
+			started.Done()
+			f()
+		}()
+	}
+
+	started.Wait()
+	// Give the goroutines time to reach the provider
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	done.Wait()
+}
+
+func testCoalesce(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Lookup func(c *Cache) error
+	}{
+		{"Channel", func(c *Cache) error { _, err := c.Channel("1234"); return err }},
+		{"User", func(c *Cache) error { _, err := c.User("5678"); return err }},
+		{"Guild", func(c *Cache) error { _, err := c.Guild("9101112"); return err }},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			p := newCountingProvider()
+			cache := NewCache(p)
+
+			var failed atomic.Int32
+			concurrently(50, p.release, func() {
+				if err := c.Lookup(cache); err != nil {
+					failed.Add(1)
+				}
+			})
+
+			if n := failed.Load(); n != 0 {
+				t.Errorf("%d lookups failed", n)
+			}
+			if n := p.calls.Load(); n != 1 {
+				t.Errorf("expected 1 provider call, got %d", n)
+			}
+			// Now cached
+			if err := c.Lookup(cache); err != nil || p.calls.Load() != 1 {
+				t.Errorf("cached lookup made a provider call (err: %v)", err)
+			}
+		})
+	}
+}
+
+func testCoalesceError(t *testing.T) {
+	p := newCountingProvider()
+	cache := NewCache(p)
+
+	var failed atomic.Int32
+	concurrently(50, p.release, func() {
+		if _, err := cache.Channel("nonexistent"); errors.Is(err, ErrMissing) {
+			failed.Add(1)
+		}
+	})
+
+	if n := failed.Load(); n != 50 {
+		t.Errorf("expected all 50 lookups to fail, %d did", n)
+	}
+	if n := p.calls.Load(); n != 1 {
+		t.Errorf("expected 1 provider call, got %d", n)
+	}
+
+	// Errors are not cached
+	cache.Channel("nonexistent")
+	if n := p.calls.Load(); n != 2 {
+		t.Errorf("failed lookup was cached: expected 2 provider calls, got %d", n)
+	}
+}
+
+func testInvalidateDuringLookup(t *testing.T) {
+	p := newCountingProvider()
+	cache := NewCache(p)
+
+	done := make(chan struct{})
+	go func() {
+		cache.Channel("1234")
+		close(done)
+	}()
+	for p.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Invalidated while the lookup is in progress, so its result may be stale
+	cache.InvalidateChannel("1234")
+	close(p.release)
+	<-done
+
+	if _, ok := cache.channels.load("1234"); ok {
+		t.Error("result of lookup invalidated while in progress was cached")
+	}
+}
+
+// Tests for data races on the cache maps; run with -race.
+func testRace(t *testing.T) {
+	c := NewCache(MockProvider{})
+	for i := 0; i < 100; i++ {
+		str := strconv.Itoa(i)
+		c.attachments.entries[str] = &Attachment{Name: str, LastReference: time.Now()}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				c.Channel("1234")
+				c.Channel("4321")
+				c.Category(discordgo.Channel{ID: "4321", ParentID: "1234", Type: discordgo.ChannelTypeGuildPublicThread})
+				c.User("5678")
+				c.Guild("9101112")
+				c.Member("9101112", "5678")
+				c.Roles("9101112")
+				c.Clean()
+
+				switch (i + j) % 4 {
+				case 0:
+					c.InvalidateChannel("1234")
+				case 1:
+					c.InvalidateMember("9101112", "5678")
+				case 2:
+					c.InvalidateRoles("9101112")
+				case 3:
+					c.InvalidateGuild("9101112")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestConcurrency(t *testing.T) {
+	t.Run("Coalesce", testCoalesce)
+	t.Run("CoalesceError", testCoalesceError)
+	t.Run("InvalidateDuringLookup", testInvalidateDuringLookup)
+	t.Run("Race", testRace)
 }
@@ -0,0 +1,301 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Persistent store constants.
+const (
+	// Minimum interval between applications of the retention policy of a
+	// persistent store, which walks the whole store.
+	StorePruneInterval = time.Minute
+	// Age after which files left in the temporary directory of a
+	// persistent store, such as by a crash mid-download, are removed.
+	storeTempLifetime = time.Hour
+)
+
+// disk is a persistent, content-addressed store of attachments. Content is
+// kept in objects/, named by its SHA-256 hash, such that identical content
+// downloaded from several URLs is only stored once and always has the same
+// path. Each URL downloaded has an entry in index/ naming the hash of its
+// content, whose modification time is the last time it was used.
+//
+// Attachments are kept until the retention policy removes their index entry,
+// after which any content no longer named by an entry is removed.
+type disk struct {
+	dir       string
+	retention time.Duration
+	maxSize   int64
+
+	// Serialises changes to the store, such that content is not removed
+	// while an entry naming it is being added
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+// diskEntry is an entry in the index of a disk store.
+type diskEntry struct {
+	URL  string `json:"url"`
+	Hash string `json:"hash"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+}
+
+// tempDir returns the directory in which attachments are downloaded before
+// being added, which is on the same filesystem as the store.
+func (d *disk) tempDir() string {
+	return filepath.Join(d.dir, "tmp")
+}
+
+// objectPath returns the path of the content with the given hash.
+func (d *disk) objectPath(hash string) string {
+	return filepath.Join(d.dir, "objects", hash[:2], hash)
+}
+
+// indexPath returns the path of the index entry for url.
+func (d *disk) indexPath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(d.dir, "index", hex.EncodeToString(sum[:])+".json")
+}
+
+// lookup returns the attachment stored for url, if any, marking it as used.
+func (d *disk) lookup(url string) (*Attachment, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	idx := d.indexPath(url)
+	buf, err := os.ReadFile(idx)
+	if err != nil {
+		return nil, false
+	}
+	var e diskEntry
+	if err := json.Unmarshal(buf, &e); err != nil || e.URL != url || len(e.Hash) != sha256.Size*2 {
+		return nil, false
+	}
+	path := d.objectPath(e.Hash)
+	if _, err := os.Stat(path); err != nil {
+		os.Remove(idx)
+		return nil, false
+	}
+
+	now := time.Now()
+	os.Chtimes(idx, now, now)
+	return &Attachment{
+		Name:          e.Name,
+		Type:          e.Type,
+		Size:          e.Size,
+		Path:          path,
+		Hash:          e.Hash,
+		LastReference: now,
+	}, true
+}
+
+// add stores the content of a, downloaded from url, setting its Path to the
+// stored copy. The content is either a.Content or, if a.Path is set, the file
+// at a.Path, which must be in tempDir and is moved into the store. a.Hash must
+// be the hash of the content.
+func (d *disk) add(url string, a *Attachment) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	path := d.objectPath(a.Hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		if a.Path != "" {
+			os.Remove(a.Path)
+		}
+		return err
+	}
+
+	switch _, err := os.Stat(path); {
+	case err == nil:
+		// Already stored from elsewhere
+		if a.Path != "" {
+			os.Remove(a.Path)
+		}
+	case a.Path != "":
+		if err := os.Rename(a.Path, path); err != nil {
+			os.Remove(a.Path)
+			return err
+		}
+	default:
+		if err := writeAtomic(d.tempDir(), path, a.Content); err != nil {
+			return err
+		}
+	}
+	a.Path = path
+
+	buf, err := json.Marshal(diskEntry{URL: url, Hash: a.Hash, Name: a.Name, Type: a.Type, Size: a.Size})
+	if err != nil {
+		return err
+	}
+	idx := d.indexPath(url)
+	if err := os.MkdirAll(filepath.Dir(idx), 0o755); err != nil {
+		return err
+	}
+	return writeAtomic(d.tempDir(), idx, buf)
+}
+
+// writeAtomic writes buf to path by way of a temporary file in tmp, such that
+// path is never seen partially written.
+func writeAtomic(tmp, path string, buf []byte) error {
+	if err := os.MkdirAll(tmp, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(tmp, "write-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(buf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// prune applies the retention policy of the store, unless it was already
+// applied within StorePruneInterval. Index entries unused for longer than the
+// retention period are removed, followed by the least recently used entries
+// until the content they name fits within the maximum size. Content named by
+// no remaining entry is then removed. The URLs of the entries removed are
+// returned.
+//
+// Entries and content whose path is in held are kept, as they are still in
+// use, and their paths returned as deferred, such that the policy may be
+// applied again once they are released (see retry).
+func (d *disk) prune(now time.Time, held map[string]bool) (removed, deferred []string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.lastPrune) < StorePruneInterval {
+		return nil, nil, nil
+	}
+	d.lastPrune = now
+
+	type entry struct {
+		diskEntry
+		path string
+		used time.Time
+	}
+	var entries []entry
+	// remove removes e, returning false if it is held
+	remove := func(e entry) bool {
+		if path := d.objectPath(e.Hash); held[path] {
+			deferred = append(deferred, path)
+			return false
+		}
+		if err := os.Remove(e.path); err == nil || errors.Is(err, fs.ErrNotExist) {
+			removed = append(removed, e.URL)
+		}
+		return true
+	}
+
+	files, err := os.ReadDir(filepath.Join(d.dir, "index"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+	for _, f := range files {
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		e := entry{path: filepath.Join(d.dir, "index", f.Name()), used: info.ModTime()}
+		if buf, err := os.ReadFile(e.path); err != nil || json.Unmarshal(buf, &e.diskEntry) != nil {
+			// Unreadable entries are useless
+			os.Remove(e.path)
+			continue
+		}
+
+		if d.retention > 0 && now.Sub(e.used) > d.retention && remove(e) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	// Count the size of each piece of content once, however many entries
+	// name it
+	refs := make(map[string]int, len(entries))
+	var size int64
+	for _, e := range entries {
+		if refs[e.Hash] == 0 {
+			size += e.Size
+		}
+		refs[e.Hash]++
+	}
+	if d.maxSize > 0 && size > d.maxSize {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].used.Before(entries[j].used)
+		})
+		for _, e := range entries {
+			if size <= d.maxSize {
+				break
+			}
+			if !remove(e) {
+				continue
+			}
+			if refs[e.Hash]--; refs[e.Hash] == 0 {
+				size -= e.Size
+			}
+		}
+	}
+
+	err = d.sweep(refs, held, now)
+	return removed, deferred, err
+}
+
+// retry causes the retention policy to be applied by the next call to prune,
+// however soon, such as once content it deferred is released.
+func (d *disk) retry() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lastPrune = time.Time{}
+}
+
+// sweep removes content neither named in refs nor held, and any temporary files
+// left over from downloads which did not finish.
+func (d *disk) sweep(refs map[string]int, held map[string]bool, now time.Time) error {
+	objects := filepath.Join(d.dir, "objects")
+	err := filepath.WalkDir(objects, func(path string, f fs.DirEntry, err error) error {
+		if err != nil || f.IsDir() {
+			return err
+		}
+		if refs[f.Name()] == 0 && !held[path] {
+			os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	files, _ := os.ReadDir(d.tempDir())
+	for _, f := range files {
+		if info, err := f.Info(); err == nil && now.Sub(info.ModTime()) > storeTempLifetime {
+			os.Remove(filepath.Join(d.tempDir(), f.Name()))
+		}
+	}
+	return nil
+}
+
+// storeError wraps an error from a disk store.
+func storeError(err error) error {
+	return fmt.Errorf("%w: store: %s", ErrIO, err.Error())
+}
@@ -0,0 +1,246 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// storeFiles returns the names of the files in dir of a store.
+func storeFiles(t *testing.T, store, dir string) []string {
+	var ret []string
+	filepath.WalkDir(filepath.Join(store, dir), func(path string, f os.DirEntry, err error) error {
+		if err == nil && !f.IsDir() {
+			ret = append(ret, f.Name())
+		}
+		return nil
+	})
+	return ret
+}
+
+func testStoreDedup(t *testing.T) {
+	srv, _ := attachmentServer(t)
+	dir := t.TempDir()
+	c := NewCacheOptions(MockProvider{}, Options{SpillSize: 10, StoreDir: dir})
+
+	for _, pair := range [][2]string{{"/a/5", "/b/5"}, {"/c/50", "/chunked/50"}} {
+		first, err := c.Attachment(attachmentAt(srv, pair[0]))
+		if err != nil {
+			t.Fatal("Unexpected error from attachment download:", err)
+		}
+		second, err := c.Attachment(attachmentAt(srv, pair[1]))
+		if err != nil {
+			t.Fatal("Unexpected error from attachment download:", err)
+		}
+
+		if first.Hash == "" || first.Hash != second.Hash || first.Path != second.Path {
+			t.Errorf("%v: identical content stored twice: %s (%s), %s (%s)", pair, first.Path, first.Hash, second.Path, second.Hash)
+		}
+		if rel, err := filepath.Rel(dir, first.Path); err != nil || filepath.Base(rel) != first.Hash {
+			t.Errorf("%v: content not stored by hash: %s", pair, first.Path)
+		}
+		if buf, err := os.ReadFile(first.Path); err != nil || int64(len(buf)) != first.Size {
+			t.Errorf("%v: stored content of wrong size: %d bytes (%v)", pair, len(buf), err)
+		}
+	}
+
+	if objects := storeFiles(t, dir, "objects"); len(objects) != 2 {
+		t.Error("Expected 2 objects in store, got", objects)
+	}
+	if index := storeFiles(t, dir, "index"); len(index) != 4 {
+		t.Error("Expected 4 index entries, got", index)
+	}
+	if tmp := storeFiles(t, dir, "tmp"); len(tmp) != 0 {
+		t.Error("Temporary files left in store:", tmp)
+	}
+}
+
+func testStorePersist(t *testing.T) {
+	srv, requests := attachmentServer(t)
+	dir := t.TempDir()
+
+	c := NewCacheOptions(MockProvider{}, Options{SpillSize: 10, StoreDir: dir})
+	small, err := c.Attachment(attachmentAt(srv, "/5"))
+	if err != nil {
+		t.Fatal("Unexpected error from attachment download:", err)
+	}
+	large, err := c.Attachment(attachmentAt(srv, "/50"))
+	if err != nil {
+		t.Fatal("Unexpected error from attachment download:", err)
+	}
+	if small.Content == nil || small.Path == "" {
+		t.Error("Small stored attachment not held in memory and on disk")
+	}
+	if err := c.Close(); err != nil {
+		t.Error("Unexpected error from close:", err)
+	}
+
+	// Restarted, with nothing in memory
+	before := requests.Load()
+	c = NewCacheOptions(MockProvider{}, Options{SpillSize: 10, StoreDir: dir})
+	for _, expect := range []Attachment{small, large} {
+		at := attachmentAt(srv, "/"+strconv.FormatInt(expect.Size, 10))
+		got, err := c.Attachment(at)
+		if err != nil {
+			t.Fatal("Unexpected error from stored attachment:", err)
+		}
+		if got.Path != expect.Path || got.Hash != expect.Hash || got.Size != expect.Size || got.Name != at.Filename {
+			t.Errorf("Stored attachment changed: %+v, expected %+v", got, expect)
+		}
+	}
+	if requests.Load() != before {
+		t.Error("Stored attachment downloaded again")
+	}
+
+	// Eviction from memory leaves the store alone
+	c.InvalidateAttachment(srv.URL + "/50")
+	if _, err := os.Stat(large.Path); err != nil {
+		t.Error("Stored attachment removed on eviction:", err)
+	}
+}
+
+// age sets the last use of the index entry for url in the store of c.
+func age(t *testing.T, c *Cache, url string, by time.Duration) {
+	when := time.Now().Add(-by)
+	if err := os.Chtimes(c.disk.indexPath(url), when, when); err != nil {
+		t.Fatal("Unexpected error ageing index entry:", err)
+	}
+}
+
+func testStoreRetention(t *testing.T) {
+	srv, _ := attachmentServer(t)
+	dir := t.TempDir()
+	c := NewCacheOptions(MockProvider{}, Options{SpillSize: 10, StoreDir: dir, Retention: time.Hour})
+
+	old, _ := c.Attachment(attachmentAt(srv, "/5"))
+	recent, _ := c.Attachment(attachmentAt(srv, "/50"))
+	// Shares content with recent, so must be kept
+	c.Attachment(attachmentAt(srv, "/chunked/50"))
+	age(t, c, srv.URL+"/5", 2*time.Hour)
+	age(t, c, srv.URL+"/chunked/50", 2*time.Hour)
+
+	if err := c.Clean(); err != nil {
+		t.Fatal("Unexpected error from clean:", err)
+	}
+	if _, err := os.Stat(old.Path); !os.IsNotExist(err) {
+		t.Error("Attachment beyond retention period not removed")
+	}
+	if _, ok := c.attachments.load(srv.URL + "/5"); ok {
+		t.Error("Removed attachment still cached in memory")
+	}
+	if _, err := os.Stat(recent.Path); err != nil {
+		t.Error("Attachment within retention period removed:", err)
+	}
+	if index := storeFiles(t, dir, "index"); len(index) != 1 {
+		t.Error("Expected 1 index entry to remain, got", index)
+	}
+
+	// Applied at most once per interval
+	c.Attachment(attachmentAt(srv, "/6"))
+	age(t, c, srv.URL+"/6", 2*time.Hour)
+	c.Clean()
+	if index := storeFiles(t, dir, "index"); len(index) != 2 {
+		t.Error("Retention applied again within interval")
+	}
+}
+
+func testStoreMaxSize(t *testing.T) {
+	srv, _ := attachmentServer(t)
+	dir := t.TempDir()
+	c := NewCacheOptions(MockProvider{}, Options{SpillSize: 10, StoreDir: dir, MaxStoreSize: 100})
+
+	for i, name := range []string{"/30", "/40", "/50"} {
+		if _, err := c.Attachment(attachmentAt(srv, name)); err != nil {
+			t.Fatal("Unexpected error from attachment download:", err)
+		}
+		age(t, c, srv.URL+name, time.Duration(3-i)*time.Minute)
+	}
+
+	if err := c.Clean(); err != nil {
+		t.Fatal("Unexpected error from clean:", err)
+	}
+	if objects := storeFiles(t, dir, "objects"); len(objects) != 2 {
+		t.Error("Expected 2 objects to remain, got", objects)
+	}
+	if _, ok := c.disk.lookup(srv.URL + "/30"); ok {
+		t.Error("Least recently used attachment not removed")
+	}
+	if _, ok := c.disk.lookup(srv.URL + "/50"); !ok {
+		t.Error("Most recently used attachment removed")
+	}
+}
+
+func testStoreHold(t *testing.T) {
+	srv, _ := attachmentServer(t)
+	dir := t.TempDir()
+	c := NewCacheOptions(MockProvider{}, Options{SpillSize: 10, StoreDir: dir, Retention: time.Hour, MaxStoreSize: 10})
+
+	held, _ := c.Attachment(attachmentAt(srv, "/50"))
+	free, _ := c.Attachment(attachmentAt(srv, "/a/40"))
+	c.Hold(held.Path)
+	age(t, c, srv.URL+"/50", 2*time.Hour)
+
+	if err := c.Clean(); err != nil {
+		t.Fatal("Unexpected error from clean:", err)
+	}
+	if _, err := os.Stat(held.Path); err != nil {
+		t.Fatal("Held attachment removed from store:", err)
+	}
+	if _, err := os.Stat(free.Path); !os.IsNotExist(err) {
+		t.Error("Attachment over maximum size not removed while another was held")
+	}
+
+	// Applied again once released, despite the interval
+	c.Release(held.Path)
+	if err := c.Clean(); err != nil {
+		t.Fatal("Unexpected error from clean:", err)
+	}
+	if _, err := os.Stat(held.Path); !os.IsNotExist(err) {
+		t.Error("Released attachment beyond retention period not removed")
+	}
+	if _, ok := c.attachments.load(srv.URL + "/50"); ok {
+		t.Error("Removed attachment still cached in memory")
+	}
+}
+
+func testStoreCleanLookup(t *testing.T) {
+	srv, _ := attachmentServer(t)
+	c := NewCacheOptions(MockProvider{}, Options{SpillSize: 10, StoreDir: t.TempDir()})
+	if _, err := c.Attachment(attachmentAt(srv, "/5")); err != nil {
+		t.Fatal("Unexpected error from attachment download:", err)
+	}
+
+	// Hold up pruning, which must not hold up lookups of cached attachments
+	c.disk.mu.Lock()
+	cleaned := make(chan struct{})
+	go func() {
+		c.Clean()
+		close(cleaned)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	looked := make(chan struct{})
+	go func() {
+		c.Attachment(attachmentAt(srv, "/5"))
+		close(looked)
+	}()
+	select {
+	case <-looked:
+	case <-time.After(time.Second):
+		t.Error("Lookup blocked by pruning of store")
+	}
+	c.disk.mu.Unlock()
+	<-cleaned
+	<-looked
+}
+
+func TestStore(t *testing.T) {
+	t.Run("Dedup", testStoreDedup)
+	t.Run("Persist", testStorePersist)
+	t.Run("Retention", testStoreRetention)
+	t.Run("MaxSize", testStoreMaxSize)
+	t.Run("Hold", testStoreHold)
+	t.Run("CleanLookup", testStoreCleanLookup)
+}
@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Handle updates the cache from a Discord gateway event, such that entries are
+// not left stale once the objects they hold change. It is intended to be added
+// as a handler of the session used as the provider of the cache:
+//
+//	s.AddHandler(c.Handle)
+//
+// Cached channels, threads, guilds and users which change are replaced by their
+// new state, while those which are deleted are invalidated, along with
+// anything cached for a deleted guild. Changes to guild members and roles
+// invalidate the cached member or roles. Other events are ignored.
+func (c *Cache) Handle(s *discordgo.Session, e interface{}) {
+	switch e := e.(type) {
+	case *discordgo.ChannelUpdate:
+		if e.Channel != nil {
+			c.replaceChannel(e.Channel)
+		}
+	case *discordgo.ThreadUpdate:
+		if e.Channel != nil {
+			c.replaceChannel(e.Channel)
+		}
+	case *discordgo.ChannelDelete:
+		if e.Channel != nil {
+			c.InvalidateChannel(e.ID)
+		}
+	case *discordgo.ThreadDelete:
+		if e.Channel != nil {
+			c.InvalidateChannel(e.ID)
+		}
+
+	case *discordgo.GuildUpdate:
+		if e.Guild != nil {
+			g := *e.Guild
+			c.guilds.replace(g.ID, &g)
+		}
+	case *discordgo.GuildDelete:
+		if e.Guild != nil {
+			c.invalidateGuild(e.ID)
+		}
+
+	case *discordgo.UserUpdate:
+		if e.User != nil {
+			u := *e.User
+			c.users.replace(u.ID, &u)
+		}
+	case *discordgo.GuildMemberUpdate:
+		if e.Member != nil && e.User != nil {
+			u := *e.User
+			c.users.replace(u.ID, &u)
+			c.InvalidateMember(e.GuildID, u.ID)
+		}
+	case *discordgo.GuildMemberRemove:
+		if e.Member != nil && e.User != nil {
+			c.InvalidateMember(e.GuildID, e.User.ID)
+		}
+
+	case *discordgo.GuildRoleCreate:
+		if e.GuildRole != nil {
+			c.InvalidateRoles(e.GuildID)
+		}
+	case *discordgo.GuildRoleUpdate:
+		if e.GuildRole != nil {
+			c.InvalidateRoles(e.GuildID)
+		}
+	case *discordgo.GuildRoleDelete:
+		c.InvalidateRoles(e.GuildID)
+	}
+}
+
+// replaceChannel replaces the cached copy of ch, if any, with ch. The channel
+// is copied, as event objects are shared with other handlers.
+func (c *Cache) replaceChannel(ch *discordgo.Channel) {
+	cp := *ch
+	c.channels.replace(cp.ID, &cp)
+}
+
+// invalidateGuild invalidates the cache entries for a guild and its channels,
+// members and roles.
+func (c *Cache) invalidateGuild(ID string) {
+	c.InvalidateGuild(ID)
+	c.InvalidateRoles(ID)
+	c.channels.removeFunc(func(_ string, ch *discordgo.Channel) bool {
+		return ch.GuildID == ID
+	})
+	c.members.removeFunc(func(key string, _ *discordgo.Member) bool {
+		return strings.HasPrefix(key, memberKey(ID, ""))
+	})
+}
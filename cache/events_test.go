@@ -0,0 +1,173 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// cachedAll returns a cache holding every object known to MockProvider.
+func cachedAll(t *testing.T) *Cache {
+	c := NewCache(MockProvider{})
+	for _, id := range []string{"1234", "1111", "4321"} {
+		if _, err := c.Channel(id); err != nil {
+			t.Fatal("Unexpected error from channel retrieval:", err)
+		}
+	}
+	if _, err := c.Guild("9101112"); err != nil {
+		t.Fatal("Unexpected error from guild retrieval:", err)
+	}
+	if _, err := c.User("5678"); err != nil {
+		t.Fatal("Unexpected error from user retrieval:", err)
+	}
+	if _, err := c.Member("9101112", "5678"); err != nil {
+		t.Fatal("Unexpected error from member retrieval:", err)
+	}
+	if _, err := c.Roles("9101112"); err != nil {
+		t.Fatal("Unexpected error from roles retrieval:", err)
+	}
+
+	return c
+}
+
+func testHandleUpdate(t *testing.T) {
+	c := cachedAll(t)
+
+	c.Handle(nil, &discordgo.ChannelUpdate{Channel: &discordgo.Channel{ID: "1234", Name: "Renamed Channel", GuildID: "9101112"}})
+	c.Handle(nil, &discordgo.ThreadUpdate{Channel: &discordgo.Channel{ID: "4321", Name: "Renamed Thread", GuildID: "9101112"}})
+	c.Handle(nil, &discordgo.GuildUpdate{Guild: &discordgo.Guild{ID: "9101112", Name: "Renamed Server"}})
+	c.Handle(nil, &discordgo.UserUpdate{User: &discordgo.User{ID: "5678", Username: "renamed"}})
+
+	if ch, err := c.Channel("1234"); err != nil || ch.Name != "Renamed Channel" {
+		t.Errorf("Channel not refreshed: %q (%v)", ch.Name, err)
+	}
+	if ch, err := c.Channel("4321"); err != nil || ch.Name != "Renamed Thread" {
+		t.Errorf("Thread not refreshed: %q (%v)", ch.Name, err)
+	}
+	if g, err := c.Guild("9101112"); err != nil || g.Name != "Renamed Server" {
+		t.Errorf("Guild not refreshed: %q (%v)", g.Name, err)
+	}
+	if u, err := c.User("5678"); err != nil || u.Username != "renamed" {
+		t.Errorf("User not refreshed: %q (%v)", u.Username, err)
+	}
+
+	// Objects not already cached are not added
+	c.Handle(nil, &discordgo.ChannelUpdate{Channel: &discordgo.Channel{ID: "uncached"}})
+	if _, ok := c.channels.load("uncached"); ok {
+		t.Error("Update of uncached channel was cached")
+	}
+}
+
+func testHandleDelete(t *testing.T) {
+	c := cachedAll(t)
+
+	c.Handle(nil, &discordgo.ThreadDelete{Channel: &discordgo.Channel{ID: "4321"}})
+	if _, ok := c.channels.load("4321"); ok {
+		t.Error("Deleted thread still cached")
+	}
+	if _, ok := c.channels.load("1234"); !ok {
+		t.Error("Channel wrongfully invalidated by thread deletion")
+	}
+	c.Handle(nil, &discordgo.ChannelDelete{Channel: &discordgo.Channel{ID: "1234"}})
+	if _, ok := c.channels.load("1234"); ok {
+		t.Error("Deleted channel still cached")
+	}
+
+	c = cachedAll(t)
+	c.Handle(nil, &discordgo.GuildDelete{Guild: &discordgo.Guild{ID: "9101112"}})
+	for _, id := range []string{"1234", "1111", "4321"} {
+		if _, ok := c.channels.load(id); ok {
+			t.Errorf("Channel %s of deleted guild still cached", id)
+		}
+	}
+	if _, ok := c.guilds.load("9101112"); ok {
+		t.Error("Deleted guild still cached")
+	}
+	if _, ok := c.members.load(memberKey("9101112", "5678")); ok {
+		t.Error("Member of deleted guild still cached")
+	}
+	if _, ok := c.roles.load("9101112"); ok {
+		t.Error("Roles of deleted guild still cached")
+	}
+	if _, ok := c.users.load("5678"); !ok {
+		t.Error("User wrongfully invalidated by guild deletion")
+	}
+}
+
+func testHandleMembers(t *testing.T) {
+	events := []struct {
+		Name  string
+		Event interface{}
+		Kind  string
+	}{
+		{"MemberUpdate", &discordgo.GuildMemberUpdate{Member: &discordgo.Member{GuildID: "9101112", User: &discordgo.User{ID: "5678", Username: "renamed"}}}, "member"},
+		{"MemberRemove", &discordgo.GuildMemberRemove{Member: &discordgo.Member{GuildID: "9101112", User: &discordgo.User{ID: "5678"}}}, "member"},
+		{"RoleCreate", &discordgo.GuildRoleCreate{GuildRole: &discordgo.GuildRole{GuildID: "9101112", Role: &discordgo.Role{ID: "1"}}}, "roles"},
+		{"RoleUpdate", &discordgo.GuildRoleUpdate{GuildRole: &discordgo.GuildRole{GuildID: "9101112", Role: &discordgo.Role{ID: "1314"}}}, "roles"},
+		{"RoleDelete", &discordgo.GuildRoleDelete{GuildID: "9101112", RoleID: "1314"}, "roles"},
+	}
+
+	for _, e := range events {
+		t.Run(e.Name, func(t *testing.T) {
+			c := cachedAll(t)
+			c.Handle(nil, e.Event)
+
+			_, member := c.members.load(memberKey("9101112", "5678"))
+			_, roles := c.roles.load("9101112")
+			if member == (e.Kind == "member") || roles == (e.Kind == "roles") {
+				t.Errorf("Wrong entries invalidated: member cached %v, roles cached %v", member, roles)
+			}
+		})
+	}
+
+	c := cachedAll(t)
+	c.Handle(nil, events[0].Event)
+	if u, _ := c.User("5678"); u.Username != "renamed" {
+		t.Error("User not refreshed by member update")
+	}
+}
+
+func TestCache_TTL(t *testing.T) {
+	p := newCountingProvider()
+	close(p.release)
+	c := NewCacheOptions(p, Options{ChannelTTL: time.Hour})
+
+	c.Channel("1234")
+	c.Channel("1234")
+	if n := p.calls.Load(); n != 1 {
+		t.Fatalf("expected 1 provider call before expiry, got %d", n)
+	}
+
+	c.channels.expires["1234"] = time.Now().Add(-time.Second)
+	if _, ok := c.channels.load("1234"); ok {
+		t.Error("Expired channel still loaded")
+	}
+	if _, err := c.Channel("1234"); err != nil {
+		t.Error("Unexpected error from channel retrieval:", err)
+	}
+	if n := p.calls.Load(); n != 2 {
+		t.Errorf("expected expired channel to be looked up again, got %d provider calls", n)
+	}
+
+	// Other kinds have no TTL
+	c.Guild("9101112")
+	if _, ok := c.guilds.expires["9101112"]; ok {
+		t.Error("Guild given a TTL")
+	}
+
+	// Invalidation is unaffected
+	if err := c.InvalidateChannel("1234"); err != nil {
+		t.Error("Unexpected error from invalidation:", err)
+	}
+	if err := c.InvalidateChannel("1234"); !errors.Is(err, ErrMissing) {
+		t.Error("Expected ErrMissing from second invalidation, got", err)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	t.Run("Update", testHandleUpdate)
+	t.Run("Delete", testHandleDelete)
+	t.Run("Members", testHandleMembers)
+}
@@ -0,0 +1,211 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// store is a concurrency safe map of cached values of type T, keyed by ID.
+// Concurrent misses for the same key are coalesced such that only one lookup
+// is made, its result being shared by all callers waiting on it.
+type store[T any] struct {
+	mu      sync.Mutex
+	entries map[string]T
+	calls   map[string]*call[T]
+
+	// If set, called with mu held whenever an entry is added or removed
+	added, removed func(key string, v T)
+
+	// If positive, entries expire this long after being cached
+	ttl     time.Duration
+	expires map[string]time.Time
+}
+
+// call is a lookup in progress for a store.
+type call[T any] struct {
+	done chan struct{}
+	val  T
+	err  error
+	// Set if the key was removed during the lookup, such that its
+	// possibly stale result is not cached
+	forget bool
+}
+
+// newStore returns an empty store whose entries expire after ttl, or never if
+// ttl is zero.
+func newStore[T any](ttl time.Duration) *store[T] {
+	return &store[T]{
+		entries: make(map[string]T),
+		calls:   make(map[string]*call[T]),
+		ttl:     ttl,
+		expires: make(map[string]time.Time),
+	}
+}
+
+// get returns the value cached for key, else looks it up using fetch and
+// caches the result. If a lookup for key is already in progress, get waits for
+// it and returns its result instead of calling fetch. Errors are not cached.
+func (s *store[T]) get(key string, fetch func() (T, error)) (T, error) {
+	s.mu.Lock()
+	if v, ok := s.lookup(key); ok {
+		s.mu.Unlock()
+		return v, nil
+	}
+	if c, ok := s.calls[key]; ok {
+		s.mu.Unlock()
+		<-c.done
+		return c.val, c.err
+	}
+
+	c := &call[T]{done: make(chan struct{})}
+	s.calls[key] = c
+	s.mu.Unlock()
+
+	s.do(key, c, fetch)
+	return c.val, c.err
+}
+
+// getContext is like get, but stops waiting for the lookup once ctx is done,
+// returning the error from ctx. The lookup itself carries on in the
+// background, such that its result is still cached for later callers.
+func (s *store[T]) getContext(ctx context.Context, key string, fetch func() (T, error)) (T, error) {
+	s.mu.Lock()
+	if v, ok := s.lookup(key); ok {
+		s.mu.Unlock()
+		return v, nil
+	}
+	c, ok := s.calls[key]
+	if !ok {
+		c = &call[T]{done: make(chan struct{})}
+		s.calls[key] = c
+		go s.do(key, c, fetch)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// lookup returns the value cached for key if it has not expired, evicting it
+// if it has. It must be called with mu held.
+func (s *store[T]) lookup(key string) (T, bool) {
+	v, ok := s.entries[key]
+	if ok && s.expired(key) {
+		s.evict(key)
+		var zero T
+		return zero, false
+	}
+	return v, ok
+}
+
+// do performs the lookup c for key using fetch, caching the result if
+// successful and releasing any callers waiting on it.
+func (s *store[T]) do(key string, c *call[T], fetch func() (T, error)) {
+	c.val, c.err = fetch()
+
+	s.mu.Lock()
+	if c.err == nil && !c.forget {
+		s.set(key, c.val)
+		if s.added != nil {
+			s.added(key, c.val)
+		}
+	}
+	delete(s.calls, key)
+	s.mu.Unlock()
+	close(c.done)
+}
+
+// set caches v for key, starting its time to live. It must be called with mu
+// held.
+func (s *store[T]) set(key string, v T) {
+	s.entries[key] = v
+	if s.ttl > 0 {
+		s.expires[key] = time.Now().Add(s.ttl)
+	}
+}
+
+// expired returns true if the entry for key has outlived the time to live of
+// s. It must be called with mu held.
+func (s *store[T]) expired(key string) bool {
+	exp, ok := s.expires[key]
+	return ok && !time.Now().Before(exp)
+}
+
+// load returns the value cached for key, if any and not expired.
+func (s *store[T]) load(key string) (T, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.entries[key]
+	if ok && s.expired(key) {
+		var zero T
+		return zero, false
+	}
+	return v, ok
+}
+
+// replace caches v for key in place of the existing entry, if there is one,
+// such that an entry known to have changed is refreshed without another
+// lookup. The result of any lookup for key already in progress is not cached.
+func (s *store[T]) replace(key string, v T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.calls[key]; ok {
+		c.forget = true
+	}
+	if _, ok := s.entries[key]; ok {
+		s.set(key, v)
+	}
+}
+
+// remove deletes the value cached for key, returning ErrMissing if there was
+// none. The result of any lookup for key already in progress is returned to
+// its callers but not cached.
+func (s *store[T]) remove(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.calls[key]; ok {
+		c.forget = true
+	}
+	if _, ok := s.entries[key]; !ok {
+		return ErrMissing
+	}
+	s.evict(key)
+	return nil
+}
+
+// evict deletes the value cached for key, if any. It must be called with mu
+// held.
+func (s *store[T]) evict(key string) {
+	v, ok := s.entries[key]
+	if !ok {
+		return
+	}
+
+	delete(s.entries, key)
+	delete(s.expires, key)
+	if s.removed != nil {
+		s.removed(key, v)
+	}
+}
+
+// removeFunc deletes every value cached for which f returns true. Lookups in
+// progress are unaffected.
+func (s *store[T]) removeFunc(f func(key string, v T) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, v := range s.entries {
+		if f(key, v) {
+			s.evict(key)
+		}
+	}
+}
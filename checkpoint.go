@@ -0,0 +1,101 @@
+package disdup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// checkpoints records the ID of the last message routed from each channel,
+// such that messages sent while disdup was not running can be found later.
+// Checkpoints are persisted to a JSON file when saved. All methods are safe
+// for concurrent use.
+type checkpoints struct {
+	path string
+
+	mu    sync.Mutex
+	last  map[string]string
+	dirty bool
+}
+
+// loadCheckpoints loads the checkpoints saved at path. If the file does not
+// exist, there are no checkpoints.
+func loadCheckpoints(path string) (*checkpoints, error) {
+	c := &checkpoints{
+		path: path,
+		last: make(map[string]string),
+	}
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return c, nil
+		}
+		return nil, fmt.Errorf("checkpoints: %w", err)
+	}
+	if err := json.Unmarshal(buf, &c.last); err != nil {
+		return nil, fmt.Errorf("checkpoints: bad syntax: %w", err)
+	}
+
+	return c, nil
+}
+
+// snowflakeBefore returns true if snowflake a was created before b.
+// Snowflakes are ordered by creation time when compared numerically.
+func snowflakeBefore(a, b string) bool {
+	ai, _ := strconv.ParseUint(a, 10, 64)
+	bi, _ := strconv.ParseUint(b, 10, 64)
+	return ai < bi
+}
+
+// get returns the last message ID recorded for channel, if any.
+func (c *checkpoints) get(channel string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, ok := c.last[channel]
+	return id, ok
+}
+
+// update records id as the last message in channel, unless a later message
+// has already been recorded.
+func (c *checkpoints) update(channel, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if last, ok := c.last[channel]; ok && !snowflakeBefore(last, id) {
+		return
+	}
+	c.last[channel] = id
+	c.dirty = true
+}
+
+// save writes the checkpoints to disk if they have changed since the last
+// save. The file is replaced atomically, so is never left partially written.
+func (c *checkpoints) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+
+	buf, err := json.Marshal(c.last)
+	if err != nil {
+		return fmt.Errorf("checkpoints: %w", err)
+	}
+
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0o644); err != nil {
+		return fmt.Errorf("checkpoints: %w", err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("checkpoints: %w", err)
+	}
+
+	c.dirty = false
+	return nil
+}
@@ -0,0 +1,36 @@
+package disdup
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpoints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoints.json")
+
+	c, err := loadCheckpoints(path)
+	if err != nil {
+		t.Fatal("Unexpected error loading missing checkpoints:", err)
+	}
+	if _, ok := c.get("1"); ok {
+		t.Error("Empty checkpoints returned a checkpoint")
+	}
+
+	c.update("1", "1000")
+	c.update("1", "999") // Older; must be ignored
+	c.update("2", "99")
+	c.update("2", "100") // Same length and newer
+	if err := c.save(); err != nil {
+		t.Fatal("Unexpected save error:", err)
+	}
+
+	c, err = loadCheckpoints(path)
+	if err != nil {
+		t.Fatal("Unexpected error loading checkpoints:", err)
+	}
+	for ch, expect := range map[string]string{"1": "1000", "2": "100"} {
+		if got, _ := c.get(ch); got != expect {
+			t.Errorf("Wrong checkpoint for channel %s\nexpect: %s\ngot: %s", ch, expect, got)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"github.com/ejv2/disdup/cmd/disdup/out"
 	config "github.com/ejv2/disdup/conf"
@@ -16,6 +17,11 @@ import (
 var (
 	ErrWrongType      = errors.New("unexpected type")
 	ErrUnknownCollate = errors.New("unknown collation mode")
+	ErrUnknownName    = errors.New("unknown display name")
+	ErrUnknownPolicy  = errors.New("unknown overflow policy")
+	ErrUnknownOutput  = errors.New("unknown output")
+	ErrDeadLetterSelf = errors.New("output is its own dead letter")
+	ErrDeadLetterLoop = errors.New("dead letters form a cycle")
 	ErrMissingCommand = errors.New("missing key: command")
 )
 
@@ -23,6 +29,35 @@ var (
 type Output struct {
 	Type      string                 `json:"type"`
 	Arguments map[string]interface{} `json:"args"`
+	QueueSize int                    `json:"queue_size"`
+	Overflow  string                 `json:"overflow"`
+	Retry     *Retry                 `json:"retry"`
+}
+
+// A Retry is a json-encodable representation of the retry policy of an
+// output. Durations are in the format accepted by time.ParseDuration. Failed
+// messages may be dead lettered to another output by name, or to a file.
+type Retry struct {
+	Attempts       int     `json:"attempts"`
+	Backoff        string  `json:"backoff"`
+	MaxBackoff     string  `json:"max_backoff"`
+	Multiplier     float64 `json:"multiplier"`
+	Jitter         float64 `json:"jitter"`
+	DeadLetter     string  `json:"dead_letter"`
+	DeadLetterFile string  `json:"dead_letter_file"`
+}
+
+func parseOverflow(policy string) (int, error) {
+	switch policy {
+	case "", "block":
+		return config.OverflowBlock, nil
+	case "drop_oldest":
+		return config.OverflowDropOldest, nil
+	case "drop_newest":
+		return config.OverflowDropNewest, nil
+	default:
+		return 0, fmt.Errorf("%s: %w", policy, ErrUnknownPolicy)
+	}
 }
 
 func parseCollation(conf map[string]interface{}) (int, error) {
@@ -46,11 +81,41 @@ func parseCollation(conf map[string]interface{}) (int, error) {
 	return 0, nil
 }
 
+// parseDisplayName parses the display_name key of conf, removing it such that
+// it is not mistaken for another option.
+func parseDisplayName(conf map[string]interface{}) (int, error) {
+	rname, ok := conf["display_name"]
+	if !ok {
+		return output.NameUsername, nil
+	}
+	delete(conf, "display_name")
+
+	name, ok := rname.(string)
+	if !ok {
+		return 0, fmt.Errorf("key display_name: %w", ErrWrongType)
+	}
+
+	switch name {
+	case "username":
+		return output.NameUsername, nil
+	case "global_name":
+		return output.NameGlobal, nil
+	case "nick":
+		return output.NameNick, nil
+	default:
+		return 0, fmt.Errorf("%s: %w", name, ErrUnknownName)
+	}
+}
+
 func parseWriter(dest io.WriteCloser, conf map[string]interface{}) (*output.Writer, error) {
 	coll, err := parseCollation(conf)
 	if err != nil {
 		return nil, err
 	}
+	names, err := parseDisplayName(conf)
+	if err != nil {
+		return nil, err
+	}
 
 	rprefix, ok := conf["prefix"]
 	prefix := ""
@@ -62,15 +127,20 @@ func parseWriter(dest io.WriteCloser, conf map[string]interface{}) (*output.Writ
 	}
 
 	w := &output.Writer{
-		Output:  dest,
-		Prefix:  prefix,
-		Collate: coll,
+		Output:      dest,
+		Prefix:      prefix,
+		Collate:     coll,
+		DisplayName: names,
 	}
 	return w, nil
 }
 
 func parseMailer(conf map[string]interface{}) (*output.Mailer, error) {
-	ret := &output.Mailer{}
+	names, err := parseDisplayName(conf)
+	if err != nil {
+		return nil, err
+	}
+	ret := &output.Mailer{DisplayName: names}
 
 	// Specific keys mapped to non-string values
 	// Need to be deleted after use to prevent next loop from using them
@@ -125,13 +195,104 @@ func parseMailer(conf map[string]interface{}) (*output.Mailer, error) {
 			ret.Preamble = val
 		case "footer":
 			ret.Footer = val
+		case "subject":
+			ret.SubjectFormat = val
+		case "dm_subject":
+			ret.DMSubjectFormat = val
 		}
 	}
 
 	return ret, nil
 }
 
+// parseRetry wraps wrapped with the retry policy conf. Dead letter outputs named
+// in conf are not resolved here, as they may not yet have been parsed.
+func parseRetry(wrapped output.Output, conf *Retry) (*output.Retry, error) {
+	var err error
+	ret := &output.Retry{
+		Output:      wrapped,
+		MaxAttempts: conf.Attempts,
+		Multiplier:  conf.Multiplier,
+		Jitter:      conf.Jitter,
+	}
+
+	if conf.Backoff != "" {
+		if ret.Backoff, err = time.ParseDuration(conf.Backoff); err != nil {
+			return nil, fmt.Errorf("key backoff: %w", err)
+		}
+	}
+	if conf.MaxBackoff != "" {
+		if ret.MaxBackoff, err = time.ParseDuration(conf.MaxBackoff); err != nil {
+			return nil, fmt.Errorf("key max_backoff: %w", err)
+		}
+	}
+
+	// Opened alongside the output, so that parsing holds no resources
+	if conf.DeadLetterFile != "" {
+		ret.DeadLetter = &out.File{Path: conf.DeadLetterFile}
+		ret.OwnDeadLetter = true
+	}
+
+	return ret, nil
+}
+
+// resolveDeadLetters points retrying outputs at the outputs named as their
+// dead letters, which must all have been loaded already. Dead letters which
+// lead back to an output already passed are rejected, as a message failing in
+// each would be passed around forever.
+func resolveDeadLetters(cfg *config.Config, outputs map[string]Output) error {
+	for name, tmpl := range outputs {
+		if tmpl.Retry == nil || tmpl.Retry.DeadLetter == "" {
+			continue
+		}
+		if tmpl.Retry.DeadLetter == name {
+			return fmt.Errorf("output %s: %w", name, ErrDeadLetterSelf)
+		}
+		if deadLetterLoops(name, outputs) {
+			return fmt.Errorf("output %s: %w", name, ErrDeadLetterLoop)
+		}
+
+		var retry *output.Retry
+		var target output.Output
+		for _, out := range cfg.Outputs {
+			if out.Name == name {
+				retry = out.Output.(*output.Retry)
+			}
+			if out.Name == tmpl.Retry.DeadLetter {
+				target = out.Output
+			}
+		}
+		if target == nil {
+			return fmt.Errorf("output %s: dead letter %s: %w", name, tmpl.Retry.DeadLetter, ErrUnknownOutput)
+		}
+
+		retry.DeadLetter = target
+	}
+
+	return nil
+}
+
+// deadLetterLoops returns true if following the dead letters named from the
+// output called name leads back to an output already passed.
+func deadLetterLoops(name string, outputs map[string]Output) bool {
+	seen := make(map[string]bool)
+	for !seen[name] {
+		seen[name] = true
+		tmpl, ok := outputs[name]
+		if !ok || tmpl.Retry == nil || tmpl.Retry.DeadLetter == "" {
+			return false
+		}
+		name = tmpl.Retry.DeadLetter
+	}
+	return true
+}
+
 func parseCommand(conf map[string]interface{}) (*out.Executor, error) {
+	names, err := parseDisplayName(conf)
+	if err != nil {
+		return nil, err
+	}
+
 	rcmd, ok := conf["cmd"]
 	if !ok {
 		return nil, ErrMissingCommand
@@ -161,8 +322,9 @@ func parseCommand(conf map[string]interface{}) (*out.Executor, error) {
 	}
 
 	return &out.Executor{
-		Command: cmd,
-		Args:    args,
+		Command:     cmd,
+		Args:        args,
+		DisplayName: names,
 	}, nil
 }
 
@@ -172,6 +334,12 @@ func convertOutput(name string, tmpl Output, cfg *config.Config) error {
 	var err error
 	var out output.Output
 
+	// Parsing consumes the arguments, so must be recorded first
+	source, err := json.Marshal(tmpl)
+	if err != nil {
+		return err
+	}
+
 	switch tmpl.Type {
 	case "stdout":
 		out, err = parseWriter(os.Stdout, tmpl.Arguments)
@@ -187,7 +355,25 @@ func convertOutput(name string, tmpl Output, cfg *config.Config) error {
 		return err
 	}
 
-	cfg.Outputs = append(cfg.Outputs, config.OutputConfig{Name: name, Output: out})
+	if tmpl.Retry != nil {
+		out, err = parseRetry(out, tmpl.Retry)
+		if err != nil {
+			return fmt.Errorf("key retry: %w", err)
+		}
+	}
+
+	overflow, err := parseOverflow(tmpl.Overflow)
+	if err != nil {
+		return err
+	}
+
+	cfg.Outputs = append(cfg.Outputs, config.OutputConfig{
+		Name:      name,
+		Output:    out,
+		QueueSize: tmpl.QueueSize,
+		Overflow:  overflow,
+		Source:    string(source),
+	})
 	return nil
 }
 
@@ -225,5 +411,9 @@ func loadOutputs(cfg *config.Config, paths []string) error {
 		}
 	}
 
+	if err := resolveDeadLetters(cfg, outputs); err != nil {
+		return fmt.Errorf("outputs config: %w", err)
+	}
+
 	return nil
 }
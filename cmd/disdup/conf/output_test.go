@@ -0,0 +1,39 @@
+package clconf
+
+import (
+	"errors"
+	"testing"
+
+	config "github.com/ejv2/disdup/conf"
+)
+
+func TestResolveDeadLetters(t *testing.T) {
+	cases := []struct {
+		Name        string
+		DeadLetters map[string]string
+		Expect      error
+	}{
+		{"Chain", map[string]string{"a": "b", "b": "c", "c": ""}, nil},
+		{"Self", map[string]string{"a": "a"}, ErrDeadLetterSelf},
+		{"Cycle", map[string]string{"a": "b", "b": "a"}, ErrDeadLetterLoop},
+		{"Unknown", map[string]string{"a": "b"}, ErrUnknownOutput},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			cfg := config.Config{}
+			outputs := make(map[string]Output)
+			for name, dead := range c.DeadLetters {
+				tmpl := Output{Type: "stdout", Retry: &Retry{DeadLetter: dead}}
+				if err := convertOutput(name, tmpl, &cfg); err != nil {
+					t.Fatal("Unexpected error converting output:", err)
+				}
+				outputs[name] = tmpl
+			}
+
+			if err := resolveDeadLetters(&cfg, outputs); !errors.Is(err, c.Expect) {
+				t.Errorf("wrong error\nexpect: %v\ngot: %v", c.Expect, err)
+			}
+		})
+	}
+}
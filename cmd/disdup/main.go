@@ -5,9 +5,11 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/ejv2/disdup"
 	clconf "github.com/ejv2/disdup/cmd/disdup/conf"
+	config "github.com/ejv2/disdup/conf"
 )
 
 // Command line flags.
@@ -35,11 +37,50 @@ func main() {
 
 	sigint := make(chan os.Signal, 1)
 	signal.Notify(sigint, os.Interrupt)
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
 
-	select {
-	case <-sigint:
-		log.Println("Caught interrupt. Terminating gracefully")
-	case err := <-dup.Wait():
-		log.Println(err)
+	for {
+		select {
+		case <-sigint:
+			log.Println("Caught interrupt. Terminating gracefully")
+			return
+		case <-sighup:
+			log.Println("Caught hangup. Reloading configuration")
+			cfg = reload(dup, cfg)
+		case err := <-dup.Wait():
+			log.Println(err)
+			return
+		}
 	}
 }
+
+// reload loads the configuration afresh and applies it to dup, returning the
+// configuration now in use.
+func reload(dup disdup.Duplicator, cfg config.Config) config.Config {
+	ncfg, err := clconf.LoadConfig()
+	if err != nil {
+		log.Println("config error:", err)
+		return cfg
+	}
+
+	if *AuthToken != "" {
+		ncfg.Token = *AuthToken
+	}
+
+	diff := config.Diff(cfg, ncfg)
+	if len(diff) == 0 {
+		log.Println("Configuration unchanged")
+		return cfg
+	}
+	if err := dup.Reconfigure(ncfg); err != nil {
+		log.Println("config error:", err)
+		return cfg
+	}
+
+	for _, change := range diff {
+		log.Println("Configuration changed:", change)
+	}
+	// Not applied, so still differ on the next reload
+	return ncfg.KeepRunning(cfg)
+}
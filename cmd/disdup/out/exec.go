@@ -1,7 +1,9 @@
 package out
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
@@ -16,21 +18,25 @@ import (
 // Possible executor init errors.
 var (
 	ErrEmptyCommand = errors.New("output executor: empty command")
+	ErrCommand      = errors.New("output executor: command failed")
 )
 
 // formatArgs replaces formatting options documented in the Executor struct in
 // the arguments provided. The operation is performed in place on the passed
 // slice.
-func formatArgs(args []string, msg output.Message) []string {
+func formatArgs(args []string, msg output.Message, names int) []string {
 	ret := make([]string, 0, len(args))
 
 	for _, arg := range args {
 		arg = strings.ReplaceAll(arg, "{id}", msg.Message.ID)
-		arg = strings.ReplaceAll(arg, "{author}", msg.Author.Username)
+		arg = strings.ReplaceAll(arg, "{author}", msg.AuthorName(names))
+		arg = strings.ReplaceAll(arg, "{username}", msg.Author.Username)
 		arg = strings.ReplaceAll(arg, "{guild}", msg.GuildName)
 		arg = strings.ReplaceAll(arg, "{guild_id}", msg.GuildID)
 		arg = strings.ReplaceAll(arg, "{channel}", msg.ChannelName)
 		arg = strings.ReplaceAll(arg, "{channel_id}", msg.ChannelID)
+		arg = strings.ReplaceAll(arg, "{parent}", msg.ParentName)
+		arg = strings.ReplaceAll(arg, "{thread}", msg.ThreadName)
 		arg = strings.ReplaceAll(arg, "{content}", msg.PrettyContent)
 		arg = strings.ReplaceAll(arg, "{time}", time.Now().Format(time.RFC822))
 
@@ -52,19 +58,33 @@ type Executor struct {
 	// Args are command line arguments to provide to the program. Simple
 	// format substitution is supported for each, replacing the following:
 	//   - {id}: unique message ID
-	//   - {author}: name#tag of the author of the message
+	//   - {author}: the name of the author of the message, as chosen by DisplayName
+	//   - {username}: the username of the author of the message
 	//   - {guild}: the name of the guild in which the message was sent
 	//   - {channel}: the name of the channel in which the message was sent
+	//   - {parent}: the name of the channel containing the thread in which the message was sent, if any
+	//   - {thread}: the name of the thread in which the message was sent, if any
 	//   - {content}: the formatted content of the message
 	//   - {time}: approximate timestamp of the message's send, formatted according to RFC822
 	//
 	// Arguments are guaranteed to be formatted as correct command line
 	// arguments, with the same restrictions as per usual via exec.Command.
 	Args []string
+	// DisplayName is the name display mode used for {author}. See the
+	// constants in package output for documentation.
+	DisplayName int
 
 	procwg sync.WaitGroup
 }
 
+// Validate returns ErrEmptyCommand if e has no command.
+func (e *Executor) Validate() []error {
+	if e.Command == "" {
+		return []error{ErrEmptyCommand}
+	}
+	return nil
+}
+
 func (e *Executor) Open(s *discordgo.Session) error {
 	if e.Command == "" {
 		return ErrEmptyCommand
@@ -74,11 +94,19 @@ func (e *Executor) Open(s *discordgo.Session) error {
 }
 
 func (e *Executor) Write(m output.Message) {
+	if err := e.WriteContext(context.Background(), m); err != nil {
+		log.Println(err)
+	}
+}
+
+// WriteContext runs the command for message m and waits for it to exit. If
+// ctx is done first, the command is killed.
+func (e *Executor) WriteContext(ctx context.Context, m output.Message) error {
 	e.procwg.Add(1)
 	defer e.procwg.Done()
 
-	args := formatArgs(e.Args, m)
-	cmd := exec.Command(e.Command, args...)
+	args := formatArgs(e.Args, m, e.DisplayName)
+	cmd := exec.CommandContext(ctx, e.Command, args...)
 
 	// For some reason, this is overriden by default
 	cmd.Stdout = os.Stdout
@@ -87,8 +115,13 @@ func (e *Executor) Write(m output.Message) {
 
 	err := cmd.Run()
 	if err != nil {
-		log.Printf("executor: %s %v: command failed to execute", e.Command, args)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%w: %s %v: %s", ErrCommand, e.Command, args, err.Error())
 	}
+
+	return nil
 }
 
 func (e *Executor) Close() error {
@@ -0,0 +1,48 @@
+package out
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/ejv2/disdup/output"
+)
+
+// Possible file init errors.
+var (
+	ErrEmptyPath = errors.New("output file: empty path")
+)
+
+// File appends messages to the file at Path, formatted as by output.Writer.
+// The file is created if needed and opened only once the output is opened,
+// such that a File which is never opened holds no resources.
+//
+// If Path is empty, File.Open returns ErrEmptyPath.
+type File struct {
+	// Path is the path of the file to append to.
+	Path string
+	output.Writer
+}
+
+// Validate returns ErrEmptyPath if f has no path.
+func (f *File) Validate() []error {
+	if f.Path == "" {
+		return []error{ErrEmptyPath}
+	}
+	return nil
+}
+
+func (f *File) Open(s *discordgo.Session) error {
+	if f.Path == "" {
+		return ErrEmptyPath
+	}
+
+	fd, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("output file: %w", err)
+	}
+	f.Writer.Output = fd
+
+	return f.Writer.Open(s)
+}
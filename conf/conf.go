@@ -1,6 +1,50 @@
 package config
 
-import "github.com/ejv2/disdup/output"
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/ejv2/disdup/output"
+)
+
+// Overflow policies for output queues. These decide what happens to a new
+// message when the queue for an output is already full. Unknown policies are
+// treated as OverflowBlock.
+const (
+	// Wait for space in the queue, blocking incoming events until the
+	// output catches up. Events in each guild are handled one at a time,
+	// so this stalls the whole guild, not only messages bound for the slow
+	// output: other outputs receive nothing from it and its backfill waits
+	// until there is space. Events in other guilds wait too once they are
+	// bound for the full queue. Use a dropping policy for outputs which may
+	// fall behind for long.
+	OverflowBlock = iota
+	// Discard the oldest queued message to make space for the new one.
+	OverflowDropOldest
+	// Discard the new message.
+	OverflowDropNewest
+)
+
+// DefaultGuild is the key in Config.Guilds of the configuration used for
+// guilds which have no entry of their own.
+const DefaultGuild = "*"
+
+// Prefixes of entries in user lists, and keys of GuildConfig.Users, which match
+// a particular name of a user. Entries without a prefix match either the ID or
+// the username of a user.
+const (
+	// Match the unique username of a user only.
+	UserPrefixUsername = "username:"
+	// Match the global display name of a user, which need not be unique.
+	UserPrefixGlobalName = "global_name:"
+	// Match the nickname of a user in the guild, which need not be unique.
+	UserPrefixNick = "nick:"
+)
+
+// DefaultQueueSize is the queue depth used for outputs which do not specify
+// a queue size.
+const DefaultQueueSize = 64
 
 // Config is the primary disdup configuration, optionally encoded in JSON
 // format and loaded by the client code. It is passed to the main duplicator,
@@ -10,10 +54,50 @@ type Config struct {
 	Token string `json:"token"`
 	// Name is the nickname the bot will assume upon being added to a guild
 	Name string `json:"name"`
+	// SpoolDir is the directory in which messages waiting to be written to
+	// each output are recorded, such that they survive restarts. Messages
+	// are recorded with their attachments as they are queued and removed
+	// once written, dropped or given up on after failing. Messages which
+	// were not written due to shutdown or a crash are written again on the
+	// next start. If empty, messages are not recorded.
+	//
+	// Attachments too large to hold in memory are recorded by the path of
+	// their file, so are only written again after a restart if kept in the
+	// persistent attachment store (see AttachmentConfig.StoreDir).
+	SpoolDir string `json:"spool_dir"`
+	// CheckpointFile is the file in which the last message seen in each
+	// channel is recorded, whether or not it was duplicated. On startup
+	// and after reconnecting, any messages sent in enabled channels since
+	// their last recorded message are routed as normal, oldest first. If
+	// empty, messages sent while disdup is not running are not duplicated.
+	CheckpointFile string `json:"checkpoint_file"`
+	// Attachments are the limits on the attachments downloaded for
+	// outputs.
+	Attachments AttachmentConfig `json:"attachments"`
+	// Cache is the configuration of the cache of channels, guilds, users
+	// and members looked up from Discord.
+	Cache CacheConfig `json:"cache"`
+	// Debug logs an explanation of the routing decisions made for every
+	// message which is not duplicated. See Config.Explain.
+	Debug bool `json:"debug"`
 	// Guilds is a map of guild names or IDs to their associated
 	// configuration. This is not an optional key: servers not configured
-	// are ignored
+	// are ignored, unless there is an entry for DefaultGuild, which is
+	// then used for all guilds without their own entry
 	Guilds map[string]*GuildConfig `json:"guilds"`
+	// Profiles is a map of profile names to guild configuration which
+	// entries in Guilds, or other profiles, may inherit from by setting
+	// their Profile. Profiles are never matched against guilds directly.
+	Profiles map[string]*GuildConfig `json:"profiles"`
+	// Rules are evaluated in order before any other configuration. The
+	// outputs of the first rule whose condition matches a message are used
+	// for that message, without checking the guild configuration. Messages
+	// matching no rule are then matched against the guild configuration as
+	// normal. See Rule for the syntax of rules.
+	Rules []Rule `json:"rules"`
+	// DirectMessages is the configuration for direct messages and group
+	// DMs sent to the bot. These are ignored unless enabled here.
+	DirectMessages DMConfig `json:"direct_messages"`
 	// Outputs is a map of output names to the output interface which will
 	// be used. On duplicator startup, all outputs have their "Open" method
 	// called concurrently. On shutdown, all outputs have their "Close"
@@ -21,6 +105,89 @@ type Config struct {
 	// from json by default and must be initialized explicitly be the
 	// caller.
 	Outputs []OutputConfig `json:"-"`
+	// OnOutputError, if not nil, is called whenever an output fails to
+	// write a message, with the name of the output, the message and the
+	// error returned. It may be called concurrently for different outputs.
+	// If nil, errors are logged. Writes abandoned due to the duplicator
+	// closing are not reported.
+	OnOutputError func(name string, m output.Message, err error) `json:"-"`
+}
+
+// AttachmentConfig is the configuration of the cache of attachments downloaded
+// for outputs. Small attachments are held in memory, within a total budget,
+// while larger attachments are written to disk. Zero values use the defaults
+// from package cache.
+type AttachmentConfig struct {
+	// MemoryBudget is the total size in bytes of the attachments held in
+	// memory. The least recently used attachments are evicted once it is
+	// exceeded.
+	MemoryBudget int64 `json:"memory_budget"`
+	// MaxSize is the size in bytes above which attachments are not
+	// downloaded. Messages are still duplicated without them.
+	MaxSize int64 `json:"max_size"`
+	// SpillSize is the size in bytes above which attachments are written
+	// to disk rather than held in memory.
+	SpillSize int64 `json:"spill_size"`
+	// Dir is the directory to which large attachments are written. If
+	// empty, a temporary directory is used.
+	Dir string `json:"dir"`
+	// Timeout bounds each attempt to download an attachment.
+	Timeout Duration `json:"timeout"`
+	// Attempts is the number of times a download is attempted before the
+	// message is duplicated without the attachment.
+	Attempts int `json:"attempts"`
+	// AllowedTypes are the content types of attachments which are
+	// downloaded, such as "image/png" or "image/" for any image. If empty,
+	// attachments of any type are downloaded.
+	AllowedTypes []string `json:"allowed_types"`
+	// StoreDir, if set, is the directory in which every attachment
+	// downloaded is kept, such that it need not be downloaded again, even
+	// after a restart. Identical attachments are stored once, and each
+	// has a stable path which outputs may refer to. Dir is unused if set.
+	StoreDir string `json:"store_dir"`
+	// Retention is how long stored attachments are kept after they were
+	// last used. If zero, they are kept regardless of age.
+	Retention Duration `json:"retention"`
+	// MaxStoreSize is the total size in bytes of the stored attachments,
+	// beyond which the least recently used are removed. If zero, the size
+	// of the store is not limited.
+	MaxStoreSize int64 `json:"max_store_size"`
+}
+
+// CacheConfig is the configuration of the cache of Discord objects. Cached
+// objects are refreshed as Discord reports changes to them, but may also be
+// given a time to live, after which they are looked up again. A zero time to
+// live keeps objects until they change.
+type CacheConfig struct {
+	ChannelTTL Duration `json:"channel_ttl"`
+	GuildTTL   Duration `json:"guild_ttl"`
+	UserTTL    Duration `json:"user_ttl"`
+	MemberTTL  Duration `json:"member_ttl"`
+	RoleTTL    Duration `json:"role_ttl"`
+}
+
+// Duration is a time.Duration encoded in JSON in the format accepted by
+// time.ParseDuration, such as "1h30m".
+type Duration time.Duration
+
+// MarshalJSON encodes d as a duration string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON decodes a duration string into d.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
 }
 
 // Guild registers a new guild for duplication and enables it by default. The
@@ -37,6 +204,63 @@ func (c *Config) Guild(nameid string) *GuildConfig {
 	return cfg
 }
 
+// UsesRoles returns true if any guild is configured to match messages using
+// the roles of their author. This requires that guild members can be looked
+// up.
+func (c Config) UsesRoles() bool {
+	if c.RulesUse("roles") {
+		return true
+	}
+	for _, g := range c.Guilds {
+		if g.UsesRoles() {
+			return true
+		}
+	}
+	for _, p := range c.Profiles {
+		if p.UsesRoles() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UsesNicknames returns true if any guild or rule matches messages using the
+// guild nickname of their author.
+func (c Config) UsesNicknames() bool {
+	if c.RulesUse("nick") {
+		return true
+	}
+	for _, g := range c.Guilds {
+		if g.UsesNicknames() {
+			return true
+		}
+	}
+	for _, p := range c.Profiles {
+		if p.UsesNicknames() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Profile registers a new guild configuration profile with the given name, for
+// guild configurations to inherit from. If a profile with the same name has
+// already been registered, Profile panics.
+func (c *Config) Profile(name string) *GuildConfig {
+	if _, ok := c.Profiles[name]; ok {
+		panic("disdup config: duplicate registration of profile " + name)
+	}
+	if c.Profiles == nil {
+		c.Profiles = make(map[string]*GuildConfig)
+	}
+
+	cfg := &GuildConfig{}
+	c.Profiles[name] = cfg
+	return cfg
+}
+
 // Use adds an output to the output array. If an output with the same name has
 // already been registered, Use panics. A pointer to the target config is
 // returned for use in function chaining.
@@ -51,11 +275,26 @@ func (c *Config) Use(name string, output output.Output) *Config {
 	return c
 }
 
+// UseQueued is identical to Use, but additionally sets the queue size and
+// overflow policy for the output.
+func (c *Config) UseQueued(name string, output output.Output, size, overflow int) *Config {
+	c.Use(name, output)
+	c.Outputs[len(c.Outputs)-1].QueueSize = size
+	c.Outputs[len(c.Outputs)-1].Overflow = overflow
+	return c
+}
+
 // GuildConfig represents the configuration for a single guild. It may be
 // configured via either a name or guild ID, the ID taking precedence. The zero
 // value of this type is a valid configuration which duplicates all messages
 // from a server.
 type GuildConfig struct {
+	// Profile is the name of the profile in Config.Profiles from which this
+	// configuration inherits. Options set here override those of the
+	// profile, while options left unset (nil lists, false booleans and
+	// empty filters) are inherited. Set a list to an empty, non-nil value
+	// to override it with nothing. Unknown profiles are ignored.
+	Profile string `json:"profile"`
 	// Disable this guild? Disabled guilds will be entirely ignored for
 	// duplication. Guilds are enabled by default
 	Disable bool `json:"disable"`
@@ -66,12 +305,111 @@ type GuildConfig struct {
 	// duplicated. If empty, all channels are enabled. Channel names should
 	// not include the leading '#'
 	EnabledChannels []string `json:"enabled_channels"`
-	// EnabledUsers are users which the bot will duplicate messages from.
-	// This does not override "enabled" or "enabled_channels"; disabled
-	// guilds or channels will still not be duplicated. If empty, all
-	// users in all enabled channels will be duplicated. Users *must*
-	// include the full tag (i.e: user#tag)
+	// EnabledUsers are users which the bot will duplicate messages from,
+	// by ID or username, or by global display name or nickname using the
+	// user prefixes. This does not override "enabled" or
+	// "enabled_channels"; disabled guilds or channels will still not be
+	// duplicated. If empty, all users in all enabled channels will be
+	// duplicated.
 	EnabledUsers []string `json:"enabled_users"`
+	// DisabledChannels are channels, by name or ID, which the bot will
+	// never duplicate from, including their threads. This overrides
+	// EnabledChannels.
+	DisabledChannels []string `json:"disabled_channels"`
+	// EnabledCategories are channel categories, by name or ID, which the
+	// bot will duplicate from. Channels in any of these categories are
+	// enabled in addition to those in EnabledChannels, including channels
+	// created later. If both are empty, all channels are enabled.
+	EnabledCategories []string `json:"enabled_categories"`
+	// DisabledCategories are channel categories, by name or ID, which the
+	// bot will never duplicate from. This overrides both EnabledChannels
+	// and EnabledCategories.
+	DisabledCategories []string `json:"disabled_categories"`
+	// DisabledUsers are users, listed as in EnabledUsers, which the bot
+	// will never duplicate messages from. This overrides EnabledUsers and
+	// EnabledRoles.
+	DisabledUsers []string `json:"disabled_users"`
+	// AuthorPolicy ignores messages by the kind of their author. Ignored
+	// messages are never duplicated, regardless of the other options.
+	AuthorPolicy
+	// EnabledRoles are roles, by name or ID, whose members the bot will
+	// duplicate messages from. Users with any of these roles are enabled
+	// in addition to those in EnabledUsers. If both are empty, all users
+	// are enabled.
+	EnabledRoles []string `json:"enabled_roles"`
+	// DisabledRoles are roles, by name or ID, whose members the bot will
+	// never duplicate messages from. This overrides both EnabledUsers and
+	// EnabledRoles.
+	DisabledRoles []string `json:"disabled_roles"`
+	// Filter selects messages from this guild by their content. Messages
+	// must pass both this filter and the filter of their channel, if any.
+	Filter ContentFilter `json:"filter"`
+	// Channels is a map of channel names or IDs to configuration specific
+	// to that channel. Threads use the configuration of their parent
+	// channel if they have none of their own. Channels listed here are not
+	// implicitly enabled; see EnabledChannels.
+	Channels map[string]*ChannelConfig `json:"channels"`
+	// Users is a map of users, keyed as in EnabledUsers, to configuration
+	// specific to messages sent by that user. If several entries match a
+	// user, the entry for their ID takes precedence, then their username,
+	// nickname and global display name. Users listed here are not implicitly
+	// enabled; see EnabledUsers.
+	Users map[string]*UserConfig `json:"users"`
+}
+
+// AuthorPolicy ignores messages by the kind of their author. The zero value of
+// this type ignores nothing.
+type AuthorPolicy struct {
+	// IgnoreBots ignores messages sent by bot users. Webhooks are not
+	// counted as bots; see IgnoreWebhooks.
+	IgnoreBots bool `json:"ignore_bots"`
+	// IgnoreWebhooks ignores messages sent by webhooks.
+	IgnoreWebhooks bool `json:"ignore_webhooks"`
+	// IgnoreSelf ignores messages sent by disdup's own bot user, such as
+	// those posted by an output.
+	IgnoreSelf bool `json:"ignore_self"`
+	// IgnoreSystemMessages ignores messages generated by Discord, such as
+	// member joins, pins and boosts.
+	IgnoreSystemMessages bool `json:"ignore_system_messages"`
+}
+
+// ChannelConfig represents the configuration for a single channel within a
+// guild. It may be configured via either a name or channel ID, the ID taking
+// precedence. The zero value of this type has no effect.
+type ChannelConfig struct {
+	// Filter selects messages from this channel by their content. This
+	// applies in addition to the filter of the guild.
+	Filter ContentFilter `json:"filter"`
+	// OutputRule selects the outputs for messages in this channel.
+	OutputRule
+}
+
+// UserConfig represents the configuration for messages sent by a single user
+// within a guild. It may be configured via either a username or user ID, the ID
+// taking precedence. The zero value of this type has no effect.
+type UserConfig struct {
+	// OutputRule selects the outputs for messages sent by this user.
+	OutputRule
+}
+
+// OutputRule selects outputs for the messages to which it applies, in
+// addition to or instead of the outputs selected by less specific
+// configuration. From least to most specific, outputs are selected by the
+// guild, then the channel, then the user. The zero value of this type has no
+// effect.
+type OutputRule struct {
+	// Output are the names of outputs to which messages are written. If
+	// empty, the rule has no effect.
+	Output []string `json:"output"`
+	// OverrideOutput causes Output to replace the outputs selected by less
+	// specific configuration, rather than adding to them.
+	OverrideOutput bool `json:"override_output"`
+}
+
+// Inherit sets the profile from which the guild inherits its configuration.
+func (g *GuildConfig) Inherit(profile string) *GuildConfig {
+	g.Profile = profile
+	return g
 }
 
 // Disable marks the guild as disabled. No messages shall be duplicated from
@@ -110,6 +448,128 @@ func (g *GuildConfig) User(nameid string) *GuildConfig {
 	return g
 }
 
+// DisableChannel disables a channel with the name or id `nameid`.
+func (g *GuildConfig) DisableChannel(nameid string) *GuildConfig {
+	g.DisabledChannels = append(g.DisabledChannels, nameid)
+	return g
+}
+
+// Category enables all channels in the category with the name or id
+// `nameid`.
+func (g *GuildConfig) Category(nameid string) *GuildConfig {
+	g.EnabledCategories = append(g.EnabledCategories, nameid)
+	return g
+}
+
+// DisableCategory disables all channels in the category with the name or id
+// `nameid`.
+func (g *GuildConfig) DisableCategory(nameid string) *GuildConfig {
+	g.DisabledCategories = append(g.DisabledCategories, nameid)
+	return g
+}
+
+// UsesCategories returns true if messages from the guild are matched using
+// the category of their channel, which must then be looked up.
+func (g *GuildConfig) UsesCategories() bool {
+	return len(g.EnabledCategories) > 0 || len(g.DisabledCategories) > 0
+}
+
+// DisableUser disables a user with the name or id `nameid`.
+func (g *GuildConfig) DisableUser(nameid string) *GuildConfig {
+	g.DisabledUsers = append(g.DisabledUsers, nameid)
+	return g
+}
+
+// Role enables members of the role with the name or id `nameid`.
+func (g *GuildConfig) Role(nameid string) *GuildConfig {
+	g.EnabledRoles = append(g.EnabledRoles, nameid)
+	return g
+}
+
+// DisableRole disables members of the role with the name or id `nameid`.
+func (g *GuildConfig) DisableRole(nameid string) *GuildConfig {
+	g.DisabledRoles = append(g.DisabledRoles, nameid)
+	return g
+}
+
+// UsesRoles returns true if messages from the guild are matched using the
+// roles of their author, which must then be looked up.
+func (g *GuildConfig) UsesRoles() bool {
+	return len(g.EnabledRoles) > 0 || len(g.DisabledRoles) > 0
+}
+
+// UsesNicknames returns true if messages from the guild are matched using the
+// guild nickname of their author, which may need to be looked up.
+func (g *GuildConfig) UsesNicknames() bool {
+	for _, list := range [][]string{g.EnabledUsers, g.DisabledUsers} {
+		for _, elem := range list {
+			if strings.HasPrefix(elem, UserPrefixNick) {
+				return true
+			}
+		}
+	}
+	for key := range g.Users {
+		if strings.HasPrefix(key, UserPrefixNick) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FindChannel looks up the configuration for the channel with either id or
+// name, with id taking precedence. If none could be found, nil is returned.
+func (g *GuildConfig) FindChannel(id, name string) *ChannelConfig {
+	if ch, ok := g.Channels[id]; ok {
+		return ch
+	}
+	if ch, ok := g.Channels[name]; ok {
+		return ch
+	}
+
+	return nil
+}
+
+// FindUser looks up the configuration for the user with either id or
+// username, with id taking precedence. Entries for the username may be
+// prefixed by UserPrefixUsername. If none could be found, nil is returned.
+//
+// Only the ID and username are matched. Entries for a nickname or global name
+// (prefixed by UserPrefixNick or UserPrefixGlobalName) are never returned,
+// although messages are routed by them if no entry for the ID or username
+// exists.
+func (g *GuildConfig) FindUser(id, username string) *UserConfig {
+	if u, ok := g.Users[id]; ok {
+		return u
+	}
+	if u, ok := g.Users[username]; ok {
+		return u
+	}
+	if u, ok := g.Users[UserPrefixUsername+username]; ok {
+		return u
+	}
+
+	return nil
+}
+
+// DMConfig represents the configuration for direct messages to the bot. The
+// zero value of this type ignores all direct messages.
+type DMConfig struct {
+	// Enable duplication of direct messages? Direct messages are disabled
+	// by default
+	Enable bool `json:"enable"`
+	// Output to the outputs with these names. If empty, all outputs are
+	// selected.
+	Output []string `json:"output"`
+	// EnabledUsers are users whose direct messages will be duplicated,
+	// listed as in GuildConfig.EnabledUsers. Direct messages have no
+	// nickname, so nicknames never match. If empty, direct messages from
+	// all users are duplicated.
+	EnabledUsers []string `json:"enabled_users"`
+	// AuthorPolicy ignores direct messages by the kind of their author.
+	AuthorPolicy
+}
+
 // OutputConfig represents one entry for an output handler which associates a
 // name with an output interface.
 //
@@ -122,4 +582,17 @@ type OutputConfig struct {
 	Name string
 	// Output is the target for the output.
 	Output output.Output
+	// QueueSize is the maximum number of messages which may be waiting to
+	// be written to this output. Messages are written to each output in
+	// the order received, one at a time. If zero, DefaultQueueSize is
+	// used.
+	QueueSize int
+	// Overflow is the policy used when a message arrives while the queue
+	// is full. See the associated constants for details.
+	Overflow int
+	// Source describes the settings Output was created from, such as the
+	// options it was loaded from, if known. Outputs are opened and some
+	// fill in defaults as they do, so Source is what is compared to find
+	// whether the settings of an output have changed.
+	Source string
 }
@@ -1,7 +1,9 @@
 package config_test
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
 	config "github.com/ejv2/disdup/conf"
 	"github.com/ejv2/disdup/output"
@@ -41,3 +43,24 @@ func TestConfig(t *testing.T) {
 		t.Run("Norm", testConfigGuild)
 	})
 }
+
+func TestDuration_JSON(t *testing.T) {
+	var c config.CacheConfig
+	if err := json.Unmarshal([]byte(`{"channel_ttl": "1h30m", "user_ttl": "45s"}`), &c); err != nil {
+		t.Fatal("Unexpected unmarshal error:", err)
+	}
+	if time.Duration(c.ChannelTTL) != 90*time.Minute || time.Duration(c.UserTTL) != 45*time.Second || c.GuildTTL != 0 {
+		t.Errorf("Wrong durations decoded: %+v", c)
+	}
+
+	buf, err := json.Marshal(c.ChannelTTL)
+	if err != nil || string(buf) != `"1h30m0s"` {
+		t.Errorf("Wrong duration encoded: %s (%v)", buf, err)
+	}
+
+	for _, bad := range []string{`{"channel_ttl": "soon"}`, `{"channel_ttl": 5}`} {
+		if err := json.Unmarshal([]byte(bad), &c); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
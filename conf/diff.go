@@ -0,0 +1,120 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+)
+
+// restartKeys are the JSON keys of the settings copied by KeepRunning.
+var restartKeys = map[string]bool{
+	"token":           true,
+	"spool_dir":       true,
+	"checkpoint_file": true,
+	"attachments":     true,
+	"cache":           true,
+}
+
+// Diff describes the differences between configurations a and b, one change
+// per line, in a format suitable for logging. Guilds are compared one by one,
+// outputs are matched by name and compared using OutputConfig.SameSettings and
+// all other keys are compared whole. Changes to settings which cannot be
+// changed while running (see KeepRunning) are marked as requiring a restart.
+// Changed values are never included, as they may be secret.
+func Diff(a, b Config) []string {
+	var diff []string
+
+	outa, outb := make(map[string]OutputConfig), make(map[string]bool)
+	for _, out := range a.Outputs {
+		outa[out.Name] = out
+	}
+	for _, out := range b.Outputs {
+		outb[out.Name] = true
+		if prev, ok := outa[out.Name]; !ok {
+			diff = append(diff, "output "+out.Name+": added")
+		} else if !prev.SameSettings(out) {
+			diff = append(diff, "output "+out.Name+": changed")
+		}
+	}
+	for _, out := range a.Outputs {
+		if !outb[out.Name] {
+			diff = append(diff, "output "+out.Name+": removed")
+		}
+	}
+
+	for _, key := range unionKeys(a.Guilds, b.Guilds) {
+		ga, ina := a.Guilds[key]
+		gb, inb := b.Guilds[key]
+		switch {
+		case !ina:
+			diff = append(diff, "guild "+key+": added")
+		case !inb:
+			diff = append(diff, "guild "+key+": removed")
+		case !jsonEqual(ga, gb):
+			diff = append(diff, "guild "+key+": changed")
+		}
+	}
+
+	// Remaining keys compared via their JSON encoding, so that new keys
+	// need not be listed here
+	var rawa, rawb map[string]json.RawMessage
+	bufa, _ := json.Marshal(a)
+	bufb, _ := json.Marshal(b)
+	json.Unmarshal(bufa, &rawa)
+	json.Unmarshal(bufb, &rawb)
+	delete(rawa, "guilds")
+	delete(rawb, "guilds")
+	for _, key := range unionKeys(rawa, rawb) {
+		switch {
+		case bytes.Equal(rawa[key], rawb[key]):
+		case restartKeys[key]:
+			diff = append(diff, key+": changed, requires restart")
+		default:
+			diff = append(diff, key+": changed")
+		}
+	}
+
+	return diff
+}
+
+// KeepRunning returns c with the settings which cannot be changed while
+// running taken from running, being Token, SpoolDir, CheckpointFile,
+// Attachments and Cache.
+func (c Config) KeepRunning(running Config) Config {
+	c.Token = running.Token
+	c.SpoolDir = running.SpoolDir
+	c.CheckpointFile = running.CheckpointFile
+	c.Attachments = running.Attachments
+	c.Cache = running.Cache
+	return c
+}
+
+// SameSettings returns true if o and p have the same Source and queue
+// settings, such that a running output created from o can be kept in place of
+// one created from p. The outputs themselves are not compared.
+func (o OutputConfig) SameSettings(p OutputConfig) bool {
+	return o.Source == p.Source && o.QueueSize == p.QueueSize && o.Overflow == p.Overflow
+}
+
+// jsonEqual returns true if a and b have identical JSON encodings.
+func jsonEqual(a, b interface{}) bool {
+	bufa, erra := json.Marshal(a)
+	bufb, errb := json.Marshal(b)
+	return erra == nil && errb == nil && bytes.Equal(bufa, bufb)
+}
+
+// unionKeys returns the sorted union of the keys of a and b.
+func unionKeys[T any](a, b map[string]T) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,55 @@
+package config_test
+
+import (
+	"testing"
+
+	config "github.com/ejv2/disdup/conf"
+)
+
+func TestDiff(t *testing.T) {
+	a := config.Config{
+		Token: "secret",
+		Name:  "disdup",
+		Guilds: map[string]*config.GuildConfig{
+			"same":    {EnabledChannels: []string{"general"}},
+			"changed": {EnabledChannels: []string{"general"}},
+			"removed": {},
+		},
+		Outputs: []config.OutputConfig{{Name: "kept"}, {Name: "changed", Source: "a"}, {Name: "removed"}},
+	}
+	b := config.Config{
+		Token: "other secret",
+		Name:  "disdup",
+		Debug: true,
+		Guilds: map[string]*config.GuildConfig{
+			"same":    {EnabledChannels: []string{"general"}},
+			"changed": {EnabledChannels: []string{"general", "random"}},
+			"added":   {},
+		},
+		Outputs: []config.OutputConfig{{Name: "kept"}, {Name: "changed", Source: "b"}, {Name: "added"}},
+	}
+	expect := []string{
+		"output changed: changed",
+		"output added: added",
+		"output removed: removed",
+		"guild added: added",
+		"guild changed: changed",
+		"guild removed: removed",
+		"debug: changed",
+		"token: changed, requires restart",
+	}
+
+	got := config.Diff(a, b)
+	if len(got) != len(expect) {
+		t.Fatalf("Wrong diff\nexpect: %q\ngot: %q", expect, got)
+	}
+	for i := range got {
+		if got[i] != expect[i] {
+			t.Errorf("Wrong diff line %d\nexpect: %s\ngot: %s", i, expect[i], got[i])
+		}
+	}
+
+	if diff := config.Diff(a, a); len(diff) != 0 {
+		t.Errorf("Expected no differences from identical configs, got %q", diff)
+	}
+}
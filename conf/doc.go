@@ -11,5 +11,7 @@
 // from Discord.
 //
 // Package config also implements the simple algorithm for checking if a
-// message is supposed to be duplicated using details from the message.
+// message is supposed to be duplicated using details from the message. For
+// routing many messages, a Config may be compiled into a Table, which makes
+// the same decisions without re-examining the whole config for each message.
 package config
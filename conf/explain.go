@@ -0,0 +1,102 @@
+package config
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Explanation is a trace of the decisions made while routing a message, as
+// returned by Config.Explain.
+type Explanation struct {
+	// Rule is the source of the rule which decided the route, if any.
+	Rule string `json:"rule,omitempty"`
+	// Guild is the key of the entry in Config.Guilds used for the message,
+	// if any. This may be DefaultGuild.
+	Guild string `json:"guild,omitempty"`
+	// Profile is the profile inherited by the guild entry, if any.
+	Profile string `json:"profile,omitempty"`
+	// Checks are the checks made, in order. Checking stops at the first
+	// failure.
+	Checks []Check `json:"checks"`
+	// Matched is true if the message is to be duplicated.
+	Matched bool `json:"matched"`
+	// Outputs are the names of the outputs selected for the message, where
+	// nil means all outputs. Only set if Matched is true.
+	Outputs []string `json:"outputs,omitempty"`
+}
+
+// Check is a single check made while routing a message.
+type Check struct {
+	// Name describes the check.
+	Name string `json:"name"`
+	// Passed is true if the message passed the check.
+	Passed bool `json:"passed"`
+}
+
+// check records a check named name with result ok in e and returns ok. If e is
+// nil, nothing is recorded.
+func (e *Explanation) check(name string, ok bool) bool {
+	if e != nil {
+		e.Checks = append(e.Checks, Check{Name: name, Passed: ok})
+	}
+	return ok
+}
+
+// Explain routes a message in the same way as Route, returning a trace of the
+// checks made and the outcome.
+//
+// Deprecated: like Route, this compiles c each time. Use Compile once and
+// Table.Explain instead.
+func (c Config) Explain(match MessageMatcher) Explanation {
+	var e Explanation
+	outs, ok := c.compileFor(&match).routeNames(&match, &e)
+	if e.Matched = ok; ok && len(outs) > 0 {
+		e.Outputs = outs
+	}
+	return e
+}
+
+// String formats e on a single line, such as:
+//
+//	guild "Ops" (profile "ops"): guild configured: pass, channel enabled: FAIL => dropped
+func (e Explanation) String() string {
+	b := &strings.Builder{}
+
+	switch {
+	case e.Rule != "":
+		b.WriteString("rule " + strconv.Quote(e.Rule))
+	case e.Guild != "":
+		b.WriteString("guild " + strconv.Quote(e.Guild))
+		if e.Profile != "" {
+			b.WriteString(" (profile " + strconv.Quote(e.Profile) + ")")
+		}
+	default:
+		b.WriteString("no guild")
+	}
+	b.WriteString(": ")
+
+	for i, c := range e.Checks {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(c.Name)
+		if c.Passed {
+			b.WriteString(": pass")
+		} else {
+			b.WriteString(": FAIL")
+		}
+	}
+
+	switch {
+	case !e.Matched:
+		b.WriteString(" => dropped")
+	case e.Outputs == nil:
+		b.WriteString(" => all outputs")
+	case len(e.Outputs) == 0:
+		b.WriteString(" => no outputs")
+	default:
+		b.WriteString(" => " + strings.Join(e.Outputs, ", "))
+	}
+
+	return b.String()
+}
@@ -0,0 +1,89 @@
+package config_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	config "github.com/ejv2/disdup/conf"
+)
+
+func TestExplain(t *testing.T) {
+	c := config.Config{
+		Guilds: map[string]*config.GuildConfig{
+			"a":                 {Profile: "p", EnabledChannels: []string{"a"}},
+			config.DefaultGuild: {Disable: true},
+		},
+		Profiles: map[string]*config.GuildConfig{
+			"p": {Output: []string{"stdout"}},
+		},
+	}
+	if err := c.Rule(`content contains "page" -> [pager]`); err != nil {
+		t.Fatal("Unexpected rule error:", err)
+	}
+
+	msg := config.MessageMatcher{
+		Author:  discordgo.User{ID: "1234", Username: "Ethan Marshall"},
+		Guild:   discordgo.Guild{ID: "a", Name: "a"},
+		Channel: discordgo.Channel{ID: "#a", Name: "a"},
+	}
+
+	t.Run("Matched", func(t *testing.T) {
+		e := c.Explain(msg)
+		if !e.Matched || e.Guild != "a" || e.Profile != "p" || e.Rule != "" {
+			t.Errorf("Wrong explanation: %+v", e)
+		}
+		if len(e.Outputs) != 1 || e.Outputs[0] != "stdout" {
+			t.Error("Wrong outputs:", e.Outputs)
+		}
+		for _, c := range e.Checks[1:] {
+			// First check is the rule, which does not match
+			if !c.Passed {
+				t.Error("Failed check for matched message:", c.Name)
+			}
+		}
+	})
+
+	t.Run("Dropped", func(t *testing.T) {
+		m := msg
+		m.Channel = discordgo.Channel{ID: "#b", Name: "b"}
+		e := c.Explain(m)
+		if e.Matched || e.Guild != "a" {
+			t.Errorf("Wrong explanation: %+v", e)
+		}
+		last := e.Checks[len(e.Checks)-1]
+		if last.Name != "channel enabled" || last.Passed {
+			t.Error("Wrong last check:", last)
+		}
+		if s := e.String(); !strings.Contains(s, "channel enabled: FAIL") || !strings.HasSuffix(s, "=> dropped") {
+			t.Error("Wrong formatting of explanation:", s)
+		}
+	})
+
+	t.Run("Default", func(t *testing.T) {
+		m := msg
+		m.Guild = discordgo.Guild{ID: "z", Name: "z"}
+		e := c.Explain(m)
+		if e.Matched || e.Guild != config.DefaultGuild {
+			t.Errorf("Wrong explanation: %+v", e)
+		}
+	})
+
+	t.Run("Rule", func(t *testing.T) {
+		m := msg
+		m.Content = "please page me"
+		e := c.Explain(m)
+		if !e.Matched || e.Rule == "" || len(e.Outputs) != 1 || e.Outputs[0] != "pager" {
+			t.Errorf("Wrong explanation: %+v", e)
+		}
+	})
+
+	// Explanations must agree with routing
+	for _, m := range append(TestMessages, msg) {
+		outs, ok := c.Route(m)
+		e := c.Explain(m)
+		if e.Matched != ok || len(e.Outputs) != len(outs) {
+			t.Errorf("Explanation disagrees with route for %+v: %v", m, e)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package config
+
+import "regexp"
+
+// ContentFilter selects messages by their content. A message passes the
+// filter if it matches at least one include pattern or keyword (or there are
+// none) and matches no exclude pattern or keyword. Patterns and keywords are
+// matched against the formatted content of the message and the filename of
+// each of its attachments.
+//
+// The zero value of this type passes all messages.
+type ContentFilter struct {
+	// Include are regular expressions, in the syntax accepted by package
+	// regexp, of which at least one must match.
+	Include []string `json:"include"`
+	// Exclude are regular expressions, any of which excludes a message.
+	Exclude []string `json:"exclude"`
+	// IncludeKeywords are plain strings, of which at least one must be
+	// contained in the message. These are checked alongside Include, such
+	// that matching either is sufficient.
+	IncludeKeywords []string `json:"include_keywords"`
+	// ExcludeKeywords are plain strings, any of which excludes a message.
+	ExcludeKeywords []string `json:"exclude_keywords"`
+	// IgnoreCase makes all patterns and keywords case-insensitive.
+	IgnoreCase bool `json:"ignore_case"`
+}
+
+// compilePattern compiles pattern, making it case-insensitive if ignoreCase
+// is set. Compiled patterns are kept by the Table which uses them.
+func compilePattern(pattern string, ignoreCase bool) (*regexp.Regexp, error) {
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+// Empty returns true if f has no patterns or keywords, and so passes all
+// messages.
+func (f ContentFilter) Empty() bool {
+	return len(f.Include) == 0 && len(f.Exclude) == 0 &&
+		len(f.IncludeKeywords) == 0 && len(f.ExcludeKeywords) == 0
+}
+
+// Compile checks that every pattern in f is a valid regular expression,
+// returning the first compilation error found.
+func (f ContentFilter) Compile() error {
+	for _, list := range [][]string{f.Include, f.Exclude} {
+		for _, pattern := range list {
+			if _, err := compilePattern(pattern, f.IgnoreCase); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Passes returns true if content or any of the attachment filenames in
+// attachments pass the filter. Invalid patterns never match. Patterns are
+// compiled each time; a Table compiles them once.
+func (f ContentFilter) Passes(content string, attachments []string) bool {
+	return compileFilter(f).passes(&MessageMatcher{Content: content, Attachments: attachments})
+}
@@ -0,0 +1,100 @@
+package config_test
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	config "github.com/ejv2/disdup/conf"
+)
+
+func TestContentFilter_Passes(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Filter      config.ContentFilter
+		Content     string
+		Attachments []string
+		Expect      bool
+	}{
+		{"Empty", config.ContentFilter{}, "anything", nil, true},
+		{"Include", config.ContentFilter{Include: []string{`^deploy(ed)? `}}, "deployed the thing", nil, true},
+		{"Include (no match)", config.ContentFilter{Include: []string{`^deploy(ed)? `}}, "we deployed", nil, false},
+		{"Include keyword", config.ContentFilter{IncludeKeywords: []string{"deploy"}}, "we deployed", nil, true},
+		{"Include either", config.ContentFilter{Include: []string{`^x$`}, IncludeKeywords: []string{"deploy"}}, "deploy", nil, true},
+		{"Exclude", config.ContentFilter{Exclude: []string{`(?:spam){2}`}}, "spamspam", nil, false},
+		{"Exclude keyword", config.ContentFilter{ExcludeKeywords: []string{"spam"}}, "no spam here", nil, false},
+		{"Exclude overrides include", config.ContentFilter{
+			IncludeKeywords: []string{"deploy"},
+			ExcludeKeywords: []string{"test"},
+		}, "deploy test", nil, false},
+		{"Case sensitive", config.ContentFilter{IncludeKeywords: []string{"Deploy"}}, "deploy", nil, false},
+		{"Ignore case keyword", config.ContentFilter{IncludeKeywords: []string{"Deploy"}, IgnoreCase: true}, "DEPLOY", nil, true},
+		{"Ignore case pattern", config.ContentFilter{Include: []string{`^deploy$`}, IgnoreCase: true}, "DEPLOY", nil, true},
+		{"Attachment", config.ContentFilter{Include: []string{`\.log$`}}, "see attached", []string{"a.png", "b.log"}, true},
+		{"Attachment exclude", config.ContentFilter{ExcludeKeywords: []string{".exe"}}, "see attached", []string{"setup.exe"}, false},
+		{"Invalid pattern", config.ContentFilter{Include: []string{`(`}}, "(", nil, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			if got := c.Filter.Passes(c.Content, c.Attachments); got != c.Expect {
+				t.Errorf("expected %v, got %v", c.Expect, got)
+			}
+		})
+	}
+}
+
+func TestContentFilter_Compile(t *testing.T) {
+	if err := (config.ContentFilter{Include: []string{`^ok$`}, Exclude: []string{`a+`}}).Compile(); err != nil {
+		t.Error("Unexpected compile error:", err)
+	}
+	if err := (config.ContentFilter{Exclude: []string{`a(`}}).Compile(); err == nil {
+		t.Error("Expected compile error for invalid pattern")
+	}
+}
+
+func TestMatches_Filter(t *testing.T) {
+	c := config.Config{Guilds: map[string]*config.GuildConfig{
+		"a": {
+			Filter: config.ContentFilter{ExcludeKeywords: []string{"spam"}},
+			Channels: map[string]*config.ChannelConfig{
+				"deploys": {Filter: config.ContentFilter{IncludeKeywords: []string{"deploy"}}},
+			},
+		},
+	}}
+	msg := config.MessageMatcher{
+		Author:  discordgo.User{ID: "1234", Username: "Ethan Marshall"},
+		Guild:   discordgo.Guild{ID: "a", Name: "a"},
+		Channel: discordgo.Channel{ID: "#general", Name: "general"},
+		Content: "hello",
+	}
+
+	if !c.MessageMatches(msg) {
+		t.Error("Message without channel filter did not match")
+	}
+	msg.Content = "spam"
+	if c.MessageMatches(msg) {
+		t.Error("Message excluded by guild filter matched")
+	}
+
+	msg.Channel = discordgo.Channel{ID: "#deploys", Name: "deploys"}
+	msg.Content = "hello"
+	if c.MessageMatches(msg) {
+		t.Error("Message not included by channel filter matched")
+	}
+	msg.Content = "deploy done"
+	if !c.MessageMatches(msg) {
+		t.Error("Message included by channel filter did not match")
+	}
+	msg.Content = "deploy spam"
+	if c.MessageMatches(msg) {
+		t.Error("Message excluded by guild filter matched in filtered channel")
+	}
+
+	// Threads use the filter of their parent
+	msg.Channel = discordgo.Channel{ID: "#thread", Name: "thread"}
+	msg.Parent = discordgo.Channel{ID: "#deploys", Name: "deploys"}
+	msg.Content = "hello"
+	if c.MessageMatches(msg) {
+		t.Error("Thread message not included by parent filter matched")
+	}
+}
@@ -1,77 +1,183 @@
 package config
 
-import (
-	"github.com/bwmarrin/discordgo"
-)
+import "github.com/bwmarrin/discordgo"
 
 // MessageMatcher is a representation of a message better suited to matching
-// against a config. It is used for the MessageMatches function.
+// against a config. It is used for the MessageMatches function. Direct
+// messages are represented with the zero value for Guild.
 type MessageMatcher struct {
 	Author  discordgo.User
 	Guild   discordgo.Guild
 	Channel discordgo.Channel
+	// Parent is the channel containing Channel if Channel is a thread or
+	// forum post, else the zero value. Channel rules which match the parent
+	// also match its threads.
+	Parent discordgo.Channel
+	// Category is the category containing Channel (or Parent, for threads),
+	// else the zero value. This only need be set if the guild
+	// configuration uses categories; see GuildConfig.UsesCategories.
+	Category discordgo.Channel
+	// Roles are the roles of Author in Guild. These only need be set if
+	// the guild configuration uses roles; see GuildConfig.UsesRoles.
+	Roles []discordgo.Role
+	// Nick is the nickname of Author in Guild, if any. This only need be
+	// set if the guild configuration uses nicknames; see
+	// GuildConfig.UsesNicknames.
+	Nick string
+	// Content is the formatted content of the message, used for content
+	// filters.
+	Content string
+	// Attachments are the filenames of each attachment to the message,
+	// used for content filters.
+	Attachments []string
+	// Type is the type of the message, used to find system messages.
+	Type discordgo.MessageType
+	// WebhookID is the ID of the webhook which sent the message, if any.
+	WebhookID string
+	// Self is true if the message was sent by disdup's own bot user.
+	Self bool
+	// Mentions are the users mentioned by the message.
+	Mentions []discordgo.User
+	// MentionsEveryone is true if the message mentions @everyone or @here.
+	MentionsEveryone bool
 }
 
 // FindGuild looks up the first guild configuration matching either id or name,
-// with id taking precedence. If none could be found, nil is returned.
+// with id taking precedence, falling back to the DefaultGuild entry. The
+// configuration returned has its profile, if any, already applied, so must not
+// be modified. If none could be found, nil is returned.
 func (c Config) FindGuild(id, name string) *GuildConfig {
-	g, ok := c.Guilds[id]
-	if !ok {
-		g, ok = c.Guilds[name]
-		if !ok {
-			return nil
-		}
+	_, g := c.findGuild(id, name)
+	return g
+}
 
-		return g
+// findGuild implements FindGuild, additionally returning the key of the entry
+// found in Guilds.
+func (c Config) findGuild(id, name string) (string, *GuildConfig) {
+	for _, key := range []string{id, name, DefaultGuild} {
+		if g, ok := c.Guilds[key]; ok {
+			return key, c.resolve(g)
+		}
 	}
 
-	return g
+	return "", nil
+}
+
+// Route decides whether a message is to be duplicated and to which outputs,
+// returning the output names (where no names means all outputs) and true if
+// it is. Rules are checked first, in order, and the first matching rule
+// decides. If no rule matches, the message is checked by MessageMatches and
+// its outputs selected by MessageOutputs.
+//
+// Route compiles the parts of c needed into a Table each time, and so routes
+// messages exactly as Table.Route, except that output names are returned as
+// given, even if no such output exists.
+//
+// Deprecated: compiling takes far longer than routing, so this is slow if
+// called for every message. Use Compile once and Table.Route instead.
+func (c Config) Route(match MessageMatcher) ([]string, bool) {
+	return c.compileFor(&match).routeNames(&match, nil)
 }
 
 // MessageMatches returns true if a message matches the criteria in Config,
 // else returns false. A special MessageMatcher object is used to pass message
 // info such that client code can do any lookups that it wishes, rather than
 // passing the whole message and requiring lookups to happen here.
+//
+// Criteria are checked in order of precedence, the first failure rejecting the
+// message:
+//  1. The guild must be configured and not disabled
+//  2. The author must not be ignored by the author policy
+//  3. The channel, category, user and roles must not be disabled
+//  4. The channel or its category, and the user or one of their roles, must
+//     be enabled
+//  5. The content must pass the guild and channel filters
+//
+// Blocklists therefore always override allow lists.
+//
+// Deprecated: like Route, this compiles c each time. Use Compile once and
+// Table.Matches instead.
 func (c Config) MessageMatches(match MessageMatcher) bool {
-	// Guild checks
-	g, ok := c.Guilds[match.Guild.ID]
-	if !ok {
-		g, ok = c.Guilds[match.Guild.Name]
-		if !ok {
-			return false
-		}
+	_, ok := c.compileFor(&match).matches(&match, nil)
+	return ok
+}
+
+// Ignores returns true if the author policy p ignores the author of match.
+func (p AuthorPolicy) Ignores(match MessageMatcher) bool {
+	switch {
+	case p.IgnoreSelf && match.Self:
+		return true
+	case p.IgnoreWebhooks && match.WebhookID != "":
+		return true
+	case p.IgnoreBots && match.WebhookID == "" && match.Author.Bot:
+		return true
+	case p.IgnoreSystemMessages && isSystem(match.Type):
+		return true
 	}
-	if g.Disable {
+
+	return false
+}
+
+// isSystem returns true if messages of type t are sent by Discord, rather than
+// written by their author.
+func isSystem(t discordgo.MessageType) bool {
+	switch t {
+	case discordgo.MessageTypeDefault, discordgo.MessageTypeReply,
+		discordgo.MessageTypeChatInputCommand, discordgo.MessageTypeContextMenuCommand:
 		return false
 	}
 
-	// Channel checks
-	if len(g.EnabledChannels) > 0 {
-		found := false
-		for _, elem := range g.EnabledChannels {
-			if elem == match.Channel.ID || elem == match.Channel.Name {
-				found = true
-			}
-		}
+	return true
+}
 
-		if !found {
-			return false
-		}
+// MessageOutputs returns the names of the outputs to which a message should
+// be written, where no names means all outputs. It does not check if the
+// message matches; for that, see MessageMatches.
+//
+// Outputs are selected by the guild, then added to or replaced by the output
+// rules of the channel (or thread parent) and then the author, such that the
+// most specific rule applies last.
+//
+// Deprecated: like Route, this compiles c each time. Use Compile once and
+// Table.Outputs instead.
+func (c Config) MessageOutputs(match MessageMatcher) []string {
+	if match.Guild.ID == "" {
+		return c.DirectMessages.Output
+	}
+
+	g := c.compileFor(&match).guild(match.Guild.ID, match.Guild.Name)
+	if g == nil {
+		return nil
 	}
+	return g.routeNames(&match)
+}
 
-	// User checks
-	if len(g.EnabledUsers) > 0 {
+// apply returns the outputs selected by r given those selected by less
+// specific configuration, where no outputs means all outputs.
+func (r OutputRule) apply(outs []string) []string {
+	if len(r.Output) == 0 {
+		return outs
+	}
+	if r.OverrideOutput {
+		return r.Output
+	}
+	// Adding to all outputs has no effect
+	if len(outs) == 0 {
+		return outs
+	}
+
+	ret := append([]string(nil), outs...)
+	for _, name := range r.Output {
 		found := false
-		for _, elem := range g.EnabledUsers {
-			if elem == match.Author.ID || elem == match.Author.Username {
+		for _, elem := range ret {
+			if elem == name {
 				found = true
+				break
 			}
 		}
-
 		if !found {
-			return false
+			ret = append(ret, name)
 		}
 	}
-
-	return true
+	return ret
 }
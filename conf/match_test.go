@@ -108,3 +108,399 @@ func TestMatches(t *testing.T) {
 		})
 	}
 }
+
+func TestMatches_DM(t *testing.T) {
+	dm := config.MessageMatcher{
+		Author:  discordgo.User{ID: "1234", Username: "Ethan Marshall"},
+		Channel: discordgo.Channel{ID: "#dm"},
+	}
+	guilds := map[string]*config.GuildConfig{
+		"a": {Output: []string{"guild"}},
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		c := config.Config{Guilds: guilds}
+		if c.MessageMatches(dm) {
+			t.Error("DM matched with direct messages disabled")
+		}
+	})
+	t.Run("Enabled", func(t *testing.T) {
+		c := config.Config{Guilds: guilds, DirectMessages: config.DMConfig{
+			Enable: true,
+			Output: []string{"dm"},
+		}}
+		if !c.MessageMatches(dm) {
+			t.Error("DM did not match with direct messages enabled")
+		}
+		if out := c.MessageOutputs(dm); len(out) != 1 || out[0] != "dm" {
+			t.Error("Wrong outputs for DM: got", out)
+		}
+		if out := c.MessageOutputs(TestMessages[0]); len(out) != 1 || out[0] != "guild" {
+			t.Error("Wrong outputs for guild message: got", out)
+		}
+	})
+	t.Run("Users", func(t *testing.T) {
+		c := config.Config{DirectMessages: config.DMConfig{
+			Enable:       true,
+			EnabledUsers: []string{"Cole Phelps", "4206"},
+		}}
+		if c.MessageMatches(dm) {
+			t.Error("DM matched from user not enabled")
+		}
+
+		dm.Author.ID = "4206"
+		if !c.MessageMatches(dm) {
+			t.Error("DM did not match from enabled user")
+		}
+	})
+}
+
+func TestMatches_Thread(t *testing.T) {
+	c := config.Config{Guilds: map[string]*config.GuildConfig{
+		"a": {EnabledChannels: []string{"general"}},
+	}}
+	msg := config.MessageMatcher{
+		Author:  discordgo.User{ID: "1234", Username: "Ethan Marshall"},
+		Guild:   discordgo.Guild{ID: "a", Name: "a"},
+		Channel: discordgo.Channel{ID: "#thread", Name: "A thread", ParentID: "#general"},
+	}
+
+	if c.MessageMatches(msg) {
+		t.Error("Thread matched without a matching parent")
+	}
+
+	msg.Parent = discordgo.Channel{ID: "#general", Name: "general"}
+	if !c.MessageMatches(msg) {
+		t.Error("Thread did not match with an enabled parent")
+	}
+
+	msg.Parent.Name = "random"
+	if c.MessageMatches(msg) {
+		t.Error("Thread matched with a parent which is not enabled")
+	}
+}
+
+func TestMatches_Roles(t *testing.T) {
+	c := config.Config{Guilds: map[string]*config.GuildConfig{
+		"roles": {EnabledRoles: []string{"Staff", "42"}},
+		"both":  {EnabledUsers: []string{"Cole Phelps"}, EnabledRoles: []string{"Staff"}},
+		"block": {DisabledRoles: []string{"Muted"}},
+		"mixed": {EnabledUsers: []string{"Ethan Marshall"}, DisabledRoles: []string{"Muted"}},
+	}}
+	staff := discordgo.Role{ID: "1", Name: "Staff"}
+	byID := discordgo.Role{ID: "42", Name: "Renamed"}
+	muted := discordgo.Role{ID: "2", Name: "Muted"}
+
+	cases := []struct {
+		Name   string
+		Guild  string
+		Roles  []discordgo.Role
+		Expect bool
+	}{
+		{"Enabled role", "roles", []discordgo.Role{staff}, true},
+		{"Enabled role by ID", "roles", []discordgo.Role{byID}, true},
+		{"No enabled role", "roles", []discordgo.Role{muted}, false},
+		{"No roles", "roles", nil, false},
+		{"Role without user", "both", []discordgo.Role{staff}, true},
+		{"Neither user nor role", "both", nil, false},
+		{"Disabled role", "block", []discordgo.Role{staff, muted}, false},
+		{"Not disabled", "block", []discordgo.Role{staff}, true},
+		{"Disabled overrides user", "mixed", []discordgo.Role{muted}, false},
+		{"User without disabled role", "mixed", nil, true},
+	}
+
+	for _, test := range cases {
+		t.Run(test.Name, func(t *testing.T) {
+			msg := config.MessageMatcher{
+				Author:  discordgo.User{ID: "1234", Username: "Ethan Marshall"},
+				Guild:   discordgo.Guild{ID: test.Guild, Name: test.Guild},
+				Channel: discordgo.Channel{ID: "#a", Name: "a"},
+				Roles:   test.Roles,
+			}
+			if got := c.MessageMatches(msg); got != test.Expect {
+				t.Errorf("expected %v, got %v", test.Expect, got)
+			}
+		})
+	}
+
+	if !c.UsesRoles() {
+		t.Error("Config with roles does not use roles")
+	}
+	if (config.Config{Guilds: map[string]*config.GuildConfig{"a": {}}}).UsesRoles() {
+		t.Error("Config without roles uses roles")
+	}
+}
+
+func TestMatches_Blocklist(t *testing.T) {
+	c := config.Config{Guilds: map[string]*config.GuildConfig{
+		"a": {
+			EnabledChannels:  []string{"a", "b"},
+			DisabledChannels: []string{"b", "#noisy"},
+			EnabledUsers:     []string{"Ethan Marshall", "Cole Phelps"},
+			DisabledUsers:    []string{"1247"},
+		},
+	}}
+	cases := []struct {
+		Name    string
+		User    discordgo.User
+		Channel discordgo.Channel
+		Parent  discordgo.Channel
+		Expect  bool
+	}{
+		{"Enabled", discordgo.User{ID: "1234", Username: "Ethan Marshall"}, discordgo.Channel{ID: "#a", Name: "a"}, discordgo.Channel{}, true},
+		{"Disabled channel overrides enabled", discordgo.User{ID: "1234", Username: "Ethan Marshall"}, discordgo.Channel{ID: "#b", Name: "b"}, discordgo.Channel{}, false},
+		{"Disabled parent", discordgo.User{ID: "1234", Username: "Ethan Marshall"}, discordgo.Channel{ID: "#t", Name: "a"}, discordgo.Channel{ID: "#noisy", Name: "noisy"}, false},
+		{"Disabled user overrides enabled", discordgo.User{ID: "1247", Username: "Cole Phelps"}, discordgo.Channel{ID: "#a", Name: "a"}, discordgo.Channel{}, false},
+	}
+
+	for _, test := range cases {
+		t.Run(test.Name, func(t *testing.T) {
+			msg := config.MessageMatcher{
+				Author:  test.User,
+				Guild:   discordgo.Guild{ID: "a", Name: "a"},
+				Channel: test.Channel,
+				Parent:  test.Parent,
+			}
+			if got := c.MessageMatches(msg); got != test.Expect {
+				t.Errorf("expected %v, got %v", test.Expect, got)
+			}
+		})
+	}
+
+	// Disabled lists alone keep all other channels and users enabled
+	c.Guilds["a"].EnabledChannels, c.Guilds["a"].EnabledUsers = nil, nil
+	msg := config.MessageMatcher{
+		Author:  discordgo.User{ID: "4206", Username: "Jay Irwin"},
+		Guild:   discordgo.Guild{ID: "a", Name: "a"},
+		Channel: discordgo.Channel{ID: "#c", Name: "c"},
+	}
+	if !c.MessageMatches(msg) {
+		t.Error("Message in channel not disabled did not match")
+	}
+}
+
+func TestMatches_Names(t *testing.T) {
+	c := config.Config{Guilds: map[string]*config.GuildConfig{
+		"a": {
+			EnabledUsers:  []string{"username:Ethan Marshall", "global_name:Cole", "nick:Boss"},
+			DisabledUsers: []string{"nick:Spammer"},
+			Users: map[string]*config.UserConfig{
+				"nick:Boss":          {OutputRule: config.OutputRule{Output: []string{"pager"}, OverrideOutput: true}},
+				"global_name:Boss":   {OutputRule: config.OutputRule{Output: []string{"mail"}, OverrideOutput: true}},
+				"username:jay.irwin": {OutputRule: config.OutputRule{Output: []string{"audit"}, OverrideOutput: true}},
+			},
+		},
+	}}
+	cases := []struct {
+		Name    string
+		User    discordgo.User
+		Nick    string
+		Expect  bool
+		Outputs []string
+	}{
+		{"Username", discordgo.User{ID: "1234", Username: "Ethan Marshall"}, "", true, nil},
+		{"Username prefix ignores ID", discordgo.User{ID: "Ethan Marshall", Username: "ethan"}, "", false, nil},
+		{"Global name", discordgo.User{ID: "1247", Username: "cole", GlobalName: "Cole"}, "", true, nil},
+		{"Global name is not username", discordgo.User{ID: "1247", Username: "Cole"}, "", false, nil},
+		{"Nickname", discordgo.User{ID: "4206", Username: "jay"}, "Boss", true, []string{"pager"}},
+		{"Nickname before global name", discordgo.User{ID: "4206", Username: "jay", GlobalName: "Boss"}, "Boss", true, []string{"pager"}},
+		{"Username before nickname", discordgo.User{ID: "4206", Username: "jay.irwin", GlobalName: "Cole"}, "Boss", true, []string{"audit"}},
+		{"Disabled nickname", discordgo.User{ID: "1234", Username: "Ethan Marshall"}, "Spammer", false, nil},
+	}
+
+	for _, test := range cases {
+		t.Run(test.Name, func(t *testing.T) {
+			msg := config.MessageMatcher{
+				Author:  test.User,
+				Nick:    test.Nick,
+				Guild:   discordgo.Guild{ID: "a", Name: "a"},
+				Channel: discordgo.Channel{ID: "#a", Name: "a"},
+			}
+			if got := c.MessageMatches(msg); got != test.Expect {
+				t.Fatalf("expected %v, got %v", test.Expect, got)
+			}
+			if !test.Expect {
+				return
+			}
+
+			got := c.MessageOutputs(msg)
+			if len(got) != len(test.Outputs) || (len(got) > 0 && got[0] != test.Outputs[0]) {
+				t.Errorf("expected outputs %v, got %v", test.Outputs, got)
+			}
+		})
+	}
+
+	if !c.UsesNicknames() {
+		t.Error("Config using nicknames does not use nicknames")
+	}
+	delete(c.Guilds["a"].Users, "nick:Boss")
+	c.Guilds["a"].EnabledUsers, c.Guilds["a"].DisabledUsers = nil, nil
+	if c.UsesNicknames() {
+		t.Error("Config without nicknames uses nicknames")
+	}
+}
+
+func TestMatches_AuthorPolicy(t *testing.T) {
+	policy := config.AuthorPolicy{
+		IgnoreBots:           true,
+		IgnoreWebhooks:       true,
+		IgnoreSelf:           true,
+		IgnoreSystemMessages: true,
+	}
+	base := config.MessageMatcher{
+		Author:  discordgo.User{ID: "1234", Username: "Ethan Marshall"},
+		Guild:   discordgo.Guild{ID: "a", Name: "a"},
+		Channel: discordgo.Channel{ID: "#a", Name: "a"},
+	}
+
+	cases := []struct {
+		Name   string
+		Modify func(m *config.MessageMatcher)
+		Expect bool
+	}{
+		{"User", func(m *config.MessageMatcher) {}, true},
+		{"Reply", func(m *config.MessageMatcher) { m.Type = discordgo.MessageTypeReply }, true},
+		{"Bot", func(m *config.MessageMatcher) { m.Author.Bot = true }, false},
+		{"Webhook", func(m *config.MessageMatcher) { m.WebhookID = "1" }, false},
+		{"Self", func(m *config.MessageMatcher) { m.Self = true }, false},
+		{"System", func(m *config.MessageMatcher) { m.Type = discordgo.MessageTypeGuildMemberJoin }, false},
+	}
+
+	for _, test := range cases {
+		t.Run(test.Name, func(t *testing.T) {
+			msg := base
+			test.Modify(&msg)
+
+			// Author policy overrides enabled users
+			c := config.Config{Guilds: map[string]*config.GuildConfig{
+				"a": {AuthorPolicy: policy, EnabledUsers: []string{"1234"}},
+			}}
+			if got := c.MessageMatches(msg); got != test.Expect {
+				t.Errorf("expected %v, got %v", test.Expect, got)
+			}
+
+			// Zero value ignores nothing
+			c.Guilds["a"].AuthorPolicy = config.AuthorPolicy{}
+			if !c.MessageMatches(msg) {
+				t.Error("Message ignored without author policy")
+			}
+		})
+	}
+
+	t.Run("WebhookNotBot", func(t *testing.T) {
+		msg := base
+		msg.Author.Bot, msg.WebhookID = true, "1"
+		c := config.Config{Guilds: map[string]*config.GuildConfig{
+			"a": {AuthorPolicy: config.AuthorPolicy{IgnoreBots: true}},
+		}}
+		if !c.MessageMatches(msg) {
+			t.Error("Webhook message ignored as a bot")
+		}
+	})
+}
+
+func TestMatches_Category(t *testing.T) {
+	c := config.Config{Guilds: map[string]*config.GuildConfig{
+		"a": {
+			EnabledChannels:    []string{"standalone"},
+			EnabledCategories:  []string{"Engineering", "#ops"},
+			DisabledCategories: []string{"Archive"},
+			DisabledChannels:   []string{"ops-noise"},
+		},
+	}}
+	cases := []struct {
+		Name     string
+		Channel  string
+		Category discordgo.Channel
+		Expect   bool
+	}{
+		{"Enabled category", "new-channel", discordgo.Channel{ID: "#eng", Name: "Engineering"}, true},
+		{"Enabled category by ID", "pager", discordgo.Channel{ID: "#ops", Name: "Operations"}, true},
+		{"Enabled channel", "standalone", discordgo.Channel{}, true},
+		{"No category", "general", discordgo.Channel{}, false},
+		{"Other category", "general", discordgo.Channel{ID: "#misc", Name: "Misc"}, false},
+		{"Disabled category", "standalone", discordgo.Channel{ID: "#arch", Name: "Archive"}, false},
+		{"Disabled channel in enabled category", "ops-noise", discordgo.Channel{ID: "#ops", Name: "Operations"}, false},
+	}
+
+	for _, test := range cases {
+		t.Run(test.Name, func(t *testing.T) {
+			msg := config.MessageMatcher{
+				Author:   discordgo.User{ID: "1234", Username: "Ethan Marshall"},
+				Guild:    discordgo.Guild{ID: "a", Name: "a"},
+				Channel:  discordgo.Channel{ID: "#" + test.Channel, Name: test.Channel},
+				Category: test.Category,
+			}
+			if got := c.MessageMatches(msg); got != test.Expect {
+				t.Errorf("expected %v, got %v", test.Expect, got)
+			}
+		})
+	}
+}
+
+func TestMessageOutputs(t *testing.T) {
+	c := config.Config{Guilds: map[string]*config.GuildConfig{
+		"a": {
+			Output: []string{"stdout"},
+			Channels: map[string]*config.ChannelConfig{
+				"alerts": {OutputRule: config.OutputRule{Output: []string{"mail"}}},
+				"secret": {OutputRule: config.OutputRule{Output: []string{"vault"}, OverrideOutput: true}},
+			},
+			Users: map[string]*config.UserConfig{
+				"Cole Phelps": {OutputRule: config.OutputRule{Output: []string{"pager", "stdout"}}},
+				"4206":        {OutputRule: config.OutputRule{Output: []string{"audit"}, OverrideOutput: true}},
+			},
+		},
+		"all": {
+			Channels: map[string]*config.ChannelConfig{
+				"alerts": {OutputRule: config.OutputRule{Output: []string{"mail"}}},
+				"secret": {OutputRule: config.OutputRule{Output: []string{"vault"}, OverrideOutput: true}},
+			},
+		},
+	}}
+	ethan := discordgo.User{ID: "1234", Username: "Ethan Marshall"}
+	cole := discordgo.User{ID: "1247", Username: "Cole Phelps"}
+	jay := discordgo.User{ID: "4206", Username: "Jay Irwin"}
+
+	cases := []struct {
+		Name    string
+		Guild   string
+		Channel string
+		Parent  string
+		Author  discordgo.User
+		Expect  []string
+	}{
+		{"Guild", "a", "general", "", ethan, []string{"stdout"}},
+		{"Channel union", "a", "alerts", "", ethan, []string{"stdout", "mail"}},
+		{"Thread uses parent", "a", "thread", "alerts", ethan, []string{"stdout", "mail"}},
+		{"Channel override", "a", "secret", "", ethan, []string{"vault"}},
+		{"User union", "a", "alerts", "", cole, []string{"stdout", "mail", "pager"}},
+		{"User union after override", "a", "secret", "", cole, []string{"vault", "pager", "stdout"}},
+		{"User override", "a", "alerts", "", jay, []string{"audit"}},
+		{"All outputs union", "all", "alerts", "", ethan, nil},
+		{"All outputs override", "all", "secret", "", ethan, []string{"vault"}},
+	}
+
+	for _, test := range cases {
+		t.Run(test.Name, func(t *testing.T) {
+			msg := config.MessageMatcher{
+				Author:  test.Author,
+				Guild:   discordgo.Guild{ID: test.Guild, Name: test.Guild},
+				Channel: discordgo.Channel{ID: "#" + test.Channel, Name: test.Channel},
+			}
+			if test.Parent != "" {
+				msg.Parent = discordgo.Channel{ID: "#" + test.Parent, Name: test.Parent}
+			}
+
+			got := c.MessageOutputs(msg)
+			if len(got) != len(test.Expect) {
+				t.Fatalf("expected %v, got %v", test.Expect, got)
+			}
+			for i := range got {
+				if got[i] != test.Expect[i] {
+					t.Fatalf("expected %v, got %v", test.Expect, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package config
+
+// resolve returns g with its profile applied. If g has no profile, g itself
+// is returned. Profiles may inherit from other profiles, but a profile which
+// (indirectly) inherits from itself is only applied once.
+func (c Config) resolve(g *GuildConfig) *GuildConfig {
+	seen := make(map[string]bool)
+	return c.resolveSeen(g, seen)
+}
+
+// resolveSeen implements resolve, skipping the profiles already in seen.
+func (c Config) resolveSeen(g *GuildConfig, seen map[string]bool) *GuildConfig {
+	if g.Profile == "" || seen[g.Profile] {
+		return g
+	}
+	p, ok := c.Profiles[g.Profile]
+	if !ok {
+		return g
+	}
+	seen[g.Profile] = true
+
+	return merge(c.resolveSeen(p, seen), g)
+}
+
+// pick returns over if set, else base.
+func pick[T any](base, over []T) []T {
+	if over != nil {
+		return over
+	}
+	return base
+}
+
+// merge returns a new configuration with the options of base overridden by
+// those set in over.
+func merge(base, over *GuildConfig) *GuildConfig {
+	out := &GuildConfig{
+		Disable:            base.Disable || over.Disable,
+		Output:             pick(base.Output, over.Output),
+		EnabledChannels:    pick(base.EnabledChannels, over.EnabledChannels),
+		EnabledUsers:       pick(base.EnabledUsers, over.EnabledUsers),
+		EnabledCategories:  pick(base.EnabledCategories, over.EnabledCategories),
+		EnabledRoles:       pick(base.EnabledRoles, over.EnabledRoles),
+		DisabledChannels:   pick(base.DisabledChannels, over.DisabledChannels),
+		DisabledCategories: pick(base.DisabledCategories, over.DisabledCategories),
+		DisabledUsers:      pick(base.DisabledUsers, over.DisabledUsers),
+		DisabledRoles:      pick(base.DisabledRoles, over.DisabledRoles),
+		AuthorPolicy: AuthorPolicy{
+			IgnoreBots:           base.IgnoreBots || over.IgnoreBots,
+			IgnoreWebhooks:       base.IgnoreWebhooks || over.IgnoreWebhooks,
+			IgnoreSelf:           base.IgnoreSelf || over.IgnoreSelf,
+			IgnoreSystemMessages: base.IgnoreSystemMessages || over.IgnoreSystemMessages,
+		},
+		Filter: base.Filter,
+	}
+	if !over.Filter.Empty() {
+		out.Filter = over.Filter
+	}
+
+	out.Channels = mergeMap(base.Channels, over.Channels)
+	out.Users = mergeMap(base.Users, over.Users)
+
+	return out
+}
+
+// mergeMap returns the union of base and over, with entries in over replacing
+// those in base. If both are empty, nil is returned.
+func mergeMap[T any](base, over map[string]T) map[string]T {
+	if len(base) == 0 && len(over) == 0 {
+		return nil
+	}
+
+	out := make(map[string]T, len(base)+len(over))
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range over {
+		out[k] = v
+	}
+	return out
+}
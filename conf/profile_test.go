@@ -0,0 +1,98 @@
+package config_test
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	config "github.com/ejv2/disdup/conf"
+)
+
+func TestFindGuild_Default(t *testing.T) {
+	c := config.Config{Guilds: map[string]*config.GuildConfig{
+		"a":                 {Output: []string{"a"}},
+		config.DefaultGuild: {Output: []string{"default"}},
+	}}
+
+	if g := c.FindGuild("a", "a"); g == nil || g.Output[0] != "a" {
+		t.Error("Listed guild did not use its own entry")
+	}
+	if g := c.FindGuild("b", "b"); g == nil || g.Output[0] != "default" {
+		t.Error("Unlisted guild did not use the default entry")
+	}
+
+	delete(c.Guilds, config.DefaultGuild)
+	if g := c.FindGuild("b", "b"); g != nil {
+		t.Error("Unlisted guild found without a default entry")
+	}
+}
+
+func TestFindGuild_Profile(t *testing.T) {
+	c := config.Config{
+		Guilds: map[string]*config.GuildConfig{
+			"inherit":  {Profile: "ops"},
+			"override": {Profile: "ops", Output: []string{"stdout"}, EnabledChannels: []string{}},
+			"chain":    {Profile: "strict"},
+			"cycle":    {Profile: "loop"},
+			"unknown":  {Profile: "nope", Output: []string{"stdout"}},
+			"*":        {Profile: "ops", Disable: true},
+		},
+		Profiles: map[string]*config.GuildConfig{
+			"ops": {
+				Output:          []string{"mail"},
+				EnabledChannels: []string{"alerts"},
+				AuthorPolicy:    config.AuthorPolicy{IgnoreBots: true},
+			},
+			"strict": {Profile: "ops", DisabledUsers: []string{"spammer"}},
+			"loop":   {Profile: "loop", Output: []string{"loop"}},
+		},
+	}
+
+	g := c.FindGuild("inherit", "")
+	if len(g.Output) != 1 || g.Output[0] != "mail" || len(g.EnabledChannels) != 1 || !g.IgnoreBots {
+		t.Errorf("Profile not inherited: %+v", g)
+	}
+
+	g = c.FindGuild("override", "")
+	if len(g.Output) != 1 || g.Output[0] != "stdout" {
+		t.Error("Output not overridden: got", g.Output)
+	}
+	if len(g.EnabledChannels) != 0 || !g.IgnoreBots {
+		t.Errorf("Wrong override of profile: %+v", g)
+	}
+
+	g = c.FindGuild("chain", "")
+	if len(g.Output) != 1 || g.Output[0] != "mail" || len(g.DisabledUsers) != 1 {
+		t.Errorf("Profile chain not inherited: %+v", g)
+	}
+
+	if g = c.FindGuild("cycle", ""); len(g.Output) != 1 || g.Output[0] != "loop" {
+		t.Errorf("Wrong resolution of profile cycle: %+v", g)
+	}
+	if g = c.FindGuild("unknown", ""); len(g.Output) != 1 || g.Output[0] != "stdout" {
+		t.Errorf("Wrong resolution of unknown profile: %+v", g)
+	}
+
+	// Profiles must not be modified by resolution
+	if c.Profiles["ops"].Disable || len(c.Profiles["ops"].Output) != 1 {
+		t.Error("Profile modified by resolution")
+	}
+
+	msg := config.MessageMatcher{
+		Author:  discordgo.User{ID: "1234", Username: "Ethan Marshall"},
+		Guild:   discordgo.Guild{ID: "inherit", Name: "inherit"},
+		Channel: discordgo.Channel{ID: "#alerts", Name: "alerts"},
+	}
+	if !c.MessageMatches(msg) {
+		t.Error("Message in inherited enabled channel did not match")
+	}
+	msg.Author.Bot = true
+	if c.MessageMatches(msg) {
+		t.Error("Message ignored by inherited policy matched")
+	}
+
+	msg.Author.Bot = false
+	msg.Guild = discordgo.Guild{ID: "other", Name: "other"}
+	if c.MessageMatches(msg) {
+		t.Error("Message in disabled default guild matched")
+	}
+}
@@ -0,0 +1,671 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// ErrRuleSyntax is wrapped by all errors returned while compiling rules.
+var ErrRuleSyntax = errors.New("config: rule syntax error")
+
+// RuleError is a syntax or type error in the source of a rule.
+type RuleError struct {
+	// Source is the full source of the rule.
+	Source string
+	// Column is the column, counted in characters from one, at which the
+	// error was found.
+	Column int
+	// Msg describes the error.
+	Msg string
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("%s: %q: column %d: %s", ErrRuleSyntax.Error(), e.Source, e.Column, e.Msg)
+}
+
+func (e *RuleError) Unwrap() error {
+	return ErrRuleSyntax
+}
+
+// A Rule routes messages matching a condition to a list of outputs. Rules are
+// written in a small condition language, such as:
+//
+//	guild == "Ops" && (channel =~ "^incident-" || mentions_everyone) -> [mail, pager]
+//
+// The condition to the left of the arrow is made of comparisons between
+// fields of the message and literals, combined with "&&", "||", "!" and
+// parentheses. The right of the arrow is a list of output names, "*" for all
+// outputs or "[]" to drop the message.
+//
+// Fields are as follows:
+//   - guild, guild_id: the name and ID of the guild, empty for DMs
+//   - channel, channel_id: the name and ID of the channel or thread
+//   - parent: the name of the channel containing the thread, if any
+//   - category: the name of the channel category, if any
+//   - user, user_id: the username and ID of the author
+//   - global_name, nick: the global display name of the author and their
+//     nickname in the guild, if any
+//   - content: the formatted content of the message
+//   - attachments: the number of attachments
+//   - files: the filenames of each attachment
+//   - roles: the names and IDs of the author's roles
+//   - mentions: the usernames and IDs of mentioned users
+//   - mentions_everyone, reply, bot, webhook, dm, thread: true if the
+//     message mentions everyone, is a reply, was sent by a bot, was sent
+//     by a webhook, is a direct message or was sent in a thread
+//
+// Text is compared using "==" and "!=", "=~" and "!~" for regular expressions
+// and "contains" for substrings. Lists may be compared using "contains" for
+// membership and regular expressions, which match if any element does.
+// Numbers and booleans are compared using "==" and "!=", and numbers also using
+// "<", "<=", ">" and ">=". Boolean fields may also be used on their own as
+// conditions. Literals are double quoted strings, integers, true and false.
+type Rule struct {
+	source  string
+	cond    func(*MessageMatcher) bool
+	fields  map[string]bool
+	outputs []string
+	all     bool
+}
+
+// ParseRule compiles a rule from its source. Errors are of type *RuleError.
+func ParseRule(src string) (Rule, error) {
+	p := &ruleParser{src: src, fields: make(map[string]bool)}
+	if err := p.lex(); err != nil {
+		return Rule{}, err
+	}
+
+	r := Rule{source: src, fields: p.fields}
+	cond, err := p.or()
+	if err != nil {
+		return Rule{}, err
+	}
+	r.cond = cond
+
+	if _, err := p.expect(tokArrow); err != nil {
+		return Rule{}, err
+	}
+	if err := p.targets(&r); err != nil {
+		return Rule{}, err
+	}
+	if _, err := p.expect(tokEOF); err != nil {
+		return Rule{}, err
+	}
+
+	return r, nil
+}
+
+// String returns the source of r.
+func (r Rule) String() string {
+	return r.source
+}
+
+// Matches returns true if match meets the condition of r.
+func (r Rule) Matches(match MessageMatcher) bool {
+	return r.cond != nil && r.cond(&match)
+}
+
+// Outputs returns the names of the outputs to which r routes messages, where
+// no names means all outputs. If r drops messages, drop is true.
+func (r Rule) Outputs() (names []string, drop bool) {
+	return r.outputs, !r.all && len(r.outputs) == 0
+}
+
+// Uses returns true if the condition of r refers to the named field.
+func (r Rule) Uses(field string) bool {
+	return r.fields[field]
+}
+
+// MarshalJSON encodes r as its source.
+func (r Rule) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.source)
+}
+
+// UnmarshalJSON decodes and compiles a rule from its source.
+func (r *Rule) UnmarshalJSON(b []byte) error {
+	var src string
+	if err := json.Unmarshal(b, &src); err != nil {
+		return err
+	}
+
+	rule, err := ParseRule(src)
+	if err != nil {
+		return err
+	}
+	*r = rule
+	return nil
+}
+
+// Rule compiles src and appends it to the rules of the config.
+func (c *Config) Rule(src string) error {
+	r, err := ParseRule(src)
+	if err != nil {
+		return err
+	}
+
+	c.Rules = append(c.Rules, r)
+	return nil
+}
+
+// RulesUse returns true if any rule refers to the named field. Fields which
+// require extra lookups need only be resolved if used.
+func (c Config) RulesUse(field string) bool {
+	for _, r := range c.Rules {
+		if r.Uses(field) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Token kinds.
+const (
+	tokEOF = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokArrow
+	tokAnd
+	tokOr
+	tokNot
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+	tokComma
+	tokStar
+	tokOp
+)
+
+// tokenNames are descriptions of each token kind for error messages.
+var tokenNames = []string{
+	tokEOF:      "end of rule",
+	tokIdent:    "name",
+	tokString:   "string",
+	tokNumber:   "number",
+	tokArrow:    `"->"`,
+	tokAnd:      `"&&"`,
+	tokOr:       `"||"`,
+	tokNot:      `"!"`,
+	tokLParen:   `"("`,
+	tokRParen:   `")"`,
+	tokLBracket: `"["`,
+	tokRBracket: `"]"`,
+	tokComma:    `","`,
+	tokStar:     `"*"`,
+	tokOp:       "operator",
+}
+
+// Punctuation tokens, longest first.
+var punctuation = []struct {
+	text string
+	kind int
+}{
+	{"->", tokArrow}, {"&&", tokAnd}, {"||", tokOr},
+	{"==", tokOp}, {"!=", tokOp}, {"=~", tokOp}, {"!~", tokOp}, {"<=", tokOp}, {">=", tokOp},
+	{"<", tokOp}, {">", tokOp}, {"!", tokNot},
+	{"(", tokLParen}, {")", tokRParen}, {"[", tokLBracket}, {"]", tokRBracket},
+	{",", tokComma}, {"*", tokStar},
+}
+
+type token struct {
+	kind int
+	text string
+	col  int
+}
+
+// Types of values in conditions.
+const (
+	typeString = iota
+	typeNumber
+	typeBool
+	typeList
+)
+
+var typeNames = []string{
+	typeString: "text",
+	typeNumber: "number",
+	typeBool:   "boolean",
+	typeList:   "list",
+}
+
+// operand is a compiled field or literal. Exactly one of the functions is set,
+// according to typ.
+type operand struct {
+	typ     int
+	col     int
+	literal *token
+	str     func(*MessageMatcher) string
+	num     func(*MessageMatcher) int
+	boolean func(*MessageMatcher) bool
+	list    func(*MessageMatcher) []string
+}
+
+// ruleFields are the fields which may be used in conditions.
+var ruleFields = map[string]operand{
+	"guild":       {typ: typeString, str: func(m *MessageMatcher) string { return m.Guild.Name }},
+	"guild_id":    {typ: typeString, str: func(m *MessageMatcher) string { return m.Guild.ID }},
+	"channel":     {typ: typeString, str: func(m *MessageMatcher) string { return m.Channel.Name }},
+	"channel_id":  {typ: typeString, str: func(m *MessageMatcher) string { return m.Channel.ID }},
+	"parent":      {typ: typeString, str: func(m *MessageMatcher) string { return m.Parent.Name }},
+	"category":    {typ: typeString, str: func(m *MessageMatcher) string { return m.Category.Name }},
+	"user":        {typ: typeString, str: func(m *MessageMatcher) string { return m.Author.Username }},
+	"user_id":     {typ: typeString, str: func(m *MessageMatcher) string { return m.Author.ID }},
+	"global_name": {typ: typeString, str: func(m *MessageMatcher) string { return m.Author.GlobalName }},
+	"nick":        {typ: typeString, str: func(m *MessageMatcher) string { return m.Nick }},
+	"content":     {typ: typeString, str: func(m *MessageMatcher) string { return m.Content }},
+	"attachments": {typ: typeNumber, num: func(m *MessageMatcher) int { return len(m.Attachments) }},
+	"files":       {typ: typeList, list: func(m *MessageMatcher) []string { return m.Attachments }},
+	"roles": {typ: typeList, list: func(m *MessageMatcher) []string {
+		ret := make([]string, 0, 2*len(m.Roles))
+		for _, r := range m.Roles {
+			ret = append(ret, r.Name, r.ID)
+		}
+		return ret
+	}},
+	"mentions": {typ: typeList, list: func(m *MessageMatcher) []string {
+		ret := make([]string, 0, 2*len(m.Mentions))
+		for _, u := range m.Mentions {
+			ret = append(ret, u.Username, u.ID)
+		}
+		return ret
+	}},
+	"mentions_everyone": {typ: typeBool, boolean: func(m *MessageMatcher) bool { return m.MentionsEveryone }},
+	"reply":             {typ: typeBool, boolean: func(m *MessageMatcher) bool { return m.Type == discordgo.MessageTypeReply }},
+	"bot":               {typ: typeBool, boolean: func(m *MessageMatcher) bool { return m.Author.Bot && m.WebhookID == "" }},
+	"webhook":           {typ: typeBool, boolean: func(m *MessageMatcher) bool { return m.WebhookID != "" }},
+	"dm":                {typ: typeBool, boolean: func(m *MessageMatcher) bool { return m.Guild.ID == "" }},
+	"thread":            {typ: typeBool, boolean: func(m *MessageMatcher) bool { return m.Parent.ID != "" }},
+}
+
+// ruleParser compiles a rule by recursive descent.
+type ruleParser struct {
+	src    string
+	toks   []token
+	pos    int
+	fields map[string]bool
+}
+
+func (p *ruleParser) errorf(col int, format string, args ...interface{}) error {
+	return &RuleError{Source: p.src, Column: col, Msg: fmt.Sprintf(format, args...)}
+}
+
+// lex splits the source into tokens.
+func (p *ruleParser) lex() error {
+	i, col := 0, 1
+	for i < len(p.src) {
+		r, size := utf8.DecodeRuneInString(p.src[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+			col++
+			continue
+		case r == '"':
+			end := i + 1
+			for end < len(p.src) && p.src[end] != '"' {
+				if p.src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(p.src) {
+				return p.errorf(col, "unterminated string")
+			}
+			text, err := strconv.Unquote(p.src[i : end+1])
+			if err != nil {
+				return p.errorf(col, "invalid string: %s", err.Error())
+			}
+			p.toks = append(p.toks, token{tokString, text, col})
+			col += utf8.RuneCountInString(p.src[i : end+1])
+			i = end + 1
+			continue
+		case r >= '0' && r <= '9':
+			end := i
+			for end < len(p.src) && p.src[end] >= '0' && p.src[end] <= '9' {
+				end++
+			}
+			p.toks = append(p.toks, token{tokNumber, p.src[i:end], col})
+			col += end - i
+			i = end
+			continue
+		case r == '_' || unicode.IsLetter(r):
+			end := i
+			for end < len(p.src) {
+				r, size := utf8.DecodeRuneInString(p.src[end:])
+				if r != '_' && r != '-' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				if strings.HasPrefix(p.src[end:], "->") {
+					break
+				}
+				end += size
+			}
+			p.toks = append(p.toks, token{tokIdent, p.src[i:end], col})
+			col += utf8.RuneCountInString(p.src[i:end])
+			i = end
+			continue
+		}
+
+		found := false
+		for _, punct := range punctuation {
+			if strings.HasPrefix(p.src[i:], punct.text) {
+				p.toks = append(p.toks, token{punct.kind, punct.text, col})
+				i += len(punct.text)
+				col += len(punct.text)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return p.errorf(col, "unexpected character %q", r)
+		}
+	}
+
+	p.toks = append(p.toks, token{tokEOF, "", col})
+	return nil
+}
+
+func (p *ruleParser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *ruleParser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *ruleParser) expect(kind int) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, p.errorf(t.col, "expected %s, found %s", tokenNames[kind], describe(t))
+	}
+	return t, nil
+}
+
+// describe describes t for error messages.
+func describe(t token) string {
+	switch t.kind {
+	case tokEOF:
+		return tokenNames[tokEOF]
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return "\"" + t.text + "\""
+}
+
+// or parses a disjunction.
+func (p *ruleParser) or() (func(*MessageMatcher) bool, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == tokOr {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		left = func(m *MessageMatcher) bool { return l(m) || right(m) }
+	}
+
+	return left, nil
+}
+
+// and parses a conjunction.
+func (p *ruleParser) and() (func(*MessageMatcher) bool, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == tokAnd {
+		p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		left = func(m *MessageMatcher) bool { return l(m) && right(m) }
+	}
+
+	return left, nil
+}
+
+// unary parses a negation, parenthesised condition or comparison.
+func (p *ruleParser) unary() (func(*MessageMatcher) bool, error) {
+	switch p.peek().kind {
+	case tokNot:
+		p.next()
+		cond, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(m *MessageMatcher) bool { return !cond(m) }, nil
+	case tokLParen:
+		p.next()
+		cond, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRParen); err != nil {
+			return nil, err
+		}
+		return cond, nil
+	}
+
+	return p.comparison()
+}
+
+// operand parses a field or literal.
+func (p *ruleParser) operand() (operand, error) {
+	t := p.next()
+	switch t.kind {
+	case tokIdent:
+		switch t.text {
+		case "true", "false":
+			v := t.text == "true"
+			return operand{typ: typeBool, col: t.col, literal: &t, boolean: func(*MessageMatcher) bool { return v }}, nil
+		}
+
+		f, ok := ruleFields[t.text]
+		if !ok {
+			return operand{}, p.errorf(t.col, "unknown field %q", t.text)
+		}
+		p.fields[t.text] = true
+		f.col = t.col
+		return f, nil
+	case tokString:
+		v := t.text
+		return operand{typ: typeString, col: t.col, literal: &t, str: func(*MessageMatcher) string { return v }}, nil
+	case tokNumber:
+		v, err := strconv.Atoi(t.text)
+		if err != nil {
+			return operand{}, p.errorf(t.col, "invalid number %s", t.text)
+		}
+		return operand{typ: typeNumber, col: t.col, literal: &t, num: func(*MessageMatcher) int { return v }}, nil
+	}
+
+	return operand{}, p.errorf(t.col, "expected field or value, found %s", describe(t))
+}
+
+// comparison parses a comparison between two operands, or a single boolean
+// operand.
+func (p *ruleParser) comparison() (func(*MessageMatcher) bool, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.peek()
+	if op.kind != tokOp && !(op.kind == tokIdent && op.text == "contains") {
+		if left.typ != typeBool {
+			return nil, p.errorf(left.col, "%s used as condition", typeNames[left.typ])
+		}
+		return left.boolean, nil
+	}
+	p.next()
+
+	right, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.text {
+	case "==", "!=":
+		return p.equality(op, left, right)
+	case "=~", "!~":
+		return p.match(op, left, right)
+	case "<", "<=", ">", ">=":
+		return p.order(op, left, right)
+	case "contains":
+		return p.contains(op, left, right)
+	}
+
+	return nil, p.errorf(op.col, "unknown operator %s", op.text)
+}
+
+func (p *ruleParser) equality(op token, left, right operand) (func(*MessageMatcher) bool, error) {
+	if left.typ == typeList {
+		return nil, p.errorf(op.col, "cannot use %s with %s", op.text, typeNames[left.typ])
+	}
+	if left.typ != right.typ {
+		return nil, p.errorf(right.col, "cannot compare %s with %s", typeNames[left.typ], typeNames[right.typ])
+	}
+
+	var eq func(*MessageMatcher) bool
+	switch left.typ {
+	case typeString:
+		eq = func(m *MessageMatcher) bool { return left.str(m) == right.str(m) }
+	case typeNumber:
+		eq = func(m *MessageMatcher) bool { return left.num(m) == right.num(m) }
+	case typeBool:
+		eq = func(m *MessageMatcher) bool { return left.boolean(m) == right.boolean(m) }
+	default:
+		return nil, p.errorf(op.col, "cannot use %s with %s", op.text, typeNames[left.typ])
+	}
+
+	if op.text == "!=" {
+		return func(m *MessageMatcher) bool { return !eq(m) }, nil
+	}
+	return eq, nil
+}
+
+func (p *ruleParser) match(op token, left, right operand) (func(*MessageMatcher) bool, error) {
+	if right.literal == nil || right.typ != typeString {
+		return nil, p.errorf(right.col, "expected string literal as regular expression")
+	}
+	re, err := regexp.Compile(right.literal.text)
+	if err != nil {
+		return nil, p.errorf(right.col, "invalid regular expression: %s", err.Error())
+	}
+
+	var match func(*MessageMatcher) bool
+	switch left.typ {
+	case typeString:
+		match = func(m *MessageMatcher) bool { return re.MatchString(left.str(m)) }
+	case typeList:
+		match = func(m *MessageMatcher) bool {
+			for _, elem := range left.list(m) {
+				if re.MatchString(elem) {
+					return true
+				}
+			}
+			return false
+		}
+	default:
+		return nil, p.errorf(op.col, "cannot use %s with %s", op.text, typeNames[left.typ])
+	}
+
+	if op.text == "!~" {
+		return func(m *MessageMatcher) bool { return !match(m) }, nil
+	}
+	return match, nil
+}
+
+func (p *ruleParser) order(op token, left, right operand) (func(*MessageMatcher) bool, error) {
+	if left.typ != typeNumber || right.typ != typeNumber {
+		return nil, p.errorf(op.col, "cannot use %s with %s and %s", op.text, typeNames[left.typ], typeNames[right.typ])
+	}
+
+	switch op.text {
+	case "<":
+		return func(m *MessageMatcher) bool { return left.num(m) < right.num(m) }, nil
+	case "<=":
+		return func(m *MessageMatcher) bool { return left.num(m) <= right.num(m) }, nil
+	case ">":
+		return func(m *MessageMatcher) bool { return left.num(m) > right.num(m) }, nil
+	}
+	return func(m *MessageMatcher) bool { return left.num(m) >= right.num(m) }, nil
+}
+
+func (p *ruleParser) contains(op token, left, right operand) (func(*MessageMatcher) bool, error) {
+	if right.typ != typeString {
+		return nil, p.errorf(right.col, "expected text, found %s", typeNames[right.typ])
+	}
+
+	switch left.typ {
+	case typeString:
+		return func(m *MessageMatcher) bool { return strings.Contains(left.str(m), right.str(m)) }, nil
+	case typeList:
+		return func(m *MessageMatcher) bool {
+			v := right.str(m)
+			for _, elem := range left.list(m) {
+				if elem == v {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+
+	return nil, p.errorf(op.col, "cannot use contains with %s", typeNames[left.typ])
+}
+
+// targets parses the outputs of a rule.
+func (p *ruleParser) targets(r *Rule) error {
+	if p.peek().kind == tokStar {
+		p.next()
+		r.all = true
+		return nil
+	}
+
+	if _, err := p.expect(tokLBracket); err != nil {
+		return err
+	}
+	if p.peek().kind == tokRBracket {
+		p.next()
+		return nil
+	}
+
+	for {
+		t := p.next()
+		if t.kind != tokIdent && t.kind != tokString {
+			return p.errorf(t.col, "expected output name, found %s", describe(t))
+		}
+		r.outputs = append(r.outputs, t.text)
+
+		t = p.next()
+		if t.kind == tokRBracket {
+			return nil
+		}
+		if t.kind != tokComma {
+			return p.errorf(t.col, "expected %s or %s, found %s", tokenNames[tokComma], tokenNames[tokRBracket], describe(t))
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package config_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	config "github.com/ejv2/disdup/conf"
+)
+
+var ruleMessage = config.MessageMatcher{
+	Author:      discordgo.User{ID: "1234", Username: "Ethan Marshall", GlobalName: "Ethan"},
+	Nick:        "Boss",
+	Guild:       discordgo.Guild{ID: "g1", Name: "Ops"},
+	Channel:     discordgo.Channel{ID: "c1", Name: "incident-42"},
+	Content:     "the database is down",
+	Attachments: []string{"trace.log", "graph.png"},
+	Roles:       []discordgo.Role{{ID: "r1", Name: "Staff"}},
+	Mentions:    []discordgo.User{{ID: "4206", Username: "Jay Irwin"}},
+	Type:        discordgo.MessageTypeReply,
+}
+
+func TestRule_Matches(t *testing.T) {
+	cases := []struct {
+		Source string
+		Expect bool
+	}{
+		{`guild == "Ops" && (channel =~ "^incident-" || mentions_everyone) -> [mail, pager]`, true},
+		{`guild == "Ops" && channel =~ "^general$" -> *`, false},
+		{`guild != "Ops" -> *`, false},
+		{`!(guild != "Ops") -> *`, true},
+		{`mentions_everyone -> *`, false},
+		{`mentions_everyone || reply -> *`, true},
+		{`reply == true && bot == false -> *`, true},
+		{`content contains "database" -> *`, true},
+		{`content =~ "(?i)DATABASE" -> *`, true},
+		{`content !~ "database" -> *`, false},
+		{`attachments >= 2 && attachments < 3 -> *`, true},
+		{`attachments > 2 || attachments <= 1 || attachments != 2 -> *`, false},
+		{`attachments == 2 -> *`, true},
+		{`files =~ "\\.log$" -> *`, true},
+		{`files contains "graph.png" -> *`, true},
+		{`roles contains "Staff" && roles contains "r1" -> *`, true},
+		{`roles contains "Admin" -> *`, false},
+		{`mentions contains "Jay Irwin" || mentions contains "0" -> *`, true},
+		{`user_id == "1234" && user == "Ethan Marshall" -> *`, true},
+		{`global_name == "Ethan" && nick == "Boss" -> *`, true},
+		{`nick == "Ethan" -> *`, false},
+		{`dm || thread || webhook -> *`, false},
+		{`guild == "Ops" || dm && thread -> *`, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Source, func(t *testing.T) {
+			r, err := config.ParseRule(c.Source)
+			if err != nil {
+				t.Fatal("Unexpected parse error:", err)
+			}
+
+			if got := r.Matches(ruleMessage); got != c.Expect {
+				t.Errorf("expected %v, got %v", c.Expect, got)
+			}
+		})
+	}
+}
+
+func TestRule_Outputs(t *testing.T) {
+	cases := []struct {
+		Source string
+		Expect []string
+		Drop   bool
+	}{
+		{`dm -> [mail, "pager-2", alerts-3]`, []string{"mail", "pager-2", "alerts-3"}, false},
+		{`dm -> *`, nil, false},
+		{`dm -> []`, nil, true},
+		{`dm->[a]`, []string{"a"}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Source, func(t *testing.T) {
+			r, err := config.ParseRule(c.Source)
+			if err != nil {
+				t.Fatal("Unexpected parse error:", err)
+			}
+
+			outs, drop := r.Outputs()
+			if drop != c.Drop || len(outs) != len(c.Expect) {
+				t.Fatalf("expected %v (drop %v), got %v (drop %v)", c.Expect, c.Drop, outs, drop)
+			}
+			for i := range outs {
+				if outs[i] != c.Expect[i] {
+					t.Fatalf("expected %v, got %v", c.Expect, outs)
+				}
+			}
+		})
+	}
+}
+
+func TestRule_Errors(t *testing.T) {
+	cases := []struct {
+		Source string
+		Column int
+	}{
+		{`guild == "Ops"`, 15},
+		{`guild == "Ops -> *`, 10},
+		{`guild = "Ops" -> *`, 7},
+		{`guild == "Ops" && -> *`, 19},
+		{`(guild == "Ops" -> *`, 17},
+		{`nosuchfield -> *`, 1},
+		{`guild -> *`, 1},
+		{`guild == 3 -> *`, 10},
+		{`attachments > "3" -> *`, 13},
+		{`content =~ "(" -> *`, 12},
+		{`content =~ channel -> *`, 12},
+		{`roles == "Staff" -> *`, 7},
+		{`dm -> [mail pager]`, 13},
+		{`dm -> [mail,]`, 13},
+		{`dm -> * extra`, 9},
+		{`dm -> mail`, 7},
+		{`dm $ -> *`, 4},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Source, func(t *testing.T) {
+			_, err := config.ParseRule(c.Source)
+			if err == nil {
+				t.Fatal("Expected error")
+			}
+			if !errors.Is(err, config.ErrRuleSyntax) {
+				t.Error("Error does not wrap ErrRuleSyntax:", err)
+			}
+
+			var rerr *config.RuleError
+			if !errors.As(err, &rerr) {
+				t.Fatal("Error is not a RuleError:", err)
+			}
+			if rerr.Column != c.Column {
+				t.Errorf("Wrong column for error %q: expected %d, got %d", err, c.Column, rerr.Column)
+			}
+		})
+	}
+}
+
+func TestRule_JSON(t *testing.T) {
+	var c config.Config
+	err := json.Unmarshal([]byte(`{"rules": ["guild == \"Ops\" -> [mail]", "dm -> []"]}`), &c)
+	if err != nil {
+		t.Fatal("Unexpected unmarshal error:", err)
+	}
+	if len(c.Rules) != 2 || !c.Rules[0].Matches(ruleMessage) {
+		t.Error("Rules not decoded")
+	}
+
+	buf, err := json.Marshal(c.Rules)
+	if err != nil {
+		t.Fatal("Unexpected marshal error:", err)
+	}
+	var src []string
+	if err := json.Unmarshal(buf, &src); err != nil || len(src) != 2 || src[0] != `guild == "Ops" -> [mail]` {
+		t.Error("Wrong encoding of rules:", string(buf))
+	}
+
+	err = json.Unmarshal([]byte(`{"rules": ["guild == -> [mail]"]}`), &c)
+	if !errors.Is(err, config.ErrRuleSyntax) {
+		t.Error("Expected syntax error, got", err)
+	}
+}
+
+func TestRoute(t *testing.T) {
+	c := config.Config{Guilds: map[string]*config.GuildConfig{
+		"Ops": {Output: []string{"stdout"}, DisabledUsers: []string{"spammer"}},
+	}}
+	for _, src := range []string{
+		`channel =~ "^incident-" -> [pager]`,
+		`user == "spammer" -> [quarantine]`,
+		`content contains "ignore me" -> []`,
+	} {
+		if err := c.Rule(src); err != nil {
+			t.Fatal("Unexpected rule error:", err)
+		}
+	}
+
+	if outs, ok := c.Route(ruleMessage); !ok || len(outs) != 1 || outs[0] != "pager" {
+		t.Error("First matching rule did not route message: got", outs, ok)
+	}
+
+	msg := ruleMessage
+	msg.Channel = discordgo.Channel{ID: "c2", Name: "general"}
+	if outs, ok := c.Route(msg); !ok || len(outs) != 1 || outs[0] != "stdout" {
+		t.Error("Message matching no rule not routed by guild: got", outs, ok)
+	}
+
+	msg.Author.Username = "spammer"
+	if outs, ok := c.Route(msg); !ok || len(outs) != 1 || outs[0] != "quarantine" {
+		t.Error("Rule did not take precedence over guild: got", outs, ok)
+	}
+
+	msg.Author.Username = "Ethan Marshall"
+	msg.Content = "please ignore me"
+	if _, ok := c.Route(msg); ok {
+		t.Error("Message dropped by rule was routed")
+	}
+
+	if c.UsesRoles() {
+		t.Error("Config uses roles without rules using roles")
+	}
+	c.Rule(`roles contains "Staff" -> *`)
+	if !c.UsesRoles() {
+		t.Error("UsesRoles does not account for rules")
+	}
+}
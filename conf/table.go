@@ -0,0 +1,767 @@
+package config
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Table is a precompiled, immutable form of a Config, used to route messages
+// without repeating the work of interpreting the config for every message.
+// Lists of names and IDs become sets, profiles are applied, patterns are
+// compiled and output names are resolved to indices into Config.Outputs.
+//
+// Config.Route and the other matching methods of Config compile a Table to do
+// their work, so always agree with it. Table.Route differs only in returning
+// outputs as indices, discarding output names which do not exist. It is safe
+// for concurrent use.
+type Table struct {
+	conf Config
+	// Indices of every output
+	all    []int
+	rules  []compiledRule
+	guilds map[string]*compiledGuild
+	def    *compiledGuild
+	dm     compiledDM
+	// Outputs left unresolved, as only their names are used
+	named bool
+
+	// Details which rules need resolved for every message
+	ruleNeeds Lookups
+}
+
+// Lookups are the details of a message which need extra lookups to resolve,
+// and so need only be set in a MessageMatcher if used by the config.
+type Lookups struct {
+	// Roles is true if MessageMatcher.Roles is used.
+	Roles bool
+	// Category is true if MessageMatcher.Category is used.
+	Category bool
+	// Nick is true if MessageMatcher.Nick is used.
+	Nick bool
+}
+
+// set is a set of names and IDs.
+type set map[string]struct{}
+
+// newSet returns the set of elements of lists, or nil if there are none.
+func newSet(lists ...[]string) set {
+	var s set
+	for _, list := range lists {
+		for _, elem := range list {
+			if s == nil {
+				s = make(set)
+			}
+			s[elem] = struct{}{}
+		}
+	}
+
+	return s
+}
+
+// has returns true if any of keys are in s.
+func (s set) has(keys ...string) bool {
+	for _, k := range keys {
+		if _, ok := s[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// channel returns true if the channel of match, or its parent, is in s.
+func (s set) channel(match *MessageMatcher) bool {
+	if s.has(match.Channel.ID, match.Channel.Name) {
+		return true
+	}
+	return match.Parent.ID != "" && s.has(match.Parent.ID, match.Parent.Name)
+}
+
+// category returns true if the category of match is in s.
+func (s set) category(match *MessageMatcher) bool {
+	return match.Category.ID != "" && s.has(match.Category.ID, match.Category.Name)
+}
+
+// userSet is a set of users, split by the names which each entry matches.
+type userSet struct {
+	// Entries without a prefix, matching IDs and usernames
+	plain                     set
+	usernames, globals, nicks set
+}
+
+// newUserSet returns the set of users listed in users, or nil if there are
+// none.
+func newUserSet(users []string) *userSet {
+	if len(users) == 0 {
+		return nil
+	}
+
+	s := &userSet{}
+	for _, elem := range users {
+		dest := &s.plain
+		if name, ok := strings.CutPrefix(elem, UserPrefixUsername); ok {
+			elem, dest = name, &s.usernames
+		} else if name, ok := strings.CutPrefix(elem, UserPrefixGlobalName); ok {
+			elem, dest = name, &s.globals
+		} else if name, ok := strings.CutPrefix(elem, UserPrefixNick); ok {
+			elem, dest = name, &s.nicks
+		}
+		// Prefixed names which are empty never match
+		if elem == "" && dest != &s.plain {
+			continue
+		}
+
+		if *dest == nil {
+			*dest = make(set)
+		}
+		(*dest)[elem] = struct{}{}
+	}
+	return s
+}
+
+// user returns true if the author of match is in s.
+func (s *userSet) user(match *MessageMatcher) bool {
+	if s == nil {
+		return false
+	}
+	return s.plain.has(match.Author.ID, match.Author.Username) ||
+		s.usernames.has(match.Author.Username) ||
+		(match.Author.GlobalName != "" && s.globals.has(match.Author.GlobalName)) ||
+		(match.Nick != "" && s.nicks.has(match.Nick))
+}
+
+// roles returns true if any role of the author of match is in s.
+func (s set) roles(match *MessageMatcher) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, r := range match.Roles {
+		if s.has(r.ID, r.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// compiledFilter is a ContentFilter with its patterns compiled. Patterns which
+// fail to compile are omitted, as they never match.
+type compiledFilter struct {
+	include, exclude     []*regexp.Regexp
+	includeKW, excludeKW []string
+	ignoreCase           bool
+	// Whether the filter had any includes, even if invalid
+	hasInclude bool
+}
+
+// compileFilter compiles f, returning nil if f is empty.
+func compileFilter(f ContentFilter) *compiledFilter {
+	if f.Empty() {
+		return nil
+	}
+
+	cf := &compiledFilter{
+		ignoreCase: f.IgnoreCase,
+		hasInclude: len(f.Include) > 0 || len(f.IncludeKeywords) > 0,
+	}
+	compile := func(patterns []string) []*regexp.Regexp {
+		var ret []*regexp.Regexp
+		for _, p := range patterns {
+			if re, err := compilePattern(p, f.IgnoreCase); err == nil {
+				ret = append(ret, re)
+			}
+		}
+		return ret
+	}
+	keywords := func(kws []string) []string {
+		ret := make([]string, len(kws))
+		for i, kw := range kws {
+			if f.IgnoreCase {
+				kw = strings.ToLower(kw)
+			}
+			ret[i] = kw
+		}
+		return ret
+	}
+	cf.include, cf.exclude = compile(f.Include), compile(f.Exclude)
+	cf.includeKW, cf.excludeKW = keywords(f.IncludeKeywords), keywords(f.ExcludeKeywords)
+
+	return cf
+}
+
+// passes implements ContentFilter.Passes. A nil filter passes everything.
+func (f *compiledFilter) passes(match *MessageMatcher) bool {
+	if f == nil {
+		return true
+	}
+
+	content := match.Content
+	attachments := match.Attachments
+	if f.ignoreCase && len(f.includeKW)+len(f.excludeKW) > 0 {
+		content = strings.ToLower(content)
+		lower := make([]string, len(attachments))
+		for i, a := range attachments {
+			lower[i] = strings.ToLower(a)
+		}
+		attachments = lower
+	}
+
+	if f.matches(f.exclude, f.excludeKW, match.Content, match.Attachments, content, attachments) {
+		return false
+	}
+	if !f.hasInclude {
+		return true
+	}
+	return f.matches(f.include, f.includeKW, match.Content, match.Attachments, content, attachments)
+}
+
+// matches returns true if any of patterns match text or atts, or any of
+// keywords are contained in kwText or kwAtts.
+func (f *compiledFilter) matches(patterns []*regexp.Regexp, keywords []string, text string, atts []string, kwText string, kwAtts []string) bool {
+	for _, re := range patterns {
+		if re.MatchString(text) {
+			return true
+		}
+		for _, a := range atts {
+			if re.MatchString(a) {
+				return true
+			}
+		}
+	}
+
+	for _, kw := range keywords {
+		if strings.Contains(kwText, kw) {
+			return true
+		}
+		for _, a := range kwAtts {
+			if strings.Contains(a, kw) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// outputSet is a set of outputs resolved to indices, in ascending order.
+type outputSet struct {
+	all  bool
+	outs []int
+}
+
+// compiledRule is an OutputRule with its outputs resolved.
+type compiledRule struct {
+	rule Rule
+	outputSet
+	drop bool
+}
+
+// compiledOutputRule is an OutputRule with its outputs resolved.
+type compiledOutputRule struct {
+	src      OutputRule
+	outs     []int
+	override bool
+}
+
+// compiledChannel is a ChannelConfig or UserConfig with its filter compiled
+// and outputs resolved.
+type compiledChannel struct {
+	filter *compiledFilter
+	rule   *compiledOutputRule
+}
+
+// compiledGuild is a GuildConfig with its profile applied and lists compiled
+// into sets.
+type compiledGuild struct {
+	// Key in Config.Guilds and profile inherited, for explanations
+	key, profile string
+
+	disable bool
+	policy  AuthorPolicy
+
+	// Channel and user allow lists
+	allowChannels bool
+	channels      set
+	categories    set
+	allowUsers    bool
+	users         *userSet
+	roles         set
+	// Blocklists
+	noChannels   set
+	noCategories set
+	noUsers      *userSet
+	noRoles      set
+
+	filter       *compiledFilter
+	channelConfs map[string]*compiledChannel
+	// User configuration by ID or username, then by prefixed name
+	userConfs                         map[string]*compiledChannel
+	userNames, userNicks, userGlobals map[string]*compiledChannel
+	outputSet
+	// Output names as given
+	output []string
+
+	needs Lookups
+}
+
+// compiledDM is a DMConfig with its lists compiled.
+type compiledDM struct {
+	enable bool
+	policy AuthorPolicy
+	users  *userSet
+	outputSet
+}
+
+// Compile precompiles c into a routing table. The config must not be modified
+// while the table is in use.
+func (c Config) Compile() *Table {
+	return c.compile(c.Guilds, false)
+}
+
+// compileFor compiles only the parts of c needed to route match by name, for
+// the matching methods of Config.
+func (c Config) compileFor(match *MessageMatcher) *Table {
+	var guilds map[string]*GuildConfig
+	if match.Guild.ID != "" {
+		for _, key := range []string{match.Guild.ID, match.Guild.Name, DefaultGuild} {
+			if g, ok := c.Guilds[key]; ok {
+				guilds = map[string]*GuildConfig{key: g}
+				break
+			}
+		}
+	}
+	return c.compile(guilds, true)
+}
+
+// compile implements Compile, compiling only the given guild entries. If
+// named is set, outputs are not resolved to indices.
+func (c Config) compile(guilds map[string]*GuildConfig, named bool) *Table {
+	t := &Table{
+		conf:   c,
+		guilds: make(map[string]*compiledGuild, len(guilds)),
+		named:  named,
+
+		ruleNeeds: Lookups{
+			Roles:    c.RulesUse("roles"),
+			Category: c.RulesUse("category"),
+			Nick:     c.RulesUse("nick"),
+		},
+	}
+	if !named {
+		for i := range c.Outputs {
+			t.all = append(t.all, i)
+		}
+	}
+
+	for _, r := range c.Rules {
+		names, drop := r.Outputs()
+		t.rules = append(t.rules, compiledRule{rule: r, outputSet: t.resolve(names), drop: drop})
+	}
+	for key, g := range guilds {
+		cg := t.compileGuild(c.resolve(g))
+		cg.key, cg.profile = key, g.Profile
+		if key == DefaultGuild {
+			t.def = cg
+		}
+		t.guilds[key] = cg
+	}
+	t.dm = compiledDM{
+		enable:    c.DirectMessages.Enable,
+		policy:    c.DirectMessages.AuthorPolicy,
+		users:     newUserSet(c.DirectMessages.EnabledUsers),
+		outputSet: t.resolve(c.DirectMessages.Output),
+	}
+
+	return t
+}
+
+// resolve resolves the output names in names to indices, where no names means
+// all outputs. Unknown names are discarded.
+func (t *Table) resolve(names []string) outputSet {
+	if t.named {
+		return outputSet{}
+	}
+	if len(names) == 0 {
+		return outputSet{all: true, outs: t.all}
+	}
+
+	want := newSet(names)
+	ret := outputSet{outs: []int{}}
+	for i, out := range t.conf.Outputs {
+		if want.has(out.Name) {
+			ret.outs = append(ret.outs, i)
+		}
+	}
+	return ret
+}
+
+// compileOutputRule resolves the outputs of r, returning nil if r has no
+// effect.
+func (t *Table) compileOutputRule(r OutputRule) *compiledOutputRule {
+	if len(r.Output) == 0 {
+		return nil
+	}
+	return &compiledOutputRule{src: r, outs: t.resolve(r.Output).outs, override: r.OverrideOutput}
+}
+
+func (t *Table) compileGuild(g *GuildConfig) *compiledGuild {
+	cg := &compiledGuild{
+		disable: g.Disable,
+		policy:  g.AuthorPolicy,
+
+		allowChannels: len(g.EnabledChannels) > 0 || len(g.EnabledCategories) > 0,
+		channels:      newSet(g.EnabledChannels),
+		categories:    newSet(g.EnabledCategories),
+		allowUsers:    len(g.EnabledUsers) > 0 || len(g.EnabledRoles) > 0,
+		users:         newUserSet(g.EnabledUsers),
+		roles:         newSet(g.EnabledRoles),
+		noChannels:    newSet(g.DisabledChannels),
+		noCategories:  newSet(g.DisabledCategories),
+		noUsers:       newUserSet(g.DisabledUsers),
+		noRoles:       newSet(g.DisabledRoles),
+
+		filter:    compileFilter(g.Filter),
+		outputSet: t.resolve(g.Output),
+		output:    g.Output,
+
+		needs: Lookups{
+			Roles:    g.UsesRoles(),
+			Category: g.UsesCategories(),
+			Nick:     g.UsesNicknames(),
+		},
+	}
+
+	if len(g.Channels) > 0 {
+		cg.channelConfs = make(map[string]*compiledChannel, len(g.Channels))
+		for key, ch := range g.Channels {
+			cg.channelConfs[key] = &compiledChannel{
+				filter: compileFilter(ch.Filter),
+				rule:   t.compileOutputRule(ch.OutputRule),
+			}
+		}
+	}
+	for key, u := range g.Users {
+		dest := &cg.userConfs
+		if name, ok := strings.CutPrefix(key, UserPrefixUsername); ok {
+			key, dest = name, &cg.userNames
+		} else if name, ok := strings.CutPrefix(key, UserPrefixGlobalName); ok {
+			key, dest = name, &cg.userGlobals
+		} else if name, ok := strings.CutPrefix(key, UserPrefixNick); ok {
+			key, dest = name, &cg.userNicks
+		}
+
+		if *dest == nil {
+			*dest = make(map[string]*compiledChannel)
+		}
+		(*dest)[key] = &compiledChannel{rule: t.compileOutputRule(u.OutputRule)}
+	}
+
+	return cg
+}
+
+// Config returns the config from which t was compiled.
+func (t *Table) Config() Config {
+	return t.conf
+}
+
+// guild returns the compiled configuration for a guild, or nil if none.
+func (t *Table) guild(id, name string) *compiledGuild {
+	if g, ok := t.guilds[id]; ok {
+		return g
+	}
+	if g, ok := t.guilds[name]; ok {
+		return g
+	}
+	return t.def
+}
+
+// Routes returns false if no message from the guild with the given ID and name
+// can be duplicated, as no rule duplicates messages and the guild has no entry
+// in Config.Guilds, even by default, or is disabled.
+func (t *Table) Routes(guildID, guildName string) bool {
+	for i := range t.rules {
+		if !t.rules[i].drop {
+			return true
+		}
+	}
+
+	g := t.guild(guildID, guildName)
+	return g != nil && !g.disable
+}
+
+// Needs returns the details which must be resolved to route a message from the
+// guild with the given ID and name.
+func (t *Table) Needs(guildID, guildName string) Lookups {
+	ret := t.ruleNeeds
+	if guildID == "" {
+		return ret
+	}
+	if g := t.guild(guildID, guildName); g != nil {
+		ret.Roles = ret.Roles || g.needs.Roles
+		ret.Category = ret.Category || g.needs.Category
+		ret.Nick = ret.Nick || g.needs.Nick
+	}
+	return ret
+}
+
+// Route decides whether a message is to be duplicated and to which outputs,
+// in the same way as Config.Route. Outputs are returned as indices into
+// Config.Outputs, in ascending order, and must not be modified.
+func (t *Table) Route(match MessageMatcher) ([]int, bool) {
+	set, ok := t.route(&match, nil)
+	return set.outs, ok
+}
+
+// Matches returns true if a message matches the guild or direct message
+// configuration, in the same way as Config.MessageMatches. Rules are not
+// checked; for that, see Route.
+func (t *Table) Matches(match MessageMatcher) bool {
+	_, ok := t.matches(&match, nil)
+	return ok
+}
+
+// Outputs returns the outputs to which a message should be written by the
+// guild or direct message configuration, in the same way as
+// Config.MessageOutputs. Outputs are returned as indices into Config.Outputs,
+// in ascending order, and must not be modified. It does not check if the
+// message matches; for that, see Matches.
+func (t *Table) Outputs(match MessageMatcher) []int {
+	if match.Guild.ID == "" {
+		return t.dm.outs
+	}
+
+	g := t.guild(match.Guild.ID, match.Guild.Name)
+	if g == nil {
+		return nil
+	}
+	return g.route(&match).outs
+}
+
+// Explain routes a message in the same way as Route, returning a trace of the
+// checks made and the outcome. Unlike Config.Explain, the outputs given are
+// those which the message is actually written to.
+func (t *Table) Explain(match MessageMatcher) Explanation {
+	var e Explanation
+	set, ok := t.route(&match, &e)
+	if e.Matched = ok; ok && !set.all {
+		e.Outputs = make([]string, len(set.outs))
+		for i, out := range set.outs {
+			e.Outputs[i] = t.conf.Outputs[out].Name
+		}
+	}
+	return e
+}
+
+// route implements Route, recording each check made in e if not nil.
+func (t *Table) route(match *MessageMatcher, e *Explanation) (outputSet, bool) {
+	r, g, ok := t.decide(match, e)
+	switch {
+	case !ok:
+		return outputSet{}, false
+	case r != nil:
+		return r.outputSet, true
+	case g == nil:
+		return t.dm.outputSet, true
+	}
+	return g.route(match), true
+}
+
+// routeNames is like route, but returns the names of the outputs as given in
+// the config, including any which do not exist.
+func (t *Table) routeNames(match *MessageMatcher, e *Explanation) ([]string, bool) {
+	r, g, ok := t.decide(match, e)
+	switch {
+	case !ok:
+		return nil, false
+	case r != nil:
+		outs, _ := r.rule.Outputs()
+		return outs, true
+	case g == nil:
+		return t.conf.DirectMessages.Output, true
+	}
+	return g.routeNames(match), true
+}
+
+// decide checks match against the rules, then the guild or direct message
+// configuration, recording each check made in e if not nil. If the message is
+// to be duplicated, the rule which decided so is returned, if any, else the
+// guild configuration matched, which is nil for direct messages.
+func (t *Table) decide(match *MessageMatcher, e *Explanation) (*compiledRule, *compiledGuild, bool) {
+	for i := range t.rules {
+		r := &t.rules[i]
+		ok := r.rule.Matches(*match)
+		if e != nil {
+			e.check("rule "+strconv.Itoa(i+1)+" matches", ok)
+		}
+		if ok {
+			if e != nil {
+				e.Rule = r.rule.String()
+			}
+			return r, nil, !r.drop
+		}
+	}
+
+	g, ok := t.matches(match, e)
+	return nil, g, ok
+}
+
+// matches implements Config.MessageMatches, returning the guild configuration
+// used, if any, and recording each check made in e if not nil.
+func (t *Table) matches(match *MessageMatcher, e *Explanation) (*compiledGuild, bool) {
+	if match.Guild.ID == "" {
+		dm := &t.dm
+		return nil, e.check("direct messages enabled", dm.enable) &&
+			e.check("author not ignored", !dm.policy.Ignores(*match)) &&
+			e.check("user enabled", dm.users == nil || dm.users.user(match))
+	}
+
+	g := t.guild(match.Guild.ID, match.Guild.Name)
+	if e != nil && g != nil {
+		e.Guild, e.Profile = g.key, g.profile
+	}
+	if !e.check("guild configured", g != nil) {
+		return nil, false
+	}
+	return g, g.matches(match, e)
+}
+
+// findChannel returns the configuration for the channel of match, falling back
+// to that of its parent.
+func (g *compiledGuild) findChannel(match *MessageMatcher) *compiledChannel {
+	for _, key := range [...]string{match.Channel.ID, match.Channel.Name} {
+		if ch, ok := g.channelConfs[key]; ok {
+			return ch
+		}
+	}
+	if match.Parent.ID != "" {
+		for _, key := range [...]string{match.Parent.ID, match.Parent.Name} {
+			if ch, ok := g.channelConfs[key]; ok {
+				return ch
+			}
+		}
+	}
+	return nil
+}
+
+// findUser returns the configuration for the author of match. Entries for the
+// ID and username are checked in the same order as GuildConfig.FindUser, then
+// those for the nickname and global name, which FindUser does not match.
+func (g *compiledGuild) findUser(match *MessageMatcher) *compiledChannel {
+	for _, key := range [...]string{match.Author.ID, match.Author.Username} {
+		if u, ok := g.userConfs[key]; ok {
+			return u
+		}
+	}
+	if u, ok := g.userNames[match.Author.Username]; ok {
+		return u
+	}
+	if u, ok := g.userNicks[match.Nick]; ok && match.Nick != "" {
+		return u
+	}
+	if u, ok := g.userGlobals[match.Author.GlobalName]; ok && match.Author.GlobalName != "" {
+		return u
+	}
+	return nil
+}
+
+// matches implements Config.MessageMatches for a guild, recording each check
+// made in e if not nil.
+func (g *compiledGuild) matches(match *MessageMatcher, e *Explanation) bool {
+	if !e.check("guild not disabled", !g.disable) ||
+		!e.check("author not ignored", !g.policy.Ignores(*match)) {
+		return false
+	}
+
+	// Blocklists
+	if !e.check("channel not disabled", !g.noChannels.channel(match)) ||
+		!e.check("category not disabled", !g.noCategories.category(match)) ||
+		!e.check("user not disabled", !g.noUsers.user(match)) ||
+		!e.check("roles not disabled", !g.noRoles.roles(match)) {
+		return false
+	}
+
+	// Allow lists
+	if g.allowChannels && !e.check("channel enabled", g.channels.channel(match) || g.categories.category(match)) {
+		return false
+	}
+	if g.allowUsers && !e.check("user enabled", g.users.user(match) || g.roles.roles(match)) {
+		return false
+	}
+
+	// Content
+	if g.filter != nil && !e.check("guild filter", g.filter.passes(match)) {
+		return false
+	}
+	if g.channelConfs != nil {
+		if ch := g.findChannel(match); ch != nil && ch.filter != nil && !e.check("channel filter", ch.filter.passes(match)) {
+			return false
+		}
+	}
+	return true
+}
+
+// rules returns the output rules of the channel and author of match, either
+// of which may be nil.
+func (g *compiledGuild) rules(match *MessageMatcher) (ch, user *compiledOutputRule) {
+	if g.channelConfs != nil {
+		if c := g.findChannel(match); c != nil {
+			ch = c.rule
+		}
+	}
+	if len(g.userConfs)+len(g.userNames)+len(g.userNicks)+len(g.userGlobals) > 0 {
+		if u := g.findUser(match); u != nil {
+			user = u.rule
+		}
+	}
+	return ch, user
+}
+
+// route implements Config.MessageOutputs for a guild, resolving outputs to
+// indices.
+func (g *compiledGuild) route(match *MessageMatcher) outputSet {
+	ch, user := g.rules(match)
+	return user.apply(ch.apply(g.outputSet))
+}
+
+// routeNames implements Config.MessageOutputs for a guild.
+func (g *compiledGuild) routeNames(match *MessageMatcher) []string {
+	outs := g.output
+	ch, user := g.rules(match)
+	for _, r := range [...]*compiledOutputRule{ch, user} {
+		if r != nil {
+			outs = r.src.apply(outs)
+		}
+	}
+	return outs
+}
+
+// apply implements OutputRule.apply for resolved outputs. A nil rule has no
+// effect.
+func (r *compiledOutputRule) apply(set outputSet) outputSet {
+	switch {
+	case r == nil:
+		return set
+	case r.override:
+		return outputSet{outs: r.outs}
+	case set.all:
+		return set
+	}
+
+	// Merge ascending lists
+	ret := outputSet{outs: make([]int, 0, len(set.outs)+len(r.outs))}
+	i, j := 0, 0
+	for i < len(set.outs) || j < len(r.outs) {
+		switch {
+		case j >= len(r.outs) || (i < len(set.outs) && set.outs[i] < r.outs[j]):
+			ret.outs = append(ret.outs, set.outs[i])
+			i++
+		case i >= len(set.outs) || r.outs[j] < set.outs[i]:
+			ret.outs = append(ret.outs, r.outs[j])
+			j++
+		default:
+			ret.outs = append(ret.outs, set.outs[i])
+			i++
+			j++
+		}
+	}
+	return ret
+}
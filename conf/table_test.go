@@ -0,0 +1,380 @@
+package config_test
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	config "github.com/ejv2/disdup/conf"
+)
+
+// tableConfig returns a config exercising every routing option, with outputs
+// named a to e.
+func tableConfig(t testing.TB) config.Config {
+	c := config.Config{
+		Guilds: map[string]*config.GuildConfig{
+			"a": {
+				Output:        []string{"a", "nosuchoutput"},
+				DisabledUsers: []string{"Cole Phelps", "global_name:Spammer", "nick:"},
+				Channels: map[string]*config.ChannelConfig{
+					"alerts": {OutputRule: config.OutputRule{Output: []string{"c", "b"}}},
+					"secret": {
+						Filter:     config.ContentFilter{ExcludeKeywords: []string{"PASSWORD"}, IgnoreCase: true},
+						OutputRule: config.OutputRule{Output: []string{"e"}, OverrideOutput: true},
+					},
+				},
+				Users: map[string]*config.UserConfig{
+					"4206":               {OutputRule: config.OutputRule{Output: []string{"d", "a"}}},
+					"nick:Boss":          {OutputRule: config.OutputRule{Output: []string{"e"}, OverrideOutput: true}},
+					"global_name:Ethan":  {OutputRule: config.OutputRule{Output: []string{"c"}}},
+					"username:Jay Irwin": {OutputRule: config.OutputRule{Output: []string{"b"}}},
+				},
+			},
+			"b": {
+				Profile:           "staff",
+				EnabledCategories: []string{"Support"},
+				EnabledChannels:   []string{"#general"},
+				EnabledUsers:      []string{"nick:Boss", "username:bot"},
+			},
+			"c": {Disable: true},
+			"Typo": {
+				Output: []string{"nosuchoutput"},
+				Filter: config.ContentFilter{Include: []string{"("}},
+			},
+			config.DefaultGuild: {
+				AuthorPolicy: config.AuthorPolicy{IgnoreBots: true, IgnoreSystemMessages: true},
+				Filter:       config.ContentFilter{Include: []string{`^\d+$`}, IncludeKeywords: []string{"log"}},
+				Users: map[string]*config.UserConfig{
+					"Ethan Marshall": {OutputRule: config.OutputRule{Output: []string{"b"}}},
+				},
+			},
+		},
+		Profiles: map[string]*config.GuildConfig{
+			"staff": {
+				EnabledRoles:  []string{"Staff"},
+				DisabledRoles: []string{"r-muted"},
+				Output:        []string{"b", "c"},
+			},
+		},
+		DirectMessages: config.DMConfig{
+			Enable:       true,
+			EnabledUsers: []string{"1234", "Jay Irwin"},
+			Output:       []string{"d"},
+		},
+	}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		c.Outputs = append(c.Outputs, config.OutputConfig{Name: name})
+	}
+	for _, src := range []string{
+		`content contains "drop me" -> []`,
+		`channel == "incident" && guild == "b" -> [e, a]`,
+		`mentions_everyone -> *`,
+	} {
+		if err := c.Rule(src); err != nil {
+			t.Fatal("Unexpected rule error:", err)
+		}
+	}
+
+	return c
+}
+
+// tableMessages returns every combination of a set of authors, guilds,
+// channels and contents.
+func tableMessages() []config.MessageMatcher {
+	authors := []discordgo.User{
+		{ID: "1234", Username: "Ethan Marshall", GlobalName: "Ethan"},
+		{ID: "1247", Username: "Cole Phelps"},
+		{ID: "4206", Username: "Jay Irwin", GlobalName: "Spammer"},
+		{ID: "9999", Username: "bot", Bot: true},
+	}
+	nicks := []string{"", "Boss"}
+	guilds := []discordgo.Guild{
+		{}, {ID: "a", Name: "a"}, {ID: "b", Name: "b"}, {ID: "c", Name: "c"},
+		{ID: "g4", Name: "Typo"}, {ID: "g5", Name: "Unknown"},
+	}
+	type place struct{ channel, parent, category discordgo.Channel }
+	places := []place{
+		{channel: discordgo.Channel{ID: "#general", Name: "general"}},
+		{channel: discordgo.Channel{ID: "#alerts", Name: "alerts"}},
+		{channel: discordgo.Channel{ID: "#t", Name: "thread"}, parent: discordgo.Channel{ID: "#secret", Name: "secret"}},
+		{channel: discordgo.Channel{ID: "#incident", Name: "incident"}, category: discordgo.Channel{ID: "#support", Name: "Support"}},
+	}
+	contents := []string{"", "1234", "see the log", "my password is", "drop me"}
+	roles := [][]discordgo.Role{nil, {{ID: "r1", Name: "Staff"}}, {{ID: "r1", Name: "Staff"}, {ID: "r-muted", Name: "Muted"}}}
+
+	var ret []config.MessageMatcher
+	for _, a := range authors {
+		for _, g := range guilds {
+			for _, p := range places {
+				for _, content := range contents {
+					for _, r := range roles {
+						for _, nick := range nicks {
+							ret = append(ret, config.MessageMatcher{
+								Author:   a,
+								Guild:    g,
+								Channel:  p.channel,
+								Parent:   p.parent,
+								Category: p.category,
+								Roles:    r,
+								Nick:     nick,
+								Content:  content,
+								Type:     discordgo.MessageTypeDefault,
+							})
+						}
+					}
+				}
+			}
+		}
+	}
+
+	everyone := ret[0]
+	everyone.MentionsEveryone = true
+	system := ret[0]
+	system.Type = discordgo.MessageTypeGuildMemberJoin
+	return append(ret, everyone, system)
+}
+
+// routeIndices converts the output names returned by Config.Route to indices
+// into Outputs, as dispatched.
+func routeIndices(c config.Config, names []string) []int {
+	ret := []int{}
+	for i, out := range c.Outputs {
+		if len(names) == 0 {
+			ret = append(ret, i)
+			continue
+		}
+		for _, name := range names {
+			if name == out.Name {
+				ret = append(ret, i)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+func TestTable_Route(t *testing.T) {
+	c := tableConfig(t)
+	table := c.Compile()
+
+	for i, msg := range tableMessages() {
+		names, expectOK := c.Route(msg)
+		outs, ok := table.Route(msg)
+		if ok != expectOK {
+			t.Fatalf("message %d (%+v): expected routed %v, got %v", i, msg, expectOK, ok)
+		}
+		if !ok {
+			continue
+		}
+
+		expect := routeIndices(c, names)
+		if fmt.Sprint(outs) != fmt.Sprint(expect) && !(len(outs) == 0 && len(expect) == 0) {
+			t.Fatalf("message %d (%+v): expected outputs %v (%v), got %v", i, msg, expect, names, outs)
+		}
+	}
+}
+
+func TestTable_Matches(t *testing.T) {
+	c := tableConfig(t)
+	table := c.Compile()
+
+	for i, msg := range tableMessages() {
+		if got, expect := table.Matches(msg), c.MessageMatches(msg); got != expect {
+			t.Fatalf("message %d (%+v): expected matched %v, got %v", i, msg, expect, got)
+		}
+
+		expect := routeIndices(c, c.MessageOutputs(msg))
+		if outs := table.Outputs(msg); fmt.Sprint(outs) != fmt.Sprint(expect) && !(len(outs) == 0 && len(expect) == 0) {
+			t.Fatalf("message %d (%+v): expected outputs %v, got %v", i, msg, expect, outs)
+		}
+	}
+}
+
+// checkAgrees checks that c and its compiled table make the same decisions
+// for every message in msgs, differing only in the outputs which do not exist.
+func checkAgrees(t *testing.T, c config.Config, msgs []config.MessageMatcher) {
+	table := c.Compile()
+	for i, msg := range msgs {
+		expect, got := c.Explain(msg), table.Explain(msg)
+		if got.Matched != expect.Matched || got.Rule != expect.Rule || got.Guild != expect.Guild ||
+			got.Profile != expect.Profile || fmt.Sprint(got.Checks) != fmt.Sprint(expect.Checks) {
+			t.Fatalf("message %d (%+v): explanations differ\nconfig: %v\ntable: %v", i, msg, expect, got)
+		}
+		if !got.Matched {
+			continue
+		}
+
+		// Empty but not nil when none of the outputs exist
+		outs := []int{}
+		if got.Outputs == nil || len(got.Outputs) > 0 {
+			outs = routeIndices(c, got.Outputs)
+		}
+		if fmt.Sprint(outs) != fmt.Sprint(routeIndices(c, expect.Outputs)) {
+			t.Fatalf("message %d (%+v): outputs differ\nconfig: %v\ntable: %v", i, msg, expect, got)
+		}
+	}
+}
+
+func TestTable_Explain(t *testing.T) {
+	checkAgrees(t, tableConfig(t), tableMessages())
+	for _, test := range TestData {
+		t.Run(test.Name, func(t *testing.T) {
+			checkAgrees(t, test.Config, TestMessages)
+		})
+	}
+
+	// Only outputs which exist are reported by the table
+	c := tableConfig(t)
+	msg := config.MessageMatcher{
+		Author:  discordgo.User{ID: "1247", Username: "Jay Irwin"},
+		Guild:   discordgo.Guild{ID: "a", Name: "a"},
+		Channel: discordgo.Channel{ID: "#general", Name: "general"},
+	}
+	if e := c.Explain(msg); fmt.Sprint(e.Outputs) != "[a nosuchoutput b]" {
+		t.Errorf("wrong config outputs\nexpect: [a nosuchoutput b]\ngot: %v", e.Outputs)
+	}
+	if e := c.Compile().Explain(msg); fmt.Sprint(e.Outputs) != "[a b]" {
+		t.Errorf("wrong table outputs\nexpect: [a b]\ngot: %v", e.Outputs)
+	}
+}
+
+func TestTable_Needs(t *testing.T) {
+	c := tableConfig(t)
+	table := c.Compile()
+
+	if needs := table.Needs("c", "c"); needs.Roles || needs.Category || needs.Nick {
+		t.Error("Guild without roles, categories or nicknames needs them:", needs)
+	}
+	if needs := table.Needs("b", "b"); !needs.Roles || !needs.Category || !needs.Nick {
+		t.Error("Guild inheriting roles and using categories and nicknames does not need them:", needs)
+	}
+
+	c.Rule(`roles contains "Staff" -> *`)
+	if needs := c.Compile().Needs("", ""); !needs.Roles || needs.Nick {
+		t.Error("Rule using roles does not need them:", needs)
+	}
+}
+
+func TestTable_Routes(t *testing.T) {
+	c := tableConfig(t)
+	c.Rules = nil
+	delete(c.Guilds, config.DefaultGuild)
+	table := c.Compile()
+
+	if !table.Routes("a", "a") || !table.Routes("g4", "Typo") {
+		t.Error("Configured guild not routed")
+	}
+	if table.Routes("c", "c") || table.Routes("g5", "Unknown") {
+		t.Error("Disabled or unknown guild routed")
+	}
+
+	c.Rule(`content contains "drop me" -> []`)
+	if c.Compile().Routes("g5", "Unknown") {
+		t.Error("Unknown guild routed by rule which drops messages")
+	}
+	c.Rule(`guild == "Unknown" -> *`)
+	if !c.Compile().Routes("g5", "Unknown") {
+		t.Error("Unknown guild not routed by rule")
+	}
+}
+
+func TestTable_Config(t *testing.T) {
+	c := tableConfig(t)
+	if got := c.Compile().Config(); len(got.Outputs) != len(c.Outputs) || len(got.Guilds) != len(c.Guilds) {
+		t.Error("Table does not return its config")
+	}
+}
+
+// benchConfig returns a config with the given number of guilds, each with
+// the given number of enabled channels and users, and as many outputs.
+func benchConfig(guilds, entries int) config.Config {
+	c := config.Config{Guilds: make(map[string]*config.GuildConfig, guilds)}
+	for i := 0; i < entries; i++ {
+		c.Outputs = append(c.Outputs, config.OutputConfig{Name: "out" + strconv.Itoa(i)})
+	}
+
+	for i := 0; i < guilds; i++ {
+		g := &config.GuildConfig{
+			Output:   []string{"out0"},
+			Channels: make(map[string]*config.ChannelConfig),
+			Users:    make(map[string]*config.UserConfig),
+		}
+		for j := 0; j < entries; j++ {
+			id := strconv.Itoa(j)
+			g.EnabledChannels = append(g.EnabledChannels, "c"+id)
+			g.EnabledUsers = append(g.EnabledUsers, "u"+id)
+			g.DisabledRoles = append(g.DisabledRoles, "r"+id)
+			g.Channels["c"+id] = &config.ChannelConfig{OutputRule: config.OutputRule{Output: []string{"out" + id}}}
+		}
+		g.Users["u0"] = &config.UserConfig{OutputRule: config.OutputRule{Output: []string{"out1"}}}
+		c.Guilds["g"+strconv.Itoa(i)] = g
+	}
+
+	return c
+}
+
+// benchMessage returns a message matched by the last entries of the last
+// guild of a config from benchConfig.
+func benchMessage(guilds, entries int) config.MessageMatcher {
+	last := strconv.Itoa(entries - 1)
+	return config.MessageMatcher{
+		Author:  discordgo.User{ID: "u" + last, Username: "user"},
+		Guild:   discordgo.Guild{ID: "g" + strconv.Itoa(guilds-1), Name: "guild"},
+		Channel: discordgo.Channel{ID: "c" + last, Name: "channel"},
+		Roles:   []discordgo.Role{{ID: "none", Name: "none"}},
+	}
+}
+
+var benchSizes = []struct{ Guilds, Entries int }{
+	{1, 1},
+	{10, 10},
+	{100, 100},
+	{1000, 500},
+}
+
+func BenchmarkConfig_Route(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("%dx%d", size.Guilds, size.Entries), func(b *testing.B) {
+			c := benchConfig(size.Guilds, size.Entries)
+			msg := benchMessage(size.Guilds, size.Entries)
+			if _, ok := c.Route(msg); !ok {
+				b.Fatal("Benchmark message not routed")
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.Route(msg)
+			}
+		})
+	}
+}
+
+func BenchmarkTable_Route(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("%dx%d", size.Guilds, size.Entries), func(b *testing.B) {
+			table := benchConfig(size.Guilds, size.Entries).Compile()
+			msg := benchMessage(size.Guilds, size.Entries)
+			if _, ok := table.Route(msg); !ok {
+				b.Fatal("Benchmark message not routed")
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				table.Route(msg)
+			}
+		})
+	}
+}
+
+func BenchmarkCompile(b *testing.B) {
+	c := benchConfig(100, 100)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Compile()
+	}
+}
@@ -0,0 +1,267 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ejv2/disdup/output"
+)
+
+// Validation errors. Each problem found by Config.Validate wraps one of these,
+// or the error returned by the output at fault.
+var (
+	ErrNoToken        = errors.New("config: empty token")
+	ErrBadOutput      = errors.New("config: invalid output")
+	ErrUnknownOutput  = errors.New("config: unknown output")
+	ErrUnknownProfile = errors.New("config: unknown profile")
+	ErrDuplicate      = errors.New("config: duplicate entry")
+	ErrConflict       = errors.New("config: entry both enabled and disabled")
+	ErrBadPattern     = errors.New("config: invalid filter pattern")
+	ErrBadLimit       = errors.New("config: invalid limit")
+)
+
+// ValidationError is returned by Config.Validate, listing every problem found
+// with a config.
+type ValidationError struct {
+	Problems []error
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0].Error()
+	}
+
+	msgs := make([]string, len(e.Problems))
+	for i, err := range e.Problems {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("config: %d problems: %s", len(e.Problems), strings.Join(msgs, "; "))
+}
+
+// Is returns true if any of the problems in e is target, such that errors.Is
+// can be used to check for a particular problem.
+func (e *ValidationError) Is(target error) bool {
+	for _, err := range e.Problems {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// validator collects the problems found with a config.
+type validator struct {
+	outputs map[string]bool
+	errs    []error
+}
+
+// add records a problem wrapping err, described by the format string and
+// arguments.
+func (v *validator) add(err error, format string, args ...interface{}) {
+	v.errs = append(v.errs, fmt.Errorf("%w: "+format, append([]interface{}{err}, args...)...))
+}
+
+// Validate checks c for mistakes which would otherwise be silently ignored or
+// cause a panic at runtime, such as references to outputs which do not exist.
+// If any are found, a *ValidationError is returned listing all of them, else
+// nil.
+//
+// Problems reported are:
+//   - An empty token
+//   - Outputs with no name, no output, a negative queue size or problems
+//     reported by their output.Validator implementation
+//   - Negative attachment limits and cache times to live
+//   - References to unknown outputs or profiles
+//   - Duplicate output names and duplicate entries in any list
+//   - Channels, categories, users or roles both enabled and disabled in the
+//     same guild or profile entry
+//   - Filter patterns which are not valid regular expressions
+func (c Config) Validate() error {
+	v := &validator{outputs: make(map[string]bool, len(c.Outputs))}
+
+	if c.Token == "" {
+		v.errs = append(v.errs, ErrNoToken)
+	}
+
+	for i, out := range c.Outputs {
+		switch {
+		case out.Name == "":
+			v.add(ErrBadOutput, "output %d: empty name", i+1)
+		case v.outputs[out.Name]:
+			v.add(ErrDuplicate, "output %q", out.Name)
+		}
+		v.outputs[out.Name] = true
+
+		if out.Output == nil {
+			v.add(ErrBadOutput, "output %q: nil output", out.Name)
+		} else if val, ok := out.Output.(output.Validator); ok {
+			for _, err := range val.Validate() {
+				v.errs = append(v.errs, fmt.Errorf("config: output %q: %w", out.Name, err))
+			}
+		}
+		if out.QueueSize < 0 {
+			v.add(ErrBadOutput, "output %q: negative queue size %d", out.Name, out.QueueSize)
+		}
+	}
+
+	limits := []struct {
+		name  string
+		value int64
+	}{
+		{"memory budget", c.Attachments.MemoryBudget},
+		{"max size", c.Attachments.MaxSize},
+		{"spill size", c.Attachments.SpillSize},
+		{"max store size", c.Attachments.MaxStoreSize},
+	}
+	for _, l := range limits {
+		if l.value < 0 {
+			v.add(ErrBadLimit, "attachments: negative %s %d", l.name, l.value)
+		}
+	}
+	if c.Attachments.Timeout < 0 {
+		v.add(ErrBadLimit, "attachments: negative timeout %s", time.Duration(c.Attachments.Timeout))
+	}
+	if c.Attachments.Retention < 0 {
+		v.add(ErrBadLimit, "attachments: negative retention %s", time.Duration(c.Attachments.Retention))
+	}
+	if c.Attachments.Attempts < 0 {
+		v.add(ErrBadLimit, "attachments: negative attempts %d", c.Attachments.Attempts)
+	}
+	ttls := []struct {
+		name  string
+		value Duration
+	}{
+		{"channel", c.Cache.ChannelTTL},
+		{"guild", c.Cache.GuildTTL},
+		{"user", c.Cache.UserTTL},
+		{"member", c.Cache.MemberTTL},
+		{"role", c.Cache.RoleTTL},
+	}
+	for _, ttl := range ttls {
+		if ttl.value < 0 {
+			v.add(ErrBadLimit, "cache: negative %s ttl %s", ttl.name, time.Duration(ttl.value))
+		}
+	}
+
+	for _, r := range c.Rules {
+		names, _ := r.Outputs()
+		v.outputNames(fmt.Sprintf("rule %q", r.String()), names)
+	}
+
+	dm := c.DirectMessages
+	v.outputNames("direct messages", dm.Output)
+	v.duplicates("direct messages: enabled users", dm.EnabledUsers)
+
+	for _, key := range sortedKeys(c.Profiles) {
+		v.guild(c, fmt.Sprintf("profile %q", key), c.Profiles[key])
+	}
+	for _, key := range sortedKeys(c.Guilds) {
+		v.guild(c, fmt.Sprintf("guild %q", key), c.Guilds[key])
+	}
+
+	if len(v.errs) > 0 {
+		return &ValidationError{Problems: v.errs}
+	}
+	return nil
+}
+
+// guild validates the guild or profile entry g, described by where.
+func (v *validator) guild(c Config, where string, g *GuildConfig) {
+	if g == nil {
+		return
+	}
+
+	if _, ok := c.Profiles[g.Profile]; g.Profile != "" && !ok {
+		v.add(ErrUnknownProfile, "%s: profile %q", where, g.Profile)
+	}
+	v.outputNames(where, g.Output)
+
+	lists := []struct {
+		name              string
+		enabled, disabled []string
+	}{
+		{"channels", g.EnabledChannels, g.DisabledChannels},
+		{"categories", g.EnabledCategories, g.DisabledCategories},
+		{"users", g.EnabledUsers, g.DisabledUsers},
+		{"roles", g.EnabledRoles, g.DisabledRoles},
+	}
+	for _, l := range lists {
+		v.duplicates(where+": enabled "+l.name, l.enabled)
+		v.duplicates(where+": disabled "+l.name, l.disabled)
+
+		disabled := make(map[string]bool, len(l.disabled))
+		for _, elem := range l.disabled {
+			disabled[elem] = true
+		}
+		for _, elem := range l.enabled {
+			if disabled[elem] {
+				v.add(ErrConflict, "%s: %s: %q", where, l.name, elem)
+				// Only report once per element
+				delete(disabled, elem)
+			}
+		}
+	}
+
+	v.filter(where+": filter", g.Filter)
+	for _, key := range sortedKeys(g.Channels) {
+		if ch := g.Channels[key]; ch != nil {
+			chwhere := fmt.Sprintf("%s: channel %q", where, key)
+			v.outputNames(chwhere, ch.Output)
+			v.filter(chwhere+": filter", ch.Filter)
+		}
+	}
+	for _, key := range sortedKeys(g.Users) {
+		if u := g.Users[key]; u != nil {
+			v.outputNames(fmt.Sprintf("%s: user %q", where, key), u.Output)
+		}
+	}
+}
+
+// outputNames checks that each of names, used by where, is a known output and
+// is only given once.
+func (v *validator) outputNames(where string, names []string) {
+	for _, name := range names {
+		if !v.outputs[name] {
+			v.add(ErrUnknownOutput, "%s: output %q", where, name)
+		}
+	}
+	v.duplicates(where+": outputs", names)
+}
+
+// duplicates checks that no element of list, described by where, is given more
+// than once.
+func (v *validator) duplicates(where string, list []string) {
+	seen := make(map[string]int, len(list))
+	for _, elem := range list {
+		seen[elem]++
+		// Only report once per element
+		if seen[elem] == 2 {
+			v.add(ErrDuplicate, "%s: %q", where, elem)
+		}
+	}
+}
+
+// filter checks that each pattern in f, described by where, compiles.
+func (v *validator) filter(where string, f ContentFilter) {
+	for _, list := range [][]string{f.Include, f.Exclude} {
+		for _, pattern := range list {
+			if _, err := compilePattern(pattern, f.IgnoreCase); err != nil {
+				v.add(ErrBadPattern, "%s: %s", where, err)
+			}
+		}
+	}
+}
+
+// sortedKeys returns the keys of m in order, such that problems are always
+// reported in the same order.
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,116 @@
+package config_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	config "github.com/ejv2/disdup/conf"
+	"github.com/ejv2/disdup/output"
+)
+
+func TestValidate(t *testing.T) {
+	c := config.Config{Token: "token", Guilds: map[string]*config.GuildConfig{}}
+	c.Use("stdout", &output.Channel{Output: make(chan string)})
+	c.Use("mail", &output.Mailer{To: "to@example.com", From: "from@example.com", Server: output.MailServer{Address: "localhost:25"}})
+	c.Guild("a").Use("stdout").Channel("general").DisableChannel("secret")
+	c.Profile("staff").Role("Staff").Use("mail")
+	c.Guild("b").Inherit("staff")
+	if err := c.Rule(`dm -> [mail]`); err != nil {
+		t.Fatal("Unexpected rule error:", err)
+	}
+
+	if err := c.Validate(); err != nil {
+		t.Fatal("Unexpected error from valid config:", err)
+	}
+}
+
+func TestValidate_Problems(t *testing.T) {
+	c := config.Config{
+		Guilds: map[string]*config.GuildConfig{
+			"a": {
+				Profile:          "nosuchprofile",
+				Output:           []string{"stdout", "stdotu"},
+				EnabledChannels:  []string{"general", "general", "secret"},
+				DisabledChannels: []string{"secret"},
+				EnabledRoles:     []string{"Staff"},
+				DisabledRoles:    []string{"Staff"},
+				Filter:           config.ContentFilter{Include: []string{"("}},
+				Channels: map[string]*config.ChannelConfig{
+					"alerts": {OutputRule: config.OutputRule{Output: []string{"pager"}}},
+				},
+			},
+		},
+		DirectMessages: config.DMConfig{Output: []string{"stdout", "stdout"}},
+		Attachments:    config.AttachmentConfig{SpillSize: -1, Retention: config.Duration(-time.Hour)},
+		Cache:          config.CacheConfig{RoleTTL: config.Duration(-time.Minute)},
+	}
+	c.Use("stdout", &output.Channel{Output: make(chan string)})
+	c.Outputs = append(c.Outputs, config.OutputConfig{Name: "stdout"})
+	c.Use("mail", &output.Mailer{ReplyMode: 42})
+	if err := c.Rule(`dm -> [mial]`); err != nil {
+		t.Fatal("Unexpected rule error:", err)
+	}
+
+	err := c.Validate()
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatal("Expected ValidationError, got", err)
+	}
+
+	expect := []struct {
+		Err  error
+		Text string
+	}{
+		{config.ErrNoToken, ""},
+		{config.ErrDuplicate, `output "stdout"`},
+		{config.ErrBadOutput, `output "stdout": nil output`},
+		{output.ErrMailMissing, `output "mail"`},
+		{output.ErrMailMissing, `output "mail"`},
+		{output.ErrMailMissing, `output "mail"`},
+		{output.ErrMailReplyMode, `output "mail"`},
+		{config.ErrBadLimit, `attachments: negative spill size -1`},
+		{config.ErrBadLimit, `attachments: negative retention -1h0m0s`},
+		{config.ErrBadLimit, `cache: negative role ttl -1m0s`},
+		{config.ErrUnknownOutput, `rule "dm -> [mial]": output "mial"`},
+		{config.ErrDuplicate, `direct messages: outputs: "stdout"`},
+		{config.ErrUnknownProfile, `guild "a": profile "nosuchprofile"`},
+		{config.ErrUnknownOutput, `guild "a": output "stdotu"`},
+		{config.ErrDuplicate, `guild "a": enabled channels: "general"`},
+		{config.ErrConflict, `guild "a": channels: "secret"`},
+		{config.ErrConflict, `guild "a": roles: "Staff"`},
+		{config.ErrBadPattern, `guild "a": filter`},
+		{config.ErrUnknownOutput, `guild "a": channel "alerts": output "pager"`},
+	}
+	if len(verr.Problems) != len(expect) {
+		t.Fatalf("expected %d problems, got %d: %v", len(expect), len(verr.Problems), err)
+	}
+	for i, e := range expect {
+		got := verr.Problems[i]
+		if !errors.Is(got, e.Err) || !strings.Contains(got.Error(), e.Text) {
+			t.Errorf("wrong problem %d\nexpect: %s (%s)\ngot: %s", i, e.Err, e.Text, got)
+		}
+	}
+
+	if !errors.Is(err, config.ErrConflict) || errors.Is(err, config.ErrRuleSyntax) {
+		t.Error("errors.Is does not check each problem")
+	}
+	if !strings.HasPrefix(err.Error(), "config: 19 problems: ") {
+		t.Error("Wrong error message:", err)
+	}
+}
+
+func TestValidate_DeadLetterCycle(t *testing.T) {
+	a := &output.Retry{Output: &output.Channel{Output: make(chan string)}}
+	b := &output.Retry{Output: &output.Channel{Output: make(chan string)}, DeadLetter: a}
+	a.DeadLetter = b
+
+	c := config.Config{Token: "token", Guilds: map[string]*config.GuildConfig{}}
+	c.Use("a", a).Use("b", b)
+	err := c.Validate()
+	var verr *config.ValidationError
+	if !errors.As(err, &verr) || len(verr.Problems) != 2 || !errors.Is(err, output.ErrRetryCycle) {
+		t.Error("Expected dead letter cycle of each output, got", err)
+	}
+}
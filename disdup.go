@@ -5,34 +5,115 @@
 package disdup
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/ejv2/disdup/cache"
 	config "github.com/ejv2/disdup/conf"
 	"github.com/ejv2/disdup/output"
+	"github.com/ejv2/disdup/spool"
 
 	"github.com/bwmarrin/discordgo"
 )
 
+// Internal implementation constants.
+const (
+	// The number of recent messages per channel kept in the session state
+	// for use in reporting deletions.
+	messageHistory = 50
+	// The interval at which checkpoints are saved to disk.
+	checkpointInterval = 10 * time.Second
+	// The maximum number of messages per channel fetched when backfilling.
+	backfillLimit = 1000
+	// The number of messages requested per page of channel history.
+	backfillPage = 100
+)
+
 // Duplicator errors.
 var (
 	ErrClosed = errors.New("duplicator: closed")
+	// Returned by Reconfigure if an output still used as a dead letter
+	// would be removed.
+	ErrDeadLetterRemoved = errors.New("duplicator: reconfigure: removed output is still a dead letter")
 )
 
 type Duplicator struct {
-	conn  *discordgo.Session
-	cache *cache.Cache
-	conf  config.Config
+	conn   *discordgo.Session
+	cache  *cache.Cache
+	routes *routes
+
+	// Context for output writes, cancelled on close
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Last routed message in each channel, or nil if not kept
+	checkpoints *checkpoints
+	// Work for gateway events, run in order for each guild
+	events *sequencer
 
-	lastPrune time.Time
+	lastPrune *pruneClock
 
 	cerr chan error
 	stop chan struct{}
 }
 
+// routes is the configuration in use by a duplicator, compiled into a routing
+// table, alongside the delivery queue for each output. It is shared between
+// copies of a duplicator and may be replaced by Reconfigure.
+type routes struct {
+	mu     sync.RWMutex
+	table  *config.Table
+	queues []*queue // One for each output in the config of table
+
+	// Serialises calls to Reconfigure
+	reconf sync.Mutex
+}
+
+// pruneClock records when the attachment cache was last cleaned. It is shared
+// between copies of a duplicator, as messages in different guilds are prepared
+// concurrently.
+type pruneClock struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+// due reports whether the cache was last cleaned at least
+// cache.AttachmentLifetime before now, recording now as the time of the clean
+// if so.
+func (p *pruneClock) due(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if now.Sub(p.last) < cache.AttachmentLifetime {
+		return false
+	}
+	p.last = now
+	return true
+}
+
+// current returns the configuration and output queues currently in use.
+func (d Duplicator) current() (config.Config, []*queue) {
+	d.routes.mu.RLock()
+	defer d.routes.mu.RUnlock()
+
+	return d.routes.table.Config(), d.routes.queues
+}
+
+// routing returns the routing table and output queues currently in use. Output
+// indices from the table index the queues returned alongside it.
+func (d Duplicator) routing() (*config.Table, []*queue) {
+	d.routes.mu.RLock()
+	defer d.routes.mu.RUnlock()
+
+	return d.routes.table, d.routes.queues
+}
+
 // NewDuplicator initializes and starts running a new duplicator. As soon as
 // this call completes, the duplicator is connected to Discord and serving
 // events.
@@ -41,13 +122,21 @@ type Duplicator struct {
 // complete, use Duplicator.Run or Duplicator.Wait. It is the caller's
 // responsibility to call close and to check for errors from the runner
 // channel.
+//
+// The configuration is checked by Config.Validate first, and the duplicator
+// is not started if any problems are found.
 func NewDuplicator(conf config.Config) (Duplicator, error) {
+	if err := conf.Validate(); err != nil {
+		return Duplicator{}, fmt.Errorf("duplicator: %w", err)
+	}
+
 	var err error
 	dup := Duplicator{
-		conf:      conf,
+		routes:    &routes{table: conf.Compile()},
 		cerr:      make(chan error),
 		stop:      make(chan struct{}),
-		lastPrune: time.Now(),
+		events:    &sequencer{},
+		lastPrune: &pruneClock{last: time.Now()},
 	}
 
 	dup.conn, err = discordgo.New("Bot " + conf.Token)
@@ -63,24 +152,135 @@ func NewDuplicator(conf config.Config) (Duplicator, error) {
 	dup.conn.Identify.Intents = discordgo.IntentGuildMessages |
 		discordgo.IntentMessageContent | discordgo.IntentDirectMessages | discordgo.IntentGuilds
 
-	// Set up cache based on current discord session
-	dup.cache = cache.NewCache(dup.conn)
+	// Matching by role or nickname requires knowing when members change.
+	// This is a privileged intent, so is only requested when needed.
+	if conf.UsesRoles() || conf.UsesNicknames() {
+		dup.conn.Identify.Intents |= discordgo.IntentGuildMembers
+	}
+
+	// Events must be handled in the order received so that they are
+	// queued for output in that order. Handlers only queue their work to
+	// be run in order for each guild (see sequencer), so never hold up the
+	// gateway connection.
+	dup.conn.SyncEvents = true
+
+	// Keep recent messages in the session state so that the content of
+	// deleted messages is still known when they are deleted
+	dup.conn.State.MaxMessageCount = messageHistory
+
+	// Set up cache based on current discord session, kept up to date by
+	// gateway events
+	dup.cache = cache.NewCacheOptions(dup.conn, cache.Options{
+		ChannelTTL:        time.Duration(conf.Cache.ChannelTTL),
+		GuildTTL:          time.Duration(conf.Cache.GuildTTL),
+		UserTTL:           time.Duration(conf.Cache.UserTTL),
+		MemberTTL:         time.Duration(conf.Cache.MemberTTL),
+		RoleTTL:           time.Duration(conf.Cache.RoleTTL),
+		MemoryBudget:      conf.Attachments.MemoryBudget,
+		MaxAttachmentSize: conf.Attachments.MaxSize,
+		SpillSize:         conf.Attachments.SpillSize,
+		Dir:               conf.Attachments.Dir,
+		FetchTimeout:      time.Duration(conf.Attachments.Timeout),
+		FetchAttempts:     conf.Attachments.Attempts,
+		AllowedTypes:      conf.Attachments.AllowedTypes,
+		StoreDir:          conf.Attachments.StoreDir,
+		Retention:         time.Duration(conf.Attachments.Retention),
+		MaxStoreSize:      conf.Attachments.MaxStoreSize,
+	})
+
+	dup.ctx, dup.cancel = context.WithCancel(context.Background())
+
+	// Messages left over from the last run are written before any new
+	// ones, so must be queued before connecting.
+	for _, out := range conf.Outputs {
+		q, err := dup.newQueue(out)
+		if err != nil {
+			dup.abort(false)
+			return Duplicator{}, err
+		}
+		dup.routes.queues = append(dup.routes.queues, q)
+	}
 
 	// Event handling.
 	// Discordgo automatically dispatches events to the correct handler
 	// based on method signature.
 	dup.conn.AddHandler(dup.onMessage)
+	dup.conn.AddHandler(dup.onUpdate)
+	dup.conn.AddHandler(dup.onDelete)
 	dup.conn.AddHandler(dup.onJoin)
+	dup.conn.AddHandler(dup.cache.Handle)
+
+	if conf.CheckpointFile != "" {
+		dup.checkpoints, err = loadCheckpoints(conf.CheckpointFile)
+		if err != nil {
+			dup.abort(false)
+			return Duplicator{}, fmt.Errorf("duplicator: %w", err)
+		}
+		dup.conn.AddHandler(dup.onGuild)
+	}
+
+	// Open up outputs before connecting, such that events are never
+	// queued for outputs which failed to open
+	if err = dup.openOutputs(conf.Outputs); err != nil {
+		dup.abort(false)
+		return Duplicator{}, err
+	}
+	for _, q := range dup.routes.queues {
+		q.start()
+	}
 
 	if err = dup.conn.Open(); err != nil {
+		dup.abort(true)
 		return Duplicator{}, fmt.Errorf("duplicator: connection: %w", err)
 	}
+	if dup.checkpoints != nil {
+		go dup.saveCheckpoints()
+	}
+
+	return dup, nil
+}
+
+// newQueue creates the delivery queue for output out, preloaded with any
+// messages left in its spool.
+func (d Duplicator) newQueue(out config.OutputConfig) (*queue, error) {
+	conf, _ := d.current()
+	q := newQueue(d.ctx, out, d.outputError(out.Name))
+	q.hold, q.release = d.holdFiles, d.releaseFiles
+
+	if conf.SpoolDir != "" {
+		sp, err := spool.Open(filepath.Join(conf.SpoolDir, url.PathEscape(out.Name)))
+		if err != nil {
+			return nil, fmt.Errorf("duplicator: output %s: %w", out.Name, err)
+		}
+		q.preload(sp)
+	}
 
-	// Open up outputs
-	done, fail := make(chan struct{}, len(conf.Outputs)), make(chan error, 1)
-	for _, output := range conf.Outputs {
+	return q, nil
+}
+
+// holdFiles keeps the files of the attachments of dl which are on disk until
+// released by releaseFiles, such that they are not removed by the cache while
+// waiting to be written.
+func (d Duplicator) holdFiles(dl delivery) {
+	for _, a := range dl.msg.Downloads {
+		d.cache.Hold(a.Path)
+	}
+}
+
+// releaseFiles releases the files held by holdFiles.
+func (d Duplicator) releaseFiles(dl delivery) {
+	for _, a := range dl.msg.Downloads {
+		d.cache.Release(a.Path)
+	}
+}
+
+// openOutputs concurrently opens each of outs, returning the first error
+// encountered, if any.
+func (d Duplicator) openOutputs(outs []config.OutputConfig) error {
+	done, fail := make(chan struct{}, len(outs)), make(chan error, 1)
+	for _, output := range outs {
 		go func(out config.OutputConfig) {
-			err := out.Output.Open(dup.conn)
+			err := out.Output.Open(d.conn)
 			if err != nil {
 				select {
 				case fail <- err:
@@ -94,12 +294,12 @@ func NewDuplicator(conf config.Config) (Duplicator, error) {
 	for i := 0; i < cap(done); i++ {
 		select {
 		case err := <-fail:
-			return Duplicator{}, fmt.Errorf("duplicator: output open: %w", err)
+			return fmt.Errorf("duplicator: output open: %w", err)
 		case <-done:
 		}
 	}
 
-	return dup, nil
+	return nil
 }
 
 // Run runs the duplicator until an error occurs or the duplicator is
@@ -115,8 +315,9 @@ func (d Duplicator) Wait() chan error {
 }
 
 // Close terminates the duplicator. Any errors waiting to be received are
-// discarded and all running goroutines terminate gracefully. It is safe to
-// call Close after an error, although it is seldom necessary.
+// discarded and all running goroutines terminate gracefully. Writes in
+// progress or still queued are cancelled. It is safe to call Close after an
+// error, although it is seldom necessary.
 func (d Duplicator) Close() {
 	select {
 	case <-d.stop:
@@ -124,9 +325,62 @@ func (d Duplicator) Close() {
 		close(d.stop)
 	}
 	d.conn.Close()
-	for _, out := range d.conf.Outputs {
+	d.cancel()
+	// Queues drain quickly once cancelled, so events waiting for space
+	// finish soon too
+	d.events.close()
+
+	conf, queues := d.current()
+	for i, out := range conf.Outputs {
+		queues[i].close()
 		out.Output.Close()
 	}
+	if d.checkpoints != nil {
+		if err := d.checkpoints.save(); err != nil {
+			log.Println("[WARNING]: duplicator:", err)
+		}
+	}
+	if err := d.cache.Close(); err != nil {
+		log.Println("[WARNING]: duplicator:", err)
+	}
+}
+
+// saveCheckpoints periodically saves checkpoints to disk until the duplicator
+// is stopped.
+func (d Duplicator) saveCheckpoints() {
+	tick := time.NewTicker(checkpointInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			if err := d.checkpoints.save(); err != nil {
+				log.Println("[WARNING]: duplicator:", err)
+			}
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// abort releases the resources held by a duplicator which failed to start. If
+// started is set, the outputs were opened and their queues started.
+func (d Duplicator) abort(started bool) {
+	d.conn.Close()
+	d.cancel()
+	d.events.close()
+
+	conf, queues := d.current()
+	for i, q := range queues {
+		switch {
+		case started:
+			q.close()
+			conf.Outputs[i].Output.Close()
+		case q.spool != nil:
+			q.spool.Close()
+		}
+	}
+	d.cache.Close()
 }
 
 // err propagates an error to the client code, ensuring that this cannot block
@@ -141,27 +395,64 @@ func (d Duplicator) err(err error) {
 	}
 }
 
+// outputError returns a function which reports failed deliveries to the
+// output named name to the client code.
+func (d Duplicator) outputError(name string) func(dl delivery, err error) {
+	return func(dl delivery, err error) {
+		// Cancelled on close; not a failure of the output
+		if d.ctx.Err() != nil && errors.Is(err, d.ctx.Err()) {
+			return
+		}
+
+		conf, _ := d.current()
+		if conf.OnOutputError != nil {
+			conf.OnOutputError(name, dl.msg, err)
+			return
+		}
+		log.Println("[WARNING]: duplicator: output", name+":", err)
+	}
+}
+
 // updateNickname attempts to change the nickname of the bot in the guild `g`.
 func (d Duplicator) updateNickname(g *discordgo.Guild) error {
-	return d.conn.GuildMemberNickname(g.ID, "@me", d.conf.Name)
+	conf, _ := d.current()
+	return d.conn.GuildMemberNickname(g.ID, "@me", conf.Name)
 }
 
-// onMessage is the event handler for a message creation event in any of the
-// guilds of which the bot is a member.
-func (d *Duplicator) onMessage(s *discordgo.Session, m *discordgo.MessageCreate) {
-	if time.Since(d.lastPrune) >= cache.AttachmentLifetime {
-		d.cache.Clean()
+// prepare resolves the channel and guild in which m was sent and checks the
+// message against the routing table. If the message is to be duplicated, it is
+// returned ready for output alongside the queues of the outputs it should be
+// written to. Attachments are only downloaded if download is set.
+//
+// If the author of m is not known (such as for deletions of messages which
+// disdup has not seen), the message is matched as if sent by an empty user and
+// the output message carries an empty, non-nil author.
+func (d *Duplicator) prepare(s *discordgo.Session, m *discordgo.Message, download bool) (output.Message, []*queue, bool) {
+	if d.lastPrune.due(time.Now()) {
+		if err := d.cache.Clean(); err != nil {
+			log.Println("[WARNING]: duplicator:", err)
+		}
 	}
 
 	c, err := d.cache.Channel(m.ChannelID)
 	if err != nil {
 		log.Println("[WARNING]: duplicator: onmessage: invalid channel:", err)
-		return
+		return output.Message{}, nil, false
 	}
-	g, err := d.cache.Guild(m.GuildID)
+	// Rules for a channel also apply to its threads
+	parent, thread, err := d.cache.Parent(c)
 	if err != nil {
-		log.Println("[WARNING]: duplicator: onmessage: invalid guild:", err)
-		return
+		log.Println("[WARNING]: duplicator: onmessage: invalid thread parent:", err)
+		return output.Message{}, nil, false
+	}
+	// Direct messages are not sent in a guild
+	var g discordgo.Guild
+	if m.GuildID != "" {
+		g, err = d.cache.Guild(m.GuildID)
+		if err != nil {
+			log.Println("[WARNING]: duplicator: onmessage: invalid guild:", err)
+			return output.Message{}, nil, false
+		}
 	}
 	cont, err := m.ContentWithMoreMentionsReplaced(s)
 	if err != nil {
@@ -170,20 +461,82 @@ func (d *Duplicator) onMessage(s *discordgo.Session, m *discordgo.MessageCreate)
 		// message will be valid, so we should continue
 	}
 
-	if d.conf.MessageMatches(config.MessageMatcher{
-		Author:  *m.Author,
-		Channel: c,
-		Guild:   g,
-	}) {
-		msg := output.Message{
-			Message:       m.Message,
-			PrettyContent: cont,
-			ChannelName:   c.Name,
-			GuildName:     g.Name,
+	if m.Author == nil {
+		cp := *m
+		cp.Author = &discordgo.User{}
+		m = &cp
+	}
+
+	table, queues := d.routing()
+	match := config.MessageMatcher{
+		Author:           *m.Author,
+		Channel:          c,
+		Guild:            g,
+		Parent:           parent,
+		Content:          cont,
+		Type:             m.Type,
+		WebhookID:        m.WebhookID,
+		Self:             s.State.User != nil && m.Author.ID == s.State.User.ID,
+		MentionsEveryone: m.MentionEveryone,
+	}
+	for _, att := range m.Attachments {
+		match.Attachments = append(match.Attachments, att.Filename)
+	}
+	for _, u := range m.Mentions {
+		match.Mentions = append(match.Mentions, *u)
+	}
+
+	// Roles, categories and nicknames require lookups, so are only
+	// resolved if used. Messages from the gateway carry the member, so
+	// nicknames are known regardless.
+	if needs := table.Needs(g.ID, g.Name); g.ID != "" {
+		member := m.Member
+		if member == nil && (needs.Roles || needs.Nick) {
+			member = d.member(m)
 		}
+		if member != nil {
+			match.Nick = member.Nick
+			if needs.Roles {
+				match.Roles = d.roles(m.GuildID, member)
+			}
+		}
+		if needs.Category {
+			// Channels which cannot be resolved are treated as
+			// having no category
+			match.Category, _, err = d.cache.Category(c)
+			if err != nil {
+				log.Println("[WARNING]: duplicator: onmessage: invalid category:", err)
+			}
+		}
+	}
 
+	outs, ok := table.Route(match)
+	if !ok {
+		if table.Config().Debug {
+			log.Println("[DEBUG]: duplicator: dropped message", m.ID+":", table.Explain(match))
+		}
+		return output.Message{}, nil, false
+	}
+	targets := make([]*queue, len(outs))
+	for i, out := range outs {
+		targets[i] = queues[out]
+	}
+
+	msg := output.Message{
+		Message:       m,
+		PrettyContent: cont,
+		ChannelName:   c.Name,
+		GuildName:     g.Name,
+		AuthorNick:    match.Nick,
+	}
+	if thread {
+		msg.ParentName = parent.Name
+		msg.ThreadName = c.Name
+	}
+
+	if download {
 		for _, att := range m.Attachments {
-			a, err := d.cache.Attachment(att)
+			a, err := d.cache.AttachmentContext(d.ctx, att)
 			if err != nil {
 				log.Println("[WARNING]: duplicator: attachment download failed:", err)
 				continue
@@ -192,32 +545,199 @@ func (d *Duplicator) onMessage(s *discordgo.Session, m *discordgo.MessageCreate)
 			msg.Downloads = append(msg.Downloads, output.Attachment{
 				Filename: a.Name,
 				Type:     a.Type,
+				Size:     a.Size,
 				Content:  a.Content,
+				Path:     a.Path,
+				Hash:     a.Hash,
 			})
 		}
+	}
 
-		gconf := d.conf.FindGuild(m.GuildID, g.Name)
-		for _, o := range d.conf.Outputs {
-			go func(out config.OutputConfig) {
-				// An empty output array means unconditionally output
-				if len(gconf.Output) == 0 {
-					out.Output.Write(msg)
-					return
-				}
+	return msg, targets, true
+}
 
-				for _, name := range gconf.Output {
-					if out.Name == name {
-						out.Output.Write(msg)
-					}
-				}
-			}(o)
+// member returns the guild member who sent m, looked up in the cache. Members
+// which cannot be resolved are logged and nil returned, such that authors which
+// are not members (such as webhooks) have no roles or nickname.
+func (d *Duplicator) member(m *discordgo.Message) *discordgo.Member {
+	if m.Author.ID == "" || m.WebhookID != "" {
+		return nil
+	}
+
+	mem, err := d.cache.Member(m.GuildID, m.Author.ID)
+	if err != nil {
+		log.Println("[WARNING]: duplicator: onmessage: invalid member:", err)
+		return nil
+	}
+	return &mem
+}
+
+// roles returns the roles of member in guild. Roles which cannot be resolved
+// are logged and omitted.
+func (d *Duplicator) roles(guild string, member *discordgo.Member) []discordgo.Role {
+	all, err := d.cache.Roles(guild)
+	if err != nil {
+		log.Println("[WARNING]: duplicator: onmessage: invalid roles:", err)
+		return nil
+	}
+
+	var ret []discordgo.Role
+	for _, r := range all {
+		for _, id := range member.Roles {
+			if r.ID == id {
+				ret = append(ret, r)
+			}
+		}
+	}
+	return ret
+}
+
+// dispatch queues dl on each of queues.
+func (d *Duplicator) dispatch(queues []*queue, dl delivery) {
+	for _, q := range queues {
+		q.push(dl)
+	}
+}
+
+// route routes a new message to outputs, recording it as the latest message
+// seen in its channel.
+func (d *Duplicator) route(s *discordgo.Session, m *discordgo.Message) {
+	msg, queues, ok := d.prepare(s, m, true)
+	if ok {
+		d.dispatch(queues, delivery{kind: deliverWrite, msg: msg})
+	}
+
+	// Messages which are not duplicated are recorded too, else channels
+	// whose messages are all dropped are backfilled again every time
+	if d.checkpoints != nil {
+		d.checkpoints.update(m.ChannelID, m.ID)
+	}
+}
+
+// onMessage is the event handler for a message creation event in any of the
+// guilds of which the bot is a member.
+func (d *Duplicator) onMessage(s *discordgo.Session, m *discordgo.MessageCreate) {
+	d.events.do(m.GuildID, func() {
+		d.route(s, m.Message)
+	})
+}
+
+// onUpdate is the event handler for a message edit event. Edits are only
+// delivered to outputs which implement output.Editor.
+func (d *Duplicator) onUpdate(s *discordgo.Session, m *discordgo.MessageUpdate) {
+	// Updates without an edit timestamp are generated by Discord itself
+	// (such as embeds being unfurled) and were not made by the author
+	if m.Author == nil || m.EditedTimestamp == nil {
+		return
+	}
+
+	d.events.do(m.GuildID, func() {
+		msg, queues, ok := d.prepare(s, m.Message, false)
+		if ok {
+			d.dispatch(queues, delivery{kind: deliverEdit, msg: msg})
+		}
+	})
+}
+
+// onDelete is the event handler for a message deletion event. Deletions are
+// only delivered to outputs which implement output.Deleter.
+func (d *Duplicator) onDelete(s *discordgo.Session, m *discordgo.MessageDelete) {
+	// The state cache keeps the last few messages of each channel, which
+	// gives us the author and content of the deleted message if recent
+	del := m.Message
+	if m.BeforeDelete != nil {
+		del = m.BeforeDelete
+	}
+
+	d.events.do(m.GuildID, func() {
+		msg, queues, ok := d.prepare(s, del, false)
+		if ok {
+			d.dispatch(queues, delivery{kind: deliverDelete, msg: msg})
+		}
+	})
+}
+
+// onGuild is the event handler for a guild becoming available, which happens
+// for every guild on startup and on reconnection. Messages sent in the guild
+// since the last checkpoint of each channel are routed before any new events
+// in the guild are handled.
+func (d *Duplicator) onGuild(s *discordgo.Session, g *discordgo.GuildCreate) {
+	d.events.do(g.ID, func() {
+		d.catchUp(s, g.Guild)
+	})
+}
+
+// catchUp backfills each channel of guild g which has a checkpoint, and
+// records a checkpoint for those which do not.
+func (d *Duplicator) catchUp(s *discordgo.Session, g *discordgo.Guild) {
+	table, _ := d.routing()
+	if !table.Routes(g.ID, g.Name) {
+		return
+	}
+
+	for _, c := range g.Channels {
+		if c.Type != discordgo.ChannelTypeGuildText && c.Type != discordgo.ChannelTypeGuildNews {
+			continue
+		}
+		if c.LastMessageID == "" {
+			continue
+		}
+
+		last, ok := d.checkpoints.get(c.ID)
+		if !ok {
+			// Never seen before; nothing could have been missed
+			d.checkpoints.update(c.ID, c.LastMessageID)
+			continue
+		}
+		if snowflakeBefore(last, c.LastMessageID) {
+			d.backfill(s, g.ID, c.ID, last, c.LastMessageID)
 		}
 	}
 }
 
+// backfill routes the messages in channel sent after message after, up to and
+// including message until, in the order in which they were sent.
+func (d *Duplicator) backfill(s *discordgo.Session, guild, channel, after, until string) {
+	for count := 0; count < backfillLimit; {
+		// Closed part way through; the rest is backfilled next time
+		if d.ctx.Err() != nil {
+			return
+		}
+
+		page, err := s.ChannelMessages(channel, backfillPage, "", after, "")
+		if err != nil {
+			log.Println("[WARNING]: duplicator: backfill: channel history:", err)
+			return
+		}
+		sort.Slice(page, func(i, j int) bool {
+			return snowflakeBefore(page[i].ID, page[j].ID)
+		})
+
+		for _, m := range page {
+			if snowflakeBefore(until, m.ID) {
+				return
+			}
+
+			// Not sent by the REST API
+			m.GuildID = guild
+			d.route(s, m)
+			after = m.ID
+			count++
+		}
+
+		if len(page) < backfillPage {
+			return
+		}
+	}
+
+	log.Println("[WARNING]: duplicator: backfill: too many missed messages in channel", channel)
+}
+
 // onJoin is the event handler for when the bot is added to a guild.
 func (d Duplicator) onJoin(s *discordgo.Session, c *discordgo.GuildCreate) {
-	if err := d.updateNickname(c.Guild); err != nil {
-		d.err(err)
-	}
+	d.events.do(c.ID, func() {
+		if err := d.updateNickname(c.Guild); err != nil {
+			d.err(err)
+		}
+	})
 }
@@ -0,0 +1,203 @@
+package disdup
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/ejv2/disdup/cache"
+	config "github.com/ejv2/disdup/conf"
+)
+
+// fakeDiscord serves the parts of the Discord REST API used when routing
+// messages. Guild 1 contains channels 10 to 39, each holding messages with
+// IDs from 101 to 350. Messages in channels from 20 upwards all have the
+// content "skip", while the content of other messages is their ID.
+type fakeDiscord struct {
+	mu       sync.Mutex
+	requests []string // Channel and after ID of each history request
+}
+
+func (f *fakeDiscord) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "application/json")
+
+	path := strings.Split(strings.TrimPrefix(req.URL.Path, "/api/v"+discordgo.APIVersion+"/"), "/")
+	switch {
+	case len(path) == 3 && path[0] == "channels" && path[2] == "messages":
+		after, _ := strconv.Atoi(req.URL.Query().Get("after"))
+		limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+		f.mu.Lock()
+		f.requests = append(f.requests, path[1]+":"+strconv.Itoa(after))
+		f.mu.Unlock()
+
+		// Newest first, as Discord sends them
+		page := []*discordgo.Message{}
+		for id := after + limit; id > after; id-- {
+			if id > 350 {
+				continue
+			}
+			content := strconv.Itoa(id)
+			if path[1] >= "20" {
+				content = "skip"
+			}
+			page = append(page, &discordgo.Message{
+				ID:        strconv.Itoa(id),
+				ChannelID: path[1],
+				Content:   content,
+				Author:    &discordgo.User{ID: "5", Username: "user"},
+			})
+		}
+		json.NewEncoder(w).Encode(page)
+	case len(path) == 2 && path[0] == "channels":
+		json.NewEncoder(w).Encode(discordgo.Channel{ID: path[1], GuildID: "1", Name: "channel" + path[1]})
+	case len(path) == 2 && path[0] == "guilds":
+		json.NewEncoder(w).Encode(discordgo.Guild{ID: path[1], Name: "guild"})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.WriteString(`{"message": "Unknown"}`)
+	}
+
+	return w.Result(), nil
+}
+
+// testDuplicator returns a duplicator using conf which makes requests to
+// fake and is not connected to the gateway.
+func testDuplicator(t *testing.T, conf config.Config, fake *fakeDiscord) *Duplicator {
+	s, err := discordgo.New("Bot test")
+	if err != nil {
+		t.Fatal("Unexpected session error:", err)
+	}
+	s.Client = &http.Client{Transport: fake}
+	s.StateEnabled = false
+
+	d := &Duplicator{
+		conn:      s,
+		cache:     cache.NewCache(s),
+		routes:    &routes{table: conf.Compile()},
+		cerr:      make(chan error),
+		stop:      make(chan struct{}),
+		events:    &sequencer{},
+		lastPrune: &pruneClock{last: time.Now()},
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	t.Cleanup(d.cancel)
+	return d
+}
+
+func TestBackfill(t *testing.T) {
+	rec := &recorder{}
+	conf := config.Config{Guilds: make(map[string]*config.GuildConfig)}
+	conf.Guild("1")
+	conf.Use("rec", rec)
+	if err := conf.Rule(`content == "skip" -> []`); err != nil {
+		t.Fatal("Unexpected rule error:", err)
+	}
+
+	fake := &fakeDiscord{}
+	d := testDuplicator(t, conf, fake)
+	q := newQueue(d.ctx, conf.Outputs[0], nil)
+	d.routes.queues = []*queue{q}
+	q.start()
+
+	cp, _ := loadCheckpoints(filepath.Join(t.TempDir(), "checkpoints.json"))
+	cp.update("10", "200")
+	cp.update("20", "200")
+	d.checkpoints = cp
+
+	guild := &discordgo.GuildCreate{Guild: &discordgo.Guild{ID: "1", Channels: []*discordgo.Channel{
+		{ID: "10", Type: discordgo.ChannelTypeGuildText, LastMessageID: "330"},
+		{ID: "20", Type: discordgo.ChannelTypeGuildText, LastMessageID: "330"},
+		{ID: "30", Type: discordgo.ChannelTypeGuildText, LastMessageID: "330"},
+	}}}
+	d.onGuild(d.conn, guild)
+	// Nothing new since; must not page through history again
+	d.onGuild(d.conn, guild)
+	d.events.close()
+	q.close()
+
+	expect := []string{"10:200", "10:300", "20:200", "20:300"}
+	if strings.Join(fake.requests, " ") != strings.Join(expect, " ") {
+		t.Errorf("wrong history requests\nexpect: %v\ngot: %v", expect, fake.requests)
+	}
+	if len(rec.got) != 130 || rec.got[0] != 201 || rec.got[129] != 330 {
+		t.Errorf("expected messages 201 to 330 to be routed, got %v", rec.got)
+	}
+	for _, ch := range []string{"10", "20", "30"} {
+		if got, _ := cp.get(ch); got != "330" {
+			t.Errorf("wrong checkpoint for channel %s\nexpect: 330\ngot: %s", ch, got)
+		}
+	}
+}
+
+func TestPrepare_Clean(t *testing.T) {
+	conf := config.Config{Guilds: make(map[string]*config.GuildConfig)}
+	conf.Guild("1")
+	d := testDuplicator(t, conf, &fakeDiscord{})
+	d.lastPrune.last = time.Now().Add(-cache.AttachmentLifetime)
+
+	m := &discordgo.Message{ID: "101", ChannelID: "10", GuildID: "1", Author: &discordgo.User{ID: "5"}}
+	if _, _, ok := d.prepare(d.conn, m, false); !ok {
+		t.Fatal("Message not routed")
+	}
+	if time.Since(d.lastPrune.last) >= cache.AttachmentLifetime {
+		t.Error("Time of cache clean not recorded")
+	}
+}
+
+func TestAbort(t *testing.T) {
+	out := &tracker{}
+	conf := config.Config{Token: "test", Guilds: make(map[string]*config.GuildConfig)}
+	conf.Outputs = []config.OutputConfig{{Name: "out", Output: out, QueueSize: 1}}
+
+	d := testDuplicator(t, conf, &fakeDiscord{})
+	q, _ := d.newQueue(conf.Outputs[0])
+	d.routes.queues = []*queue{q}
+	q.start()
+	d.abort(true)
+
+	if out.closed != 1 || d.ctx.Err() == nil {
+		t.Error("Output not closed or writes not cancelled on abort")
+	}
+	// Queue is full and set to block, so must discard instead
+	for i := 0; i < 3; i++ {
+		q.push(record(i))
+	}
+}
+
+func TestBackfill_Rules(t *testing.T) {
+	rec := &recorder{}
+	conf := config.Config{Guilds: make(map[string]*config.GuildConfig)}
+	conf.Use("rec", rec)
+	if err := conf.Rule(`guild == "guild" -> *`); err != nil {
+		t.Fatal("Unexpected rule error:", err)
+	}
+
+	fake := &fakeDiscord{}
+	d := testDuplicator(t, conf, fake)
+	q := newQueue(d.ctx, conf.Outputs[0], nil)
+	d.routes.queues = []*queue{q}
+	q.start()
+
+	cp, _ := loadCheckpoints(filepath.Join(t.TempDir(), "checkpoints.json"))
+	cp.update("10", "320")
+	d.checkpoints = cp
+
+	d.onGuild(d.conn, &discordgo.GuildCreate{Guild: &discordgo.Guild{ID: "1", Name: "guild", Channels: []*discordgo.Channel{
+		{ID: "10", Type: discordgo.ChannelTypeGuildText, LastMessageID: "330"},
+	}}})
+	d.events.close()
+	q.close()
+
+	if len(rec.got) != 10 {
+		t.Errorf("expected guild without entry routed by rule to be backfilled, got %v", rec.got)
+	}
+}
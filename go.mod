@@ -1,10 +1,10 @@
 module github.com/ejv2/disdup
 
-go 1.19
+go 1.20
 
 require (
 	github.com/Shopify/gomail v0.0.0-20220729171026-0784ece65e69
-	github.com/bwmarrin/discordgo v0.26.1
+	github.com/bwmarrin/discordgo v0.28.1
 )
 
 require (
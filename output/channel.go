@@ -1,6 +1,7 @@
 package output
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"time"
@@ -16,6 +17,12 @@ var (
 // chanSendTimeout attempts to send on channel c, but stops after timeout has
 // elapsed. If the send succeeded, nil is returned, else ErrChanTimeout.
 func chanSendTimeout[T any](c chan T, val T, timeout time.Duration) error {
+	return chanSendContext(context.Background(), c, val, timeout)
+}
+
+// chanSendContext is identical to chanSendTimeout, but additionally stops
+// once ctx is done, returning the context's error.
+func chanSendContext[T any](ctx context.Context, c chan T, val T, timeout time.Duration) error {
 	var timeoutchan <-chan time.Time
 	if timeout == 0 {
 		timeoutchan = nil
@@ -28,6 +35,8 @@ func chanSendTimeout[T any](c chan T, val T, timeout time.Duration) error {
 		return nil
 	case <-timeoutchan:
 		return ErrChanTimeout
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
@@ -39,6 +48,17 @@ func chanSendTimeout[T any](c chan T, val T, timeout time.Duration) error {
 type Channel struct {
 	Output  chan string
 	Timeout time.Duration
+	// DisplayName is the name display mode used for authors. See the
+	// constants for documentation.
+	DisplayName int
+}
+
+// Validate returns ErrChanNil if c has no output channel.
+func (c *Channel) Validate() []error {
+	if c.Output == nil {
+		return []error{ErrChanNil}
+	}
+	return nil
 }
 
 func (c *Channel) Open(s *discordgo.Session) error {
@@ -49,8 +69,39 @@ func (c *Channel) Open(s *discordgo.Session) error {
 	return nil
 }
 
+// channelPlace formats where m was sent for Channel output, as either
+// "(guild) #channel", "(guild) #channel > thread", "(DM)" or
+// "(group DM) #name".
+func channelPlace(m Message) string {
+	if !m.IsDM() {
+		return "(" + m.GuildName + ") " + m.channelLabel()
+	}
+	if m.ChannelName == "" {
+		return "(DM)"
+	}
+	return "(group DM) #" + m.ChannelName
+}
+
 func (c *Channel) Write(m Message) {
-	out := fmt.Sprintf("@%s (%s) #%s: %s", m.Author.Username, m.GuildName, m.ChannelName, m.PrettyContent)
+	c.WriteContext(context.Background(), m)
+}
+
+// WriteContext writes m to the output channel, returning ErrChanTimeout if
+// the timeout elapses first.
+func (c *Channel) WriteContext(ctx context.Context, m Message) error {
+	out := fmt.Sprintf("@%s %s: %s", m.AuthorName(c.DisplayName), channelPlace(m), m.PrettyContent)
+	return chanSendContext(ctx, c.Output, out, c.Timeout)
+}
+
+// Edit sends the new content of an edited message, marked as such.
+func (c *Channel) Edit(m Message) {
+	out := fmt.Sprintf("@%s %s edited: %s", m.AuthorName(c.DisplayName), channelPlace(m), m.PrettyContent)
+	chanSendTimeout(c.Output, out, c.Timeout)
+}
+
+// Delete sends the last known content of a deleted message, marked as such.
+func (c *Channel) Delete(m Message) {
+	out := fmt.Sprintf("@%s %s deleted: %s", m.AuthorName(c.DisplayName), channelPlace(m), m.PrettyContent)
 	chanSendTimeout(c.Output, out, c.Timeout)
 }
 
@@ -62,13 +113,27 @@ func (c *Channel) Close() error {
 // RawChannel outputs a raw message object to the given channel, optionally
 // with a timeout. Channel closes its output channel once the output is closed.
 //
+// Edited and deleted messages are sent on the Edits and Deletes channels
+// respectively. If either is nil, those events are discarded. Both are closed
+// alongside the output channel.
+//
 // If channel is nil, Channel.Open will return an error. If TImeout is zero, no
 // timeout is enforced.
 type RawChannel struct {
 	Output  chan Message
+	Edits   chan Message
+	Deletes chan Message
 	Timeout time.Duration
 }
 
+// Validate returns ErrChanNil if r has no output channel.
+func (r *RawChannel) Validate() []error {
+	if r.Output == nil {
+		return []error{ErrChanNil}
+	}
+	return nil
+}
+
 func (r *RawChannel) Open(s *discordgo.Session) error {
 	if r.Output == nil {
 		return ErrChanNil
@@ -78,10 +143,34 @@ func (r *RawChannel) Open(s *discordgo.Session) error {
 }
 
 func (r *RawChannel) Write(m Message) {
-	chanSendTimeout(r.Output, m, r.Timeout)
+	r.WriteContext(context.Background(), m)
+}
+
+// WriteContext sends m over the output channel, returning ErrChanTimeout if
+// the timeout elapses first.
+func (r *RawChannel) WriteContext(ctx context.Context, m Message) error {
+	return chanSendContext(ctx, r.Output, m, r.Timeout)
+}
+
+func (r *RawChannel) Edit(m Message) {
+	if r.Edits != nil {
+		chanSendTimeout(r.Edits, m, r.Timeout)
+	}
+}
+
+func (r *RawChannel) Delete(m Message) {
+	if r.Deletes != nil {
+		chanSendTimeout(r.Deletes, m, r.Timeout)
+	}
 }
 
 func (r *RawChannel) Close() error {
 	close(r.Output)
+	if r.Edits != nil {
+		close(r.Edits)
+	}
+	if r.Deletes != nil {
+		close(r.Deletes)
+	}
 	return nil
 }
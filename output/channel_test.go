@@ -61,3 +61,77 @@ func TestChannel(t *testing.T) {
 	t.Run("Normal", testChannel)
 	t.Run("Timeout", testChannelTimeout)
 }
+
+func TestChannel_Edit(t *testing.T) {
+	out := output.Channel{
+		Output: make(chan string, 2),
+	}
+	out.Open(fakeSession)
+
+	out.Edit(testMessages[0])
+	out.Delete(testMessages[0])
+
+	if got, expect := <-out.Output, "@user1 (guild1) #chan1 edited: Message 1"; got != expect {
+		t.Errorf("Wrong edit from Channel\nExpect:\n%s\n\nGot:\n%s", expect, got)
+	}
+	if got, expect := <-out.Output, "@user1 (guild1) #chan1 deleted: Message 1"; got != expect {
+		t.Errorf("Wrong deletion from Channel\nExpect:\n%s\n\nGot:\n%s", expect, got)
+	}
+}
+
+func TestRawChannel_Edit(t *testing.T) {
+	out := output.RawChannel{
+		Output: make(chan output.Message, 1),
+		Edits:  make(chan output.Message, 1),
+	}
+	out.Open(fakeSession)
+
+	out.Edit(testMessages[0])
+	// No deletion channel, so should be discarded without blocking
+	out.Delete(testMessages[1])
+
+	if got := <-out.Edits; got.PrettyContent != testMessages[0].PrettyContent {
+		t.Errorf("Wrong edit from RawChannel\nExpect:\n%s\n\nGot:\n%s", testMessages[0].PrettyContent, got.PrettyContent)
+	}
+	select {
+	case <-out.Output:
+		t.Error("Edit was sent over output channel")
+	default:
+	}
+}
+
+func TestChannel_DM(t *testing.T) {
+	out := output.Channel{
+		Output: make(chan string, 2),
+	}
+	out.Open(fakeSession)
+
+	dm := testMessages[0]
+	dm.GuildName, dm.ChannelName = "", ""
+	group := dm
+	group.ChannelName = "friends"
+	out.Write(dm)
+	out.Write(group)
+
+	if got, expect := <-out.Output, "@user1 (DM): Message 1"; got != expect {
+		t.Errorf("Wrong DM from Channel\nExpect:\n%s\n\nGot:\n%s", expect, got)
+	}
+	if got, expect := <-out.Output, "@user1 (group DM) #friends: Message 1"; got != expect {
+		t.Errorf("Wrong group DM from Channel\nExpect:\n%s\n\nGot:\n%s", expect, got)
+	}
+}
+
+func TestChannel_Thread(t *testing.T) {
+	out := output.Channel{
+		Output: make(chan string, 1),
+	}
+	out.Open(fakeSession)
+
+	msg := testMessages[0]
+	msg.ChannelName, msg.ThreadName, msg.ParentName = "thread", "thread", "chan1"
+	out.Write(msg)
+
+	if got, expect := <-out.Output, "@user1 (guild1) #chan1 > thread: Message 1"; got != expect {
+		t.Errorf("Wrong thread message from Channel\nExpect:\n%s\n\nGot:\n%s", expect, got)
+	}
+}
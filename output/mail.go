@@ -1,8 +1,10 @@
 package output
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"strconv"
 	"strings"
@@ -16,12 +18,16 @@ import (
 var (
 	ErrBadServer      = errors.New("output mailer: invalid host format: expect hostname:port")
 	ErrMailConnection = errors.New("output mailer: mail server connection")
+	ErrMailSend       = errors.New("output mailer: send failed")
+	ErrMailClosed     = errors.New("output mailer: write after close")
+	ErrMailMissing    = errors.New("output mailer: missing required field")
+	ErrMailReplyMode  = errors.New("output mailer: unknown reply mode")
 )
 
 // Reply detection modes. Modes are more broad the higher their number is, with
 // MailerReplyChannel being the most broad and MailerReplyNone being the most
-// restrictive. Use of unknown modes for the replies mode will cause a panic at
-// initialization time.
+// restrictive. Use of unknown modes for the replies mode will cause a panic when
+// writing, but are reported by Mailer.Validate.
 const (
 	// No messages are detected as replies.
 	MailerReplyNone = iota
@@ -36,8 +42,9 @@ const (
 // Default configuration values for the output. Some values are set to these if
 // they are their zero values at the time that Open is called.
 const (
-	MailerDefaultSubject = "[disdup] {author} in #{channel}"
-	MailerDefaultFooter  = "This email was sent by Disdup. https://github.com/ejv2/disdup"
+	MailerDefaultSubject   = "[disdup] {author} in #{channel}"
+	MailerDefaultDMSubject = "[disdup] DM from {author}"
+	MailerDefaultFooter    = "This email was sent by Disdup. https://github.com/ejv2/disdup"
 )
 
 // Internal implementation constants.
@@ -59,24 +66,39 @@ const (
 %s
 %s`
 	messageIDDomain = "noreply.disdup.io"
+	// Subject prefixes for edit and deletion notices.
+	mailerEditPrefix   = "Edited: "
+	mailerDeletePrefix = "Deleted: "
 )
 
 // formatSubject replaces formatting options documented in the Mailer struct in
 // the SubjectFormat string.
-func formatSubject(format string, msg Message) string {
+func formatSubject(format string, msg Message, names int) string {
 	out := format
 
 	out = strings.ReplaceAll(out, "{id}", msg.Message.ID)
-	out = strings.ReplaceAll(out, "{author}", msg.Author.Username)
+	out = strings.ReplaceAll(out, "{author}", msg.AuthorName(names))
+	out = strings.ReplaceAll(out, "{username}", msg.Author.Username)
 	out = strings.ReplaceAll(out, "{guild}", msg.GuildName)
 	out = strings.ReplaceAll(out, "{guild_id}", msg.GuildID)
 	out = strings.ReplaceAll(out, "{channel}", msg.ChannelName)
 	out = strings.ReplaceAll(out, "{channel_id}", msg.ChannelID)
+	out = strings.ReplaceAll(out, "{parent}", msg.ParentName)
+	out = strings.ReplaceAll(out, "{thread}", msg.ThreadName)
 	out = strings.ReplaceAll(out, "{time}", time.Now().String())
 
 	return out
 }
 
+// subject returns the subject for msg, formatted from the format string
+// appropriate to where it was sent.
+func (m *Mailer) subject(msg Message) string {
+	if msg.IsDM() {
+		return formatSubject(m.DMSubjectFormat, msg, m.DisplayName)
+	}
+	return formatSubject(m.SubjectFormat, msg, m.DisplayName)
+}
+
 // formatRemarks enumerates possible remarks and appends to a remarks string
 // for stamping on outgoing emails. Each remark ends in a stop and a space to
 // begin the next remark.
@@ -113,6 +135,11 @@ type messageReplies struct {
 type outMessage struct {
 	orig Message
 	mail *gomail.Message
+	// Edits and deletions do not count towards reply detection.
+	update bool
+	// The result of sending the mail. Buffered, so that the runner never
+	// blocks if the sender has stopped waiting.
+	result chan error
 }
 
 // A MailServer is the basic configuration for an SMTP server connection.
@@ -166,13 +193,26 @@ type Mailer struct {
 	// prepended to the subject.
 	// Format options are as follows:
 	//  - {id}: the message snowflake id
-	//  - {author}: the username (user#tag) author of the message
+	//  - {author}: the name of the author of the message, as chosen by
+	//    DisplayName
+	//  - {username}: the username of the author of the message
 	//  - {guild}: the server name in which the message was sent
 	//  - {guild_id}: the server id in which the message was sent
 	//  - {channel}: the channel name in which the message was sent
 	//  - {channel_id}: the channel id in which the message was sent
+	//  - {parent}: the channel containing the thread in which the message
+	//    was sent, or empty if not sent in a thread
+	//  - {thread}: the thread name in which the message was sent, or empty
+	//    if not sent in a thread
 	//  - {time}: the message timestamp, formatted in standard email format
 	SubjectFormat string
+	// A format string for the subject of direct messages, with the same
+	// format options as SubjectFormat. If empty, MailerDefaultDMSubject is
+	// used.
+	DMSubjectFormat string
+	// DisplayName is the name display mode used for {author} in subjects.
+	// See the constants for documentation.
+	DisplayName int
 	// What messages shall be detected as replies and under which
 	// circumstances? See associated constants for details.
 	ReplyMode uint
@@ -196,15 +236,13 @@ type Mailer struct {
 	snd       gomail.SendCloser
 }
 
-func (m *Mailer) send(msg *gomail.Message) {
+func (m *Mailer) send(msg *gomail.Message) error {
 	var err error
 
 	if !m.connected {
 		m.snd, err = m.conn.Dial()
 		if err != nil {
-			// Drop this mail for now; retry again later
-			log.Println("email failed to send", err)
-			return
+			return fmt.Errorf("%w: %s", ErrMailConnection, err.Error())
 		}
 
 		m.connected = true
@@ -212,10 +250,13 @@ func (m *Mailer) send(msg *gomail.Message) {
 
 	err = gomail.Send(m.snd, msg)
 	if err != nil {
-		// Drop this mail for now; retry again later
-		log.Println("email failed to send", err)
-		return
+		// Connection is in an unknown state; start afresh next time
+		m.snd.Close()
+		m.connected = false
+		return fmt.Errorf("%w: %s", ErrMailSend, err.Error())
 	}
+
+	return nil
 }
 
 // run is the main runner method of this mailer. It runs until the Close()
@@ -235,15 +276,18 @@ func (m *Mailer) run() {
 		select {
 		case msg := <-m.outtray:
 			timer.Stop()
-			m.send(msg.mail)
-			m.updateReplies(msg.orig)
+			err := m.send(msg.mail)
+			if err == nil && !msg.update {
+				m.updateReplies(msg.orig)
+			}
+			msg.result <- err
 			timer.Reset(mailerReconnectionInterval)
 		case <-timer.C:
-			if !m.connected {
-				panic("mailer: disconnection interval reached while disconnected")
+			// May have already disconnected due to a failed send
+			if m.connected {
+				m.snd.Close()
+				m.connected = false
 			}
-			m.snd.Close()
-			m.connected = false
 		case <-m.cancel:
 			if m.connected {
 				m.snd.Close()
@@ -287,6 +331,28 @@ func (m *Mailer) lookupReply(msg Message) string {
 	}
 }
 
+// Validate checks that the recipient, sender and server address are set and
+// that the reply mode is known.
+func (m *Mailer) Validate() []error {
+	var errs []error
+	if m.To == "" {
+		errs = append(errs, fmt.Errorf("%w: To", ErrMailMissing))
+	}
+	if m.From == "" {
+		errs = append(errs, fmt.Errorf("%w: From", ErrMailMissing))
+	}
+	if m.Server.Address == "" {
+		errs = append(errs, fmt.Errorf("%w: Server.Address", ErrMailMissing))
+	} else if _, _, err := m.Server.AddrInfo(); err != nil {
+		errs = append(errs, fmt.Errorf("%w: %q", err, m.Server.Address))
+	}
+	if m.ReplyMode > MailerReplyChannel {
+		errs = append(errs, fmt.Errorf("%w: %d", ErrMailReplyMode, m.ReplyMode))
+	}
+
+	return errs
+}
+
 func (m *Mailer) Open(s *discordgo.Session) error {
 	m.cancel = make(chan struct{})
 	m.outtray = make(chan outMessage)
@@ -301,6 +367,9 @@ func (m *Mailer) Open(s *discordgo.Session) error {
 	if m.SubjectFormat == "" {
 		m.SubjectFormat = MailerDefaultSubject
 	}
+	if m.DMSubjectFormat == "" {
+		m.DMSubjectFormat = MailerDefaultDMSubject
+	}
 
 	m.conn = gomail.NewDialer(host, port, m.Server.Username, m.Server.Password)
 	m.conn.StartTLSPolicy = gomail.MandatoryStartTLS
@@ -318,29 +387,95 @@ func (m *Mailer) Open(s *discordgo.Session) error {
 	return nil
 }
 
-// Write formats the incoming message for email and then hands off to the
-// sender to send to the server.
-func (m *Mailer) Write(msg Message) {
+// compose formats msg as an email with the given subject, message ID and
+// remarks, ready to be sent.
+func (m *Mailer) compose(msg Message, subject, id, remarks string) *gomail.Message {
 	mail := gomail.NewMessage()
 	mail.SetHeader("To", m.To)
 	mail.SetHeader("From", m.From)
-	mail.SetHeader("Subject", formatSubject(m.SubjectFormat, msg))
-	mail.SetHeader("Message-Id", generateMessageID(msg.ID))
+	mail.SetHeader("Subject", subject)
+	mail.SetHeader("Message-Id", generateMessageID(id))
 	for hdr, val := range m.CustomHeaders {
 		mail.SetHeader(hdr, val)
 	}
 
-	mail.SetBody("text/plain", fmt.Sprintf(mailerBodyFormat, m.Preamble, msg.PrettyContent, formatRemarks(msg), m.Footer))
+	mail.SetBody("text/plain", fmt.Sprintf(mailerBodyFormat, m.Preamble, msg.PrettyContent, remarks, m.Footer))
+	return mail
+}
 
-	for i, att := range msg.Downloads {
-		mail.AttachReader(att.Filename, &msg.Downloads[i])
+// Write formats the incoming message for email and then hands off to the
+// sender to send to the server. Failures are logged.
+func (m *Mailer) Write(msg Message) {
+	if err := m.WriteContext(context.Background(), msg); err != nil {
+		log.Println("email failed to send", err)
+	}
+}
+
+// WriteContext formats the incoming message for email and then waits for
+// the sender to send it to the server, returning any error in doing so.
+func (m *Mailer) WriteContext(ctx context.Context, msg Message) error {
+	mail := m.compose(msg, m.subject(msg), msg.ID, formatRemarks(msg))
+
+	// Attachments are read afresh for each attempt to send, as large
+	// attachments are streamed from disk
+	for _, att := range msg.Downloads {
+		att := att
+		mail.Attach(att.Filename, gomail.SetCopyFunc(func(w io.Writer) error {
+			_, err := att.WriteTo(w)
+			return err
+		}))
 	}
 
 	if reply := m.lookupReply(msg); reply != "" {
 		mail.SetHeader("In-Reply-To", generateMessageID(reply))
 	}
 
-	m.outtray <- outMessage{msg, mail}
+	return m.post(ctx, outMessage{orig: msg, mail: mail})
+}
+
+// Edit sends the new content of an edited message as a reply to the mail for
+// the original message. Edits do not affect reply detection.
+func (m *Mailer) Edit(msg Message) {
+	m.update(msg, mailerEditPrefix, "This message was edited. "+formatRemarks(msg))
+}
+
+// Delete sends a notice of a message's deletion as a reply to the mail for
+// the original message, including the last known content. Deletions do not
+// affect reply detection.
+func (m *Mailer) Delete(msg Message) {
+	m.update(msg, mailerDeletePrefix, "This message was deleted. "+formatRemarks(msg))
+}
+
+// update sends an email describing an update to an existing message, threaded
+// as a reply to the original message.
+func (m *Mailer) update(msg Message, prefix, remarks string) {
+	id := msg.ID + "." + strconv.FormatInt(time.Now().UnixNano(), 36)
+	mail := m.compose(msg, prefix+m.subject(msg), id, remarks)
+	mail.SetHeader("In-Reply-To", generateMessageID(msg.ID))
+
+	if err := m.post(context.Background(), outMessage{orig: msg, mail: mail, update: true}); err != nil {
+		log.Println("email failed to send", err)
+	}
+}
+
+// post hands out to the sender and waits for it to be sent.
+func (m *Mailer) post(ctx context.Context, out outMessage) error {
+	out.result = make(chan error, 1)
+
+	select {
+	case m.outtray <- out:
+	case <-m.cancel:
+		return ErrMailClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-out.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (m *Mailer) Close() error {
@@ -46,3 +46,29 @@ func TestAddrParsing(t *testing.T) {
 		}
 	}
 }
+
+func TestMailer_Validate(t *testing.T) {
+	valid := output.Mailer{
+		To:     "to@example.com",
+		From:   "from@example.com",
+		Server: output.MailServer{Address: "smtp.example.com:587"},
+	}
+	if errs := valid.Validate(); len(errs) != 0 {
+		t.Error("Unexpected errors from valid mailer:", errs)
+	}
+
+	invalid := output.Mailer{
+		Server:    output.MailServer{Address: "smtp.example.com"},
+		ReplyMode: output.MailerReplyChannel + 1,
+	}
+	errs := invalid.Validate()
+	expect := []error{output.ErrMailMissing, output.ErrMailMissing, output.ErrBadServer, output.ErrMailReplyMode}
+	if len(errs) != len(expect) {
+		t.Fatalf("expected %d errors, got %d: %v", len(expect), len(errs), errs)
+	}
+	for i := range errs {
+		if !errors.Is(errs[i], expect[i]) {
+			t.Errorf("wrong error %d\nexpect: %s\ngot: %s", i, expect[i], errs[i])
+		}
+	}
+}
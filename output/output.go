@@ -5,7 +5,11 @@
 package output
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"io"
+	"os"
 
 	"github.com/bwmarrin/discordgo"
 )
@@ -18,24 +22,199 @@ type Message struct {
 	PrettyContent string
 	ChannelName   string
 	GuildName     string
-	Downloads     []Attachment
+	// ParentName is the name of the channel containing the thread or forum
+	// post in which the message was sent. Empty if not sent in a thread.
+	ParentName string
+	// ThreadName is the name of the thread or forum post in which the
+	// message was sent, which is also the ChannelName. Empty if not sent in
+	// a thread.
+	ThreadName string
+	// AuthorNick is the nickname of the author in the guild in which the
+	// message was sent, if known. Empty for direct messages and authors
+	// without a nickname.
+	AuthorNick string
+	Downloads  []Attachment
+}
+
+// Name display modes, which choose the name by which outputs show the author
+// of a message. Unknown modes are treated as NameUsername.
+const (
+	// Show the unique username of the author. Users who have not moved to
+	// the new username system, such as some bots, are shown as "name#tag".
+	NameUsername = iota
+	// Show the global display name of the author, falling back to their
+	// username if they have none.
+	NameGlobal
+	// Show the nickname of the author in the guild, falling back to their
+	// global display name, then their username.
+	NameNick
+)
+
+// AuthorName returns the name of the author of m to display under the given
+// name display mode.
+func (m Message) AuthorName(mode int) string {
+	if m.Message == nil || m.Author == nil {
+		return ""
+	}
+
+	if mode == NameNick && m.AuthorNick != "" {
+		return m.AuthorNick
+	}
+	if (mode == NameNick || mode == NameGlobal) && m.Author.GlobalName != "" {
+		return m.Author.GlobalName
+	}
+	// Migrated users have a discriminator of "0"
+	if d := m.Author.Discriminator; d != "" && d != "0" {
+		return m.Author.Username + "#" + d
+	}
+	return m.Author.Username
+}
+
+// IsDM returns true if m is a direct message or group DM, rather than a
+// message sent in a guild. Messages with either a guild ID or guild name are
+// always guild messages.
+func (m Message) IsDM() bool {
+	return m.GuildName == "" && (m.Message == nil || m.GuildID == "")
+}
+
+// IsThread returns true if m was sent in a thread or forum post.
+func (m Message) IsThread() bool {
+	return m.ThreadName != ""
+}
+
+// channelLabel returns "#channel" for messages sent in a channel, or
+// "#parent > thread" for messages sent in a thread.
+func (m Message) channelLabel() string {
+	if m.IsThread() {
+		return "#" + m.ParentName + " > " + m.ThreadName
+	}
+	return "#" + m.ChannelName
+}
+
+// Location returns a short, human readable description of where m was sent.
+// This is "Guild #channel" for guild messages, "Guild #channel > thread" for
+// messages in threads, "DM" for direct messages and "group DM #name" for named
+// group DMs.
+func (m Message) Location() string {
+	if !m.IsDM() {
+		return m.GuildName + " " + m.channelLabel()
+	}
+	if m.ChannelName == "" {
+		return "DM"
+	}
+	return "group DM #" + m.ChannelName
+}
+
+// messageJSON is the JSON encoding of a Message. The discord message is kept
+// in its own key, as it has JSON methods of its own which would otherwise be
+// promoted to Message.
+type messageJSON struct {
+	Message       *discordgo.Message `json:"message"`
+	PrettyContent string             `json:"pretty_content"`
+	ChannelName   string             `json:"channel_name"`
+	GuildName     string             `json:"guild_name"`
+	ParentName    string             `json:"parent_name,omitempty"`
+	ThreadName    string             `json:"thread_name,omitempty"`
+	AuthorNick    string             `json:"author_nick,omitempty"`
+	Downloads     []Attachment       `json:"downloads,omitempty"`
+}
+
+// MarshalJSON encodes m as JSON, including the content of any downloads held
+// in memory. Downloads on disk are encoded by path; see Attachment.MarshalJSON.
+func (m Message) MarshalJSON() ([]byte, error) {
+	return json.Marshal(messageJSON{
+		Message:       m.Message,
+		PrettyContent: m.PrettyContent,
+		ChannelName:   m.ChannelName,
+		GuildName:     m.GuildName,
+		ParentName:    m.ParentName,
+		ThreadName:    m.ThreadName,
+		AuthorNick:    m.AuthorNick,
+		Downloads:     m.Downloads,
+	})
+}
+
+// UnmarshalJSON decodes a message encoded by MarshalJSON.
+func (m *Message) UnmarshalJSON(b []byte) error {
+	var v messageJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	*m = Message{
+		Message:       v.Message,
+		PrettyContent: v.PrettyContent,
+		ChannelName:   v.ChannelName,
+		GuildName:     v.GuildName,
+		ParentName:    v.ParentName,
+		ThreadName:    v.ThreadName,
+		AuthorNick:    v.AuthorNick,
+		Downloads:     v.Downloads,
+	}
+	return nil
 }
 
 // An Attachment is an attachment embedded in a message and downloaded
-// beforehand. It should not be modified under any circumstances, as the slice
-// points to the cached copy of the data.
+// beforehand. Small attachments are held in memory, while the content of large
+// attachments is streamed from a file on disk when read. It should not be
+// modified under any circumstances, as the content is shared with the cache
+// and other outputs.
+//
+// Files on disk are kept until the message has been written, after which they
+// are removed once the attachment is evicted from the cache, so outputs should
+// not keep Path for later, unless the persistent attachment store is enabled,
+// in which case Path is stable and may be kept for later reference.
 type Attachment struct {
-	Filename, Type string
-	Content        []byte
+	Filename string `json:"filename"`
+	Type     string `json:"type"`
+	// Size is the size of the content in bytes.
+	Size int64 `json:"size"`
+	// Content is the content of the attachment if held in memory, else
+	// nil.
+	Content []byte `json:"content"`
+	// Path is the file holding the content of the attachment, if it is on
+	// disk. Attachments in the persistent attachment store have both
+	// Content, if small, and a stable Path, which remains valid until
+	// removed by the retention policy of the store.
+	Path string `json:"path,omitempty"`
+	// Hash is the hex encoded SHA-256 hash of the content, if known.
+	Hash string `json:"hash,omitempty"`
 
 	// Reader state.
 	read int
+	file *os.File
+}
+
+// Open returns a reader for the content of a, which must be closed once
+// finished with. Each reader is independent of any other, so Open may be used
+// concurrently.
+func (a Attachment) Open() (io.ReadCloser, error) {
+	if a.Content != nil || a.Path == "" {
+		return io.NopCloser(bytes.NewReader(a.Content)), nil
+	}
+	return os.Open(a.Path)
 }
 
-// Read reads content into buffer p up to len(p). Returns EOF once a.Content is
-// exhausted. Not safe for concurrent use, as an internal read head offset is
-// used.
+// WriteTo writes the content of a to w, returning the number of bytes
+// written. It may be used concurrently.
+func (a Attachment) WriteTo(w io.Writer) (int64, error) {
+	r, err := a.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	return io.Copy(w, r)
+}
+
+// Read reads content into buffer p up to len(p). Returns EOF once the content
+// is exhausted, after which reading starts again from the beginning. Not safe
+// for concurrent use, as an internal read head offset is used; see Open.
 func (a *Attachment) Read(p []byte) (n int, err error) {
+	if a.Content == nil && a.Path != "" {
+		return a.readFile(p)
+	}
+
 	if a.read >= len(a.Content) {
 		a.read = 0
 		return 0, io.EOF
@@ -46,6 +225,36 @@ func (a *Attachment) Read(p []byte) (n int, err error) {
 	return i, nil
 }
 
+// readFile implements Read for attachments on disk, opening the file on the
+// first read and closing it at EOF or on error.
+func (a *Attachment) readFile(p []byte) (n int, err error) {
+	if a.file == nil {
+		if a.file, err = os.Open(a.Path); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err = a.file.Read(p)
+	if err != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	return n, err
+}
+
+// MarshalJSON encodes a as JSON. The content of attachments on disk is not
+// included, only their Path, so the file must still exist when the attachment
+// is decoded and read.
+func (a Attachment) MarshalJSON() ([]byte, error) {
+	// Avoid recursing into this method
+	type attachment Attachment
+
+	if a.Path != "" {
+		a.Content = nil
+	}
+	return json.Marshal(attachment(a))
+}
+
 // An Output is a destination for messages from Disdup. It has a very similar
 // interface to os.File and io.ReadCloser, mainly for familiarity with existing
 // APIs.
@@ -57,9 +266,10 @@ func (a *Attachment) Read(p []byte) (n int, err error) {
 //
 // Write is called whenever a matching incoming message event is received. For
 // more information on available information, see the documentation for the
-// Message struct. You are free to do any operation in Write, but it is best
-// not to block for too long. as no new message events can be processed until
-// all outputs for the current one have completed.
+// Message struct. Messages are written to each output one at a time and in
+// the order received. You are free to do any operation in Write, but it is
+// best not to block for too long, as further messages queue up behind the
+// current one until Write returns.
 //
 // Close is called exactly once upon the dropping of the output by disdup. If
 // it throws an error, the rest of the close callbacks will be called before
@@ -69,3 +279,70 @@ type Output interface {
 	Write(m Message)
 	Close() error
 }
+
+// An Editor is an Output which can also be notified of edits to messages.
+// Edit is called with the new content of a message which matched the config
+// when edited. The message has not necessarily been passed to Write before,
+// as it may have been sent before disdup started. Edit has the same blocking
+// considerations as Write.
+type Editor interface {
+	Output
+	Edit(m Message)
+}
+
+// A Deleter is an Output which can also be notified of deleted messages.
+// Delete is called with the last known version of the message. If the
+// message is not known to disdup, only the ID, ChannelID and GuildID of the
+// message are set, the content is empty and the author is the empty user.
+// Delete has the same blocking considerations as Write.
+type Deleter interface {
+	Output
+	Delete(m Message)
+}
+
+// A Validator is an Output which can check its configuration before it is
+// opened, such that mistakes are reported before disdup connects to Discord.
+// Validate returns every problem found, or nil if there are none. It must not
+// have side effects.
+type Validator interface {
+	Output
+	Validate() []error
+}
+
+// A ContextOutput is an output whose writes may fail or be cancelled. It is
+// otherwise identical to Output.
+//
+// WriteContext should return promptly once ctx is done, returning the
+// context's error. Any other error returned is reported to the client code
+// and indicates that the message was not written.
+type ContextOutput interface {
+	Open(s *discordgo.Session) error
+	WriteContext(ctx context.Context, m Message) error
+	Close() error
+}
+
+// WithContext adapts o for use as a ContextOutput. If o already implements
+// ContextOutput, it is returned unchanged. Otherwise, writes are passed to
+// o.Write, which is assumed always to succeed, unless ctx is already done.
+func WithContext(o Output) ContextOutput {
+	if co, ok := o.(ContextOutput); ok {
+		return co
+	}
+
+	return contextAdapter{o}
+}
+
+// contextAdapter is the ContextOutput returned by WithContext for outputs
+// with no native support.
+type contextAdapter struct {
+	Output
+}
+
+func (c contextAdapter) WriteContext(ctx context.Context, m Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.Write(m)
+	return nil
+}
@@ -2,7 +2,11 @@ package output_test
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"io"
+	"os"
+	"path/filepath"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/ejv2/disdup/output"
@@ -89,6 +93,16 @@ func (w *WriteNopCloser) Close() error {
 	return nil
 }
 
+// spilledAttachment returns an attachment whose content is read from a file
+// containing content.
+func spilledAttachment(t *testing.T, content string) output.Attachment {
+	path := filepath.Join(t.TempDir(), "attachment")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal("Unexpected error writing attachment:", err)
+	}
+	return output.Attachment{Filename: "a.txt", Size: int64(len(content)), Path: path}
+}
+
 func TestAttachment_Read(t *testing.T) {
 	cases := []struct {
 		A output.Attachment
@@ -97,6 +111,8 @@ func TestAttachment_Read(t *testing.T) {
 	}{
 		{output.Attachment{Content: []byte("testing string 1234")}, "testing string 1234"},
 		{output.Attachment{Content: []byte("")}, ""},
+		{spilledAttachment(t, "testing file 1234"), "testing file 1234"},
+		{spilledAttachment(t, ""), ""},
 	}
 
 	for _, c := range cases {
@@ -127,5 +143,86 @@ func TestAttachment_Read(t *testing.T) {
 		if b.String() != c.Expect {
 			t.Errorf("unexpected output from io.Copy\nexpect: %s\ngot: %s", c.Expect, b.String())
 		}
+
+		// Readers from Open are independent of the above
+		r, err := c.A.Open()
+		if err != nil {
+			t.Fatalf("unexpected error from Open: %s", err.Error())
+		}
+		out3, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || string(out3) != c.Expect {
+			t.Errorf("unexpected output from Open\nexpect: %s\ngot: %s (%v)", c.Expect, string(out3), err)
+		}
+	}
+}
+
+func TestAttachment_Missing(t *testing.T) {
+	a := spilledAttachment(t, "gone")
+	os.Remove(a.Path)
+
+	if _, err := io.ReadAll(&a); !errors.Is(err, os.ErrNotExist) {
+		t.Error("Expected error reading removed attachment, got", err)
+	}
+}
+
+func TestMessage_JSON(t *testing.T) {
+	msg := testMessages[0]
+	msg.ThreadName, msg.ParentName = "thread", "chan1"
+	msg.Downloads = []output.Attachment{
+		{Filename: "a.txt", Type: "text/plain", Content: []byte("hello")},
+		spilledAttachment(t, "hello from disk"),
+	}
+
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal("Unexpected marshal error:", err)
+	}
+	var got output.Message
+	if err := json.Unmarshal(buf, &got); err != nil {
+		t.Fatal("Unexpected unmarshal error:", err)
+	}
+
+	if got.Location() != msg.Location() || got.PrettyContent != msg.PrettyContent || got.Author.ID != msg.Author.ID {
+		t.Errorf("Message changed by JSON round trip\nExpect:\n%s: %s\n\nGot:\n%s: %s", msg.Location(), msg.PrettyContent, got.Location(), got.PrettyContent)
+	}
+	if len(got.Downloads) != 2 || !bytes.Equal(got.Downloads[0].Content, msg.Downloads[0].Content) {
+		t.Error("Downloads changed by JSON round trip")
+	}
+	// Content on disk is referred to by path
+	if d := got.Downloads[1]; d.Content != nil || d.Path != msg.Downloads[1].Path || d.Size != 15 {
+		t.Errorf("Spilled download changed by JSON round trip: %q (path %q, size %d)", d.Content, d.Path, d.Size)
+	}
+	if bytes.Contains(buf, []byte("hello from disk")) {
+		t.Error("Content on disk included in JSON")
+	}
+}
+
+func TestMessage_AuthorName(t *testing.T) {
+	cases := []struct {
+		Name   string
+		User   discordgo.User
+		Nick   string
+		Mode   int
+		Expect string
+	}{
+		{"Username", discordgo.User{Username: "ethan", GlobalName: "Ethan"}, "Boss", output.NameUsername, "ethan"},
+		{"Legacy tag", discordgo.User{Username: "bot", Discriminator: "1234"}, "", output.NameUsername, "bot#1234"},
+		{"Migrated tag", discordgo.User{Username: "ethan", Discriminator: "0"}, "", output.NameUsername, "ethan"},
+		{"Global name", discordgo.User{Username: "ethan", GlobalName: "Ethan"}, "Boss", output.NameGlobal, "Ethan"},
+		{"Global name fallback", discordgo.User{Username: "ethan"}, "Boss", output.NameGlobal, "ethan"},
+		{"Nickname", discordgo.User{Username: "ethan", GlobalName: "Ethan"}, "Boss", output.NameNick, "Boss"},
+		{"Nickname fallback", discordgo.User{Username: "ethan", GlobalName: "Ethan"}, "", output.NameNick, "Ethan"},
+		{"Unknown mode", discordgo.User{Username: "ethan", GlobalName: "Ethan"}, "Boss", 42, "ethan"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			user := c.User
+			msg := output.Message{Message: &discordgo.Message{Author: &user}, AuthorNick: c.Nick}
+			if got := msg.AuthorName(c.Mode); got != c.Expect {
+				t.Errorf("expected %q, got %q", c.Expect, got)
+			}
+		})
 	}
 }
@@ -0,0 +1,228 @@
+package output
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Retry errors.
+var (
+	ErrRetryNil       = errors.New("output retry: nil output")
+	ErrRetryExhausted = errors.New("output retry: attempts exhausted")
+	ErrDeadLettered   = errors.New("output retry: written to dead letter")
+	ErrRetryCycle     = errors.New("output retry: dead letters form a cycle")
+)
+
+// Default configuration values for Retry. Some values are set to these if
+// they are their zero values at the time that Open is called.
+const (
+	RetryDefaultAttempts   = 5
+	RetryDefaultBackoff    = time.Second
+	RetryDefaultMaxBackoff = 5 * time.Minute
+	RetryDefaultMultiplier = 2
+)
+
+// Retry wraps another output, retrying failed writes with exponential backoff.
+// Messages which still fail after the maximum number of attempts are written
+// to a dead letter output, if one is set, and an error is returned saying
+// whether they were.
+//
+// Only writes can fail, so edits and deletions are passed straight through to
+// the wrapped output, if it supports them. Retries are made in the goroutine
+// calling Write or WriteContext, so the wrapped output receives no further
+// messages until the current message is written or abandoned.
+//
+// If Output is nil, Retry.Open returns ErrRetryNil.
+type Retry struct {
+	// Output is the wrapped output.
+	Output Output
+	// MaxAttempts is the maximum number of times a message is written,
+	// including the first attempt. If zero, RetryDefaultAttempts is used.
+	MaxAttempts int
+	// Backoff is the delay before the first retry. If zero,
+	// RetryDefaultBackoff is used.
+	Backoff time.Duration
+	// MaxBackoff is the maximum delay between two attempts. If zero,
+	// RetryDefaultMaxBackoff is used.
+	MaxBackoff time.Duration
+	// Multiplier is the factor by which the delay grows after each retry.
+	// If less than one, RetryDefaultMultiplier is used.
+	Multiplier float64
+	// Jitter is the fraction of each delay which is randomised, between
+	// zero and one. For instance, a jitter of 0.2 makes each delay up to
+	// 20% longer or shorter.
+	Jitter float64
+	// DeadLetter receives messages which exhaust all their attempts. If
+	// nil, such messages are dropped. The dead letter output is written to
+	// from the same goroutine as the wrapped output, so must be safe for
+	// concurrent use if it is also used elsewhere.
+	DeadLetter Output
+	// OwnDeadLetter causes DeadLetter to be opened and closed alongside
+	// the wrapped output. This must be set if the dead letter output is not
+	// otherwise opened, such as if it is not registered with disdup.
+	OwnDeadLetter bool
+}
+
+// Validate returns ErrRetryNil if r has no output, or ErrRetryCycle if
+// following the dead letters of r leads back to an output already passed.
+// Otherwise, the problems with the wrapped output are returned, alongside those
+// with the dead letter output if it is owned by r. Dead letter outputs which
+// are not owned are expected to be validated on their own.
+func (r *Retry) Validate() []error {
+	if r.Output == nil {
+		return []error{ErrRetryNil}
+	}
+	if r.cycles() {
+		return []error{ErrRetryCycle}
+	}
+
+	var errs []error
+	if v, ok := r.Output.(Validator); ok {
+		errs = append(errs, v.Validate()...)
+	}
+	if v, ok := r.DeadLetter.(Validator); ok && r.OwnDeadLetter {
+		for _, err := range v.Validate() {
+			errs = append(errs, fmt.Errorf("dead letter: %w", err))
+		}
+	}
+	return errs
+}
+
+// cycles returns true if following the dead letters of r, through any further
+// Retry outputs, leads back to one already passed.
+func (r *Retry) cycles() bool {
+	seen := make(map[*Retry]bool)
+	for r != nil {
+		if seen[r] {
+			return true
+		}
+		seen[r] = true
+		r, _ = r.DeadLetter.(*Retry)
+	}
+	return false
+}
+
+func (r *Retry) Open(s *discordgo.Session) error {
+	if r.Output == nil {
+		return ErrRetryNil
+	}
+	if r.MaxAttempts == 0 {
+		r.MaxAttempts = RetryDefaultAttempts
+	}
+	if r.Backoff == 0 {
+		r.Backoff = RetryDefaultBackoff
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = RetryDefaultMaxBackoff
+	}
+	if r.Multiplier < 1 {
+		r.Multiplier = RetryDefaultMultiplier
+	}
+
+	if err := r.Output.Open(s); err != nil {
+		return err
+	}
+	if r.DeadLetter != nil && r.OwnDeadLetter {
+		return r.DeadLetter.Open(s)
+	}
+
+	return nil
+}
+
+// Write writes m to the wrapped output, retrying on failure. Failures are
+// logged.
+func (r *Retry) Write(m Message) {
+	if err := r.WriteContext(context.Background(), m); err != nil {
+		log.Println(err)
+	}
+}
+
+// WriteContext writes m to the wrapped output, retrying on failure. If all
+// attempts fail, m is written to the dead letter output and an error wrapping
+// ErrDeadLettered is returned, such that the caller knows m was not lost. If
+// there is no dead letter output or it also fails, an error wrapping
+// ErrRetryExhausted is returned instead. If ctx is done first, the context's
+// error is returned and m is not dead lettered.
+func (r *Retry) WriteContext(ctx context.Context, m Message) error {
+	out := WithContext(r.Output)
+	delay := r.Backoff
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = out.WriteContext(ctx, m)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt >= r.MaxAttempts {
+			break
+		}
+
+		timer := time.NewTimer(r.jitter(delay))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+
+		delay = time.Duration(float64(delay) * r.Multiplier)
+		if delay > r.MaxBackoff {
+			delay = r.MaxBackoff
+		}
+	}
+
+	if r.DeadLetter == nil {
+		return fmt.Errorf("%w: %d attempts: %s", ErrRetryExhausted, r.MaxAttempts, err.Error())
+	}
+	if dlerr := WithContext(r.DeadLetter).WriteContext(ctx, m); dlerr != nil {
+		return fmt.Errorf("%w: %d attempts: %s (dead letter failed: %s)", ErrRetryExhausted, r.MaxAttempts, err.Error(), dlerr.Error())
+	}
+	return fmt.Errorf("%w: %d attempts: %s", ErrDeadLettered, r.MaxAttempts, err.Error())
+}
+
+// jitter randomises delay by up to the configured jitter fraction.
+func (r *Retry) jitter(delay time.Duration) time.Duration {
+	if r.Jitter <= 0 {
+		return delay
+	}
+
+	j := r.Jitter
+	if j > 1 {
+		j = 1
+	}
+	return time.Duration(float64(delay) * (1 + j*(2*rand.Float64()-1)))
+}
+
+// Edit passes the edit to the wrapped output, if supported.
+func (r *Retry) Edit(m Message) {
+	if e, ok := r.Output.(Editor); ok {
+		e.Edit(m)
+	}
+}
+
+// Delete passes the deletion to the wrapped output, if supported.
+func (r *Retry) Delete(m Message) {
+	if d, ok := r.Output.(Deleter); ok {
+		d.Delete(m)
+	}
+}
+
+func (r *Retry) Close() error {
+	err := r.Output.Close()
+	if r.DeadLetter != nil && r.OwnDeadLetter {
+		if dlerr := r.DeadLetter.Close(); err == nil {
+			err = dlerr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,131 @@
+package output_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/ejv2/disdup/output"
+)
+
+var errFlaky = errors.New("flaky output failed")
+
+// FlakyOutput fails the first Failures writes made to it.
+type FlakyOutput struct {
+	Failures int
+	Attempts int
+	Written  []output.Message
+}
+
+func (f *FlakyOutput) Open(s *discordgo.Session) error { return nil }
+func (f *FlakyOutput) Write(m output.Message)          { f.WriteContext(context.Background(), m) }
+func (f *FlakyOutput) Close() error                    { return nil }
+
+func (f *FlakyOutput) WriteContext(ctx context.Context, m output.Message) error {
+	f.Attempts++
+	if f.Attempts <= f.Failures {
+		return errFlaky
+	}
+
+	f.Written = append(f.Written, m)
+	return nil
+}
+
+func TestRetry_WriteContext(t *testing.T) {
+	cases := []struct {
+		Name       string
+		Failures   int
+		DeadFails  int
+		ExpectErr  error
+		ExpectDead int
+	}{
+		{"Success", 0, 0, nil, 0},
+		{"Retried", 2, 0, nil, 0},
+		{"DeadLettered", 3, 0, output.ErrDeadLettered, 1},
+		{"Exhausted", 3, 1, output.ErrRetryExhausted, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			flaky := &FlakyOutput{Failures: c.Failures}
+			dead := &FlakyOutput{Failures: c.DeadFails}
+			r := &output.Retry{
+				Output:        flaky,
+				MaxAttempts:   3,
+				Backoff:       time.Millisecond,
+				Jitter:        0.5,
+				DeadLetter:    dead,
+				OwnDeadLetter: true,
+			}
+			if err := r.Open(fakeSession); err != nil {
+				t.Fatal("Unexpected open error:", err)
+			}
+			defer r.Close()
+
+			err := r.WriteContext(context.Background(), testMessages[0])
+			if c.ExpectErr == nil && err != nil {
+				t.Errorf("unexpected error: %s", err.Error())
+			} else if !errors.Is(err, c.ExpectErr) {
+				t.Errorf("wrong error\nexpect: %v\ngot: %v", c.ExpectErr, err)
+			}
+			if len(dead.Written) != c.ExpectDead {
+				t.Errorf("expected %d dead letters, got %d", c.ExpectDead, len(dead.Written))
+			}
+		})
+	}
+}
+
+func TestRetry_Cancel(t *testing.T) {
+	flaky := &FlakyOutput{Failures: 100}
+	dead := &FlakyOutput{}
+	r := &output.Retry{
+		Output:      flaky,
+		MaxAttempts: 100,
+		Backoff:     time.Hour,
+		DeadLetter:  dead,
+	}
+	r.Open(fakeSession)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := r.WriteContext(ctx, testMessages[0])
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wrong error\nexpect: %v\ngot: %v", context.DeadlineExceeded, err)
+	}
+	if flaky.Attempts != 1 {
+		t.Errorf("expected 1 attempt before cancellation, got %d", flaky.Attempts)
+	}
+	if len(dead.Written) != 0 {
+		t.Error("cancelled message was dead lettered")
+	}
+}
+
+func TestRetry_Validate(t *testing.T) {
+	if errs := (&output.Retry{}).Validate(); len(errs) != 1 || !errors.Is(errs[0], output.ErrRetryNil) {
+		t.Error("Expected ErrRetryNil, got", errs)
+	}
+
+	r := &output.Retry{Output: &output.Channel{}, DeadLetter: &output.Writer{}, OwnDeadLetter: true}
+	errs := r.Validate()
+	if len(errs) != 2 || !errors.Is(errs[0], output.ErrChanNil) || !errors.Is(errs[1], output.ErrNilOutput) {
+		t.Error("Expected problems of wrapped and dead letter outputs, got", errs)
+	}
+
+	// Validated on its own if not owned
+	r.OwnDeadLetter = false
+	if errs := r.Validate(); len(errs) != 1 {
+		t.Error("Expected only problems of wrapped output, got", errs)
+	}
+
+	a := &output.Retry{Output: &output.Channel{Output: make(chan string)}}
+	b := &output.Retry{Output: &output.Channel{Output: make(chan string)}, DeadLetter: a, OwnDeadLetter: true}
+	a.DeadLetter, a.OwnDeadLetter = b, true
+	for _, r := range []*output.Retry{a, b} {
+		if errs := r.Validate(); len(errs) != 1 || !errors.Is(errs[0], output.ErrRetryCycle) {
+			t.Error("Expected ErrRetryCycle, got", errs)
+		}
+	}
+}
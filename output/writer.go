@@ -5,6 +5,7 @@ import (
 	"io"
 	"log"
 	"strings"
+	"sync"
 
 	"github.com/bwmarrin/discordgo"
 )
@@ -34,17 +35,33 @@ var (
 //
 // If collate is non-zero, it is a bitwise combination of one or more collation
 // flags. See collation flags documentation for use.
+//
+// Writer methods are safe for concurrent use, although messages written
+// concurrently may not be collated as expected.
 type Writer struct {
 	Output io.WriteCloser
 	// Prefix will be prepended to each message log.
 	Prefix string
 	// Collate mode. See constants for documentation.
 	Collate int
-	lg      *log.Logger
+	// DisplayName is the name display mode used for authors. See the
+	// constants for documentation.
+	DisplayName int
+	lg          *log.Logger
 	// ID of the last author
 	lastAuthor string
 	// Id of the last sent channel
 	lastChannel string
+	// Guards the above collation state
+	mu sync.Mutex
+}
+
+// Validate returns ErrNilOutput if w has no output.
+func (w *Writer) Validate() []error {
+	if w.Output == nil {
+		return []error{ErrNilOutput}
+	}
+	return nil
 }
 
 func (w *Writer) Open(s *discordgo.Session) error {
@@ -67,29 +84,68 @@ func (w *Writer) Write(m Message) {
 	if w.lg == nil {
 		panic(ErrNotOpen)
 	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
 	if w.Collate >= WriterCollateChannel {
-		if m.ChannelID != w.lastChannel {
-			msg := "\n" + m.GuildName + " #" + m.ChannelName + ":\n"
-			w.Output.Write([]byte(msg))
-		}
+		w.header(m)
 
 		if w.Collate >= WriterCollateUser && m.Author.ID == w.lastAuthor && m.ChannelID == w.lastChannel {
 			// Length of username plus three characters padding for alignment
 			// This must be updated if output format changes!
-			pref := strings.Repeat(" ", len([]rune(m.Author.String()))+2)
+			pref := strings.Repeat(" ", len([]rune(m.AuthorName(w.DisplayName)))+2)
 			w.lg.Printf("%s%s", pref, m.PrettyContent)
 		} else {
-			w.lg.Printf("%s: %s", m.Author, m.PrettyContent)
+			w.lg.Printf("%s: %s", m.AuthorName(w.DisplayName), m.PrettyContent)
 		}
 	} else {
-		w.lg.Printf("%s (%s #%s): %s", m.Author, m.GuildName, m.ChannelName, m.PrettyContent)
+		w.lg.Printf("%s (%s): %s", m.AuthorName(w.DisplayName), m.Location(), m.PrettyContent)
 	}
 
 	w.lastAuthor = m.Author.ID
 	w.lastChannel = m.ChannelID
 }
 
+// Edit logs the new content of an edited message. Edits are collated by
+// channel, but are never collated by user.
+func (w *Writer) Edit(m Message) {
+	w.event(m, "edited: "+m.PrettyContent)
+}
+
+// Delete logs the deletion of a message.
+func (w *Writer) Delete(m Message) {
+	w.event(m, "deleted message "+m.ID)
+}
+
+// event logs an event which happened to message m, described by what.
+func (w *Writer) event(m Message, what string) {
+	if w.lg == nil {
+		panic(ErrNotOpen)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.Collate >= WriterCollateChannel {
+		w.header(m)
+		w.lg.Printf("%s %s", m.AuthorName(w.DisplayName), what)
+	} else {
+		w.lg.Printf("%s (%s) %s", m.AuthorName(w.DisplayName), m.Location(), what)
+	}
+
+	// Next message by this author should be written in full
+	w.lastAuthor = ""
+	w.lastChannel = m.ChannelID
+}
+
+// header writes the channel collation header if m was sent in a different
+// channel to the last message.
+func (w *Writer) header(m Message) {
+	if m.ChannelID != w.lastChannel {
+		msg := "\n" + m.Location() + ":\n"
+		w.Output.Write([]byte(msg))
+	}
+}
+
 func (w *Writer) Close() error {
 	w.lg.Println("disdup log closing")
 	return w.Output.Close()
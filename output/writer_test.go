@@ -4,6 +4,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/bwmarrin/discordgo"
 	"github.com/ejv2/disdup/output"
 
 	"testing"
@@ -11,56 +12,56 @@ import (
 
 var expectedCollationOutputs = []string{
 	`
-user1# (guild1 #chan1): Message 1
-user1# (guild1 #chan2): Message 2
-user1# (guild1 #chan2): Message 3
-user2# (guild1 #chan2): Message 4
-user1# (guild2 #chan1): Message 5
-user1# (guild1 #chan1): Message 6
-user1# (guild1 #chan2): Message 7
-user1# (guild2 #chan2): Message 8
+user1 (guild1 #chan1): Message 1
+user1 (guild1 #chan2): Message 2
+user1 (guild1 #chan2): Message 3
+user2 (guild1 #chan2): Message 4
+user1 (guild2 #chan1): Message 5
+user1 (guild1 #chan1): Message 6
+user1 (guild1 #chan2): Message 7
+user1 (guild2 #chan2): Message 8
 `,
 	`
 guild1 #chan1:
-user1#: Message 1
+user1: Message 1
 
 guild1 #chan2:
-user1#: Message 2
-user1#: Message 3
-user2#: Message 4
+user1: Message 2
+user1: Message 3
+user2: Message 4
 
 guild2 #chan1:
-user1#: Message 5
+user1: Message 5
 
 guild1 #chan1:
-user1#: Message 6
+user1: Message 6
 
 guild1 #chan2:
-user1#: Message 7
+user1: Message 7
 
 guild2 #chan2:
-user1#: Message 8
+user1: Message 8
 `,
 	`
 guild1 #chan1:
-user1#: Message 1
+user1: Message 1
 
 guild1 #chan2:
-user1#: Message 2
-        Message 3
-user2#: Message 4
+user1: Message 2
+       Message 3
+user2: Message 4
 
 guild2 #chan1:
-user1#: Message 5
+user1: Message 5
 
 guild1 #chan1:
-user1#: Message 6
+user1: Message 6
 
 guild1 #chan2:
-user1#: Message 7
+user1: Message 7
 
 guild2 #chan2:
-user1#: Message 8
+user1: Message 8
 `,
 }
 
@@ -157,3 +158,89 @@ func TestWriter_Close(t *testing.T) {
 		t.Errorf("Didn't get close message, got: \"%s\"", str.String())
 	}
 }
+
+func TestWriter_Edit(t *testing.T) {
+	cases := []struct {
+		Collate int
+		Expect  []string
+	}{
+		{0, []string{
+			"",
+			"user1 (guild1 #chan1): Message 1",
+			"user1 (guild1 #chan1) edited: Message 1",
+			"user1 (guild1 #chan1) deleted message 1",
+			"",
+		}},
+		{output.WriterCollateUser, []string{
+			"",
+			"guild1 #chan1:",
+			"user1: Message 1",
+			"user1 edited: Message 1",
+			"user1 deleted message 1",
+			"user1: Message 1",
+			"",
+		}},
+	}
+
+	for _, c := range cases {
+		str := &strings.Builder{}
+		w := output.Writer{
+			Output:  &WriteNopCloser{str},
+			Collate: c.Collate,
+		}
+		w.Open(fakeSession)
+
+		msg := testMessages[0]
+		inner := *msg.Message
+		inner.ID = "1"
+		msg.Message = &inner
+		w.Write(msg)
+		w.Edit(msg)
+		w.Delete(msg)
+		if c.Collate != 0 {
+			// Should be written in full after an edit
+			w.Write(msg)
+		}
+
+		lines := strings.Split(str.String(), "\n")
+		if len(lines) != len(c.Expect) {
+			t.Errorf("Wrong line count (collate %d)\nExpect: %d\nGot: %d", c.Collate, len(c.Expect), len(lines))
+			continue
+		}
+		for i, line := range lines {
+			if !strings.HasSuffix(line, c.Expect[i]) {
+				t.Errorf("Invalid edit output (collate %d, line %d)\nExpect:\n%s\n\nGot:\n%s\n", c.Collate, i, c.Expect[i], line)
+			}
+		}
+	}
+}
+
+func TestWriter_DM(t *testing.T) {
+	str := &strings.Builder{}
+	w := output.Writer{
+		Output:  &WriteNopCloser{str},
+		Collate: output.WriterCollateChannel,
+	}
+	w.Open(fakeSession)
+
+	dm := output.Message{
+		Message:       &discordgo.Message{ChannelID: "dm1", Author: &discordgo.User{ID: "a", Username: "user1"}},
+		PrettyContent: "Message 1",
+	}
+	group := dm
+	group.Message = &discordgo.Message{ChannelID: "dm2", Author: dm.Author}
+	group.ChannelName = "friends"
+	w.Write(dm)
+	w.Write(group)
+
+	expect := []string{"", "DM:", "user1: Message 1", "", "group DM #friends:", "user1: Message 1", ""}
+	lines := strings.Split(str.String(), "\n")
+	if len(lines) != len(expect) {
+		t.Fatalf("Wrong line count\nExpect: %d\nGot: %d", len(expect), len(lines))
+	}
+	for i, line := range lines {
+		if !strings.HasSuffix(line, expect[i]) {
+			t.Errorf("Invalid DM output (line %d)\nExpect:\n%s\n\nGot:\n%s\n", i, expect[i], line)
+		}
+	}
+}
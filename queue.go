@@ -0,0 +1,225 @@
+package disdup
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	config "github.com/ejv2/disdup/conf"
+	"github.com/ejv2/disdup/output"
+	"github.com/ejv2/disdup/spool"
+)
+
+// Kinds of delivery.
+const (
+	deliverWrite = iota
+	deliverEdit
+	deliverDelete
+)
+
+// A delivery is a single event waiting to be delivered to an output, such as
+// a message write or edit.
+type delivery struct {
+	kind int
+	msg  output.Message
+	// Sequence number in the spool, or zero if not spooled
+	seq uint64
+}
+
+// deliver makes the delivery to output out. Edits and deletions are only
+// delivered to outputs supporting them and always succeed.
+func (dl delivery) deliver(ctx context.Context, out output.Output) error {
+	switch dl.kind {
+	case deliverEdit:
+		if e, ok := out.(output.Editor); ok {
+			e.Edit(dl.msg)
+		}
+	case deliverDelete:
+		if d, ok := out.(output.Deleter); ok {
+			d.Delete(dl.msg)
+		}
+	default:
+		return output.WithContext(out).WriteContext(ctx, dl.msg)
+	}
+
+	return nil
+}
+
+// queue is a bounded FIFO of deliveries waiting for a single output. Each
+// queue is serviced by exactly one worker goroutine, so deliveries reach the
+// output one at a time and in the order in which they were queued.
+//
+// When the queue is full, new deliveries are handled according to the
+// overflow policy of the output config.
+//
+// Deliveries are made using ctx, and any which fail are passed to fail. If
+// the queue has a spool, each delivery is recorded in the spool as it is
+// queued and acknowledged once delivered, dropped or failed. Only deliveries
+// cut short by the cancellation of ctx are left in the spool, to be made again
+// on the next run.
+//
+// If set, hold is called with each delivery as it is queued and release once
+// it leaves the queue, whether delivered or dropped, such that the files it
+// refers to may be kept until then.
+type queue struct {
+	out           config.OutputConfig
+	size          int
+	overflow      int
+	ctx           context.Context
+	fail          func(dl delivery, err error)
+	spool         *spool.Spool
+	hold, release func(dl delivery)
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []delivery
+	closed  bool
+	done    chan struct{}
+}
+
+// newQueue creates a new queue for output out. The queue accepts deliveries
+// immediately, but they are not delivered until start is called. Failed
+// deliveries are passed to fail, which may be nil.
+func newQueue(ctx context.Context, out config.OutputConfig, fail func(dl delivery, err error)) *queue {
+	q := &queue{
+		out:      out,
+		size:     out.QueueSize,
+		overflow: out.Overflow,
+		ctx:      ctx,
+		fail:     fail,
+		done:     make(chan struct{}),
+	}
+	if q.size <= 0 {
+		q.size = config.DefaultQueueSize
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	return q
+}
+
+// preload queues the unacknowledged entries of spool sp and records further
+// deliveries in sp. Preloaded deliveries are not subject to the queue size.
+// preload must be called before the queue is used, but after hold is set.
+func (q *queue) preload(sp *spool.Spool) {
+	q.spool = sp
+	for _, ent := range sp.Pending() {
+		dl := delivery{ent.Kind, ent.Message, ent.Seq}
+		if q.hold != nil {
+			q.hold(dl)
+		}
+		q.pending = append(q.pending, dl)
+	}
+}
+
+// ack acknowledges the delivery in the spool, if spooled.
+func (q *queue) ack(dl delivery) {
+	if dl.seq == 0 {
+		return
+	}
+
+	if err := q.spool.Ack(dl.seq); err != nil {
+		log.Printf("[WARNING]: duplicator: output %s: spool: %s", q.out.Name, err.Error())
+	}
+}
+
+// start begins delivering queued events to the output.
+func (q *queue) start() {
+	go q.run()
+}
+
+// push adds dl to the back of the queue. If the queue is full, push may block
+// or drop a delivery, depending on the overflow policy. Deliveries pushed to
+// a closed queue are discarded.
+func (q *queue) push(dl delivery) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for !q.closed && len(q.pending) >= q.size {
+		switch q.overflow {
+		case config.OverflowDropOldest:
+			log.Printf("[WARNING]: duplicator: output %s: queue full: dropped oldest message", q.out.Name)
+			q.ack(q.pending[0])
+			if q.release != nil {
+				q.release(q.pending[0])
+			}
+			q.pending[0] = delivery{}
+			q.pending = q.pending[1:]
+		case config.OverflowDropNewest:
+			log.Printf("[WARNING]: duplicator: output %s: queue full: dropped newest message", q.out.Name)
+			return
+		default:
+			q.cond.Wait()
+		}
+	}
+	if q.closed {
+		return
+	}
+
+	if q.spool != nil {
+		seq, err := q.spool.Append(dl.kind, dl.msg)
+		if err != nil {
+			// Still worth delivering, just not durably
+			log.Printf("[WARNING]: duplicator: output %s: spool: %s", q.out.Name, err.Error())
+		}
+		dl.seq = seq
+	}
+
+	if q.hold != nil {
+		q.hold(dl)
+	}
+	q.pending = append(q.pending, dl)
+	q.cond.Broadcast()
+}
+
+// run is the worker for the queue. It delivers events until the queue is
+// closed and all remaining deliveries have been made.
+func (q *queue) run() {
+	defer close(q.done)
+
+	for {
+		q.mu.Lock()
+		for !q.closed && len(q.pending) == 0 {
+			q.cond.Wait()
+		}
+		if len(q.pending) == 0 {
+			q.mu.Unlock()
+			return
+		}
+
+		dl := q.pending[0]
+		q.pending[0] = delivery{}
+		q.pending = q.pending[1:]
+		q.cond.Broadcast()
+		q.mu.Unlock()
+
+		err := dl.deliver(q.ctx, q.out.Output)
+		if err != nil && q.fail != nil {
+			q.fail(dl, err)
+		}
+		// Any other failure is final, the output having already given up
+		// on (or dead lettered) the message, so would only fail again if
+		// replayed
+		if err == nil || q.ctx.Err() == nil {
+			q.ack(dl)
+		}
+		if q.release != nil {
+			q.release(dl)
+		}
+	}
+}
+
+// close stops the queue from accepting new deliveries and waits for those
+// already queued to be delivered. If the context of the queue is cancelled,
+// the remaining deliveries fail quickly and are left in the spool, which is
+// then closed. The queue must have been started.
+func (q *queue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	<-q.done
+	if q.spool != nil {
+		q.spool.Close()
+	}
+}
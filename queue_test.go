@@ -0,0 +1,202 @@
+package disdup
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	config "github.com/ejv2/disdup/conf"
+	"github.com/ejv2/disdup/output"
+	"github.com/ejv2/disdup/spool"
+)
+
+// recorder is an output which records the IDs of messages written to it.
+type recorder struct {
+	output.Writer
+	got []int
+}
+
+func (r *recorder) Write(m output.Message) {
+	id, _ := strconv.Atoi(m.PrettyContent)
+	r.got = append(r.got, id)
+}
+
+var errFailing = errors.New("output always fails")
+
+// failing is an output to which every write fails.
+type failing struct {
+	output.Writer
+}
+
+func (f *failing) WriteContext(ctx context.Context, m output.Message) error {
+	return errFailing
+}
+
+// record returns a delivery for a message with the given id.
+func record(id int) delivery {
+	return delivery{kind: deliverWrite, msg: output.Message{PrettyContent: strconv.Itoa(id)}}
+}
+
+func TestQueue_Order(t *testing.T) {
+	rec := &recorder{}
+	q := newQueue(context.Background(), config.OutputConfig{Name: "test", Output: rec, QueueSize: 4}, nil)
+	q.start()
+
+	for i := 0; i < 100; i++ {
+		q.push(record(i))
+	}
+	q.close()
+
+	got := rec.got
+	if len(got) != 100 {
+		t.Fatalf("expected 100 deliveries, got %d", len(got))
+	}
+	for i, id := range got {
+		if id != i {
+			t.Fatalf("delivery %d out of order: got %d", i, id)
+		}
+	}
+}
+
+func TestQueue_Overflow(t *testing.T) {
+	cases := []struct {
+		Policy int
+		Expect []int
+	}{
+		{config.OverflowDropOldest, []int{3, 4, 5}},
+		{config.OverflowDropNewest, []int{0, 1, 2}},
+	}
+
+	for _, c := range cases {
+		t.Run(strconv.Itoa(c.Policy), func(t *testing.T) {
+			rec := &recorder{}
+			q := newQueue(context.Background(), config.OutputConfig{Name: "test", Output: rec, QueueSize: 3, Overflow: c.Policy}, nil)
+			held := 0
+			q.hold = func(dl delivery) { held++ }
+			q.release = func(dl delivery) { held-- }
+
+			// Queue is not started, so fills up
+			for i := 0; i < 6; i++ {
+				q.push(record(i))
+			}
+			q.start()
+			q.close()
+
+			if held != 0 {
+				t.Errorf("%d deliveries still held once delivered or dropped", held)
+			}
+			got := rec.got
+			if len(got) != len(c.Expect) {
+				t.Fatalf("wrong delivery count\nexpect: %v\ngot: %v", c.Expect, got)
+			}
+			for i := range got {
+				if got[i] != c.Expect[i] {
+					t.Fatalf("wrong deliveries\nexpect: %v\ngot: %v", c.Expect, got)
+				}
+			}
+		})
+	}
+}
+
+func TestQueue_Closed(t *testing.T) {
+	rec := &recorder{}
+	q := newQueue(context.Background(), config.OutputConfig{Name: "test", Output: rec}, nil)
+	q.start()
+	q.close()
+
+	// Must neither block nor deliver
+	q.push(record(0))
+	if len(rec.got) != 0 {
+		t.Error("delivery made after queue closed")
+	}
+}
+
+func TestQueue_Fail(t *testing.T) {
+	var failed []error
+	ctx, cancel := context.WithCancel(context.Background())
+	out := &output.RawChannel{Output: make(chan output.Message)}
+	q := newQueue(ctx, config.OutputConfig{Name: "test", Output: out}, func(dl delivery, err error) {
+		failed = append(failed, err)
+	})
+
+	// Nobody is receiving, so writes only end on cancellation
+	q.push(record(0))
+	q.push(record(1))
+	cancel()
+	q.start()
+	q.close()
+
+	if len(failed) != 2 {
+		t.Fatalf("expected 2 failed deliveries, got %d", len(failed))
+	}
+	for _, err := range failed {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("wrong error\nexpect: %s\ngot: %s", context.Canceled, err)
+		}
+	}
+}
+
+func TestQueue_Spool(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	sp, _ := spool.Open(dir)
+
+	// Written successfully, then one left over from cancellation
+	rec := &recorder{}
+	q := newQueue(ctx, config.OutputConfig{Name: "test", Output: rec}, nil)
+	q.preload(sp)
+	q.start()
+	q.push(record(0))
+	q.close()
+	cancel()
+
+	sp, _ = spool.Open(dir)
+	q = newQueue(ctx, config.OutputConfig{Name: "test", Output: rec}, nil)
+	q.preload(sp)
+	q.start()
+	q.push(record(1))
+	q.close()
+
+	sp, _ = spool.Open(dir)
+	defer sp.Close()
+	if pend := sp.Pending(); len(pend) != 1 || pend[0].Message.PrettyContent != "1" {
+		t.Errorf("expected only cancelled delivery to be pending, got %v", pend)
+	}
+	if len(rec.got) != 1 || rec.got[0] != 0 {
+		t.Errorf("wrong deliveries\nexpect: [0]\ngot: %v", rec.got)
+	}
+}
+
+func TestQueue_SpoolFailed(t *testing.T) {
+	dir := t.TempDir()
+	sp, _ := spool.Open(dir)
+
+	// Large enough to span several segments if never acknowledged
+	var failed int
+	q := newQueue(context.Background(), config.OutputConfig{Name: "test", Output: &failing{}}, func(dl delivery, err error) {
+		failed++
+	})
+	q.preload(sp)
+	q.start()
+	pad := strings.Repeat("x", 64<<10)
+	for i := 0; i < 3*spool.SegmentSize/len(pad); i++ {
+		q.push(delivery{kind: deliverWrite, msg: output.Message{PrettyContent: pad}})
+	}
+	q.close()
+
+	if failed != 3*spool.SegmentSize/len(pad) {
+		t.Errorf("expected every delivery to fail, got %d failures", failed)
+	}
+
+	sp, _ = spool.Open(dir)
+	defer sp.Close()
+	if pend := sp.Pending(); len(pend) != 0 {
+		t.Errorf("expected failed deliveries to be acknowledged, got %d pending", len(pend))
+	}
+	if segs, _ := filepath.Glob(filepath.Join(dir, "*.seg")); len(segs) != 1 {
+		t.Errorf("expected spool to be trimmed to 1 segment, got %d", len(segs))
+	}
+}
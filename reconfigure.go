@@ -0,0 +1,138 @@
+package disdup
+
+import (
+	"fmt"
+	"log"
+
+	config "github.com/ejv2/disdup/conf"
+	"github.com/ejv2/disdup/output"
+)
+
+// Reconfigure replaces the configuration of a running duplicator with conf,
+// without reconnecting to Discord. The new guild configuration applies to all
+// events handled after Reconfigure returns.
+//
+// Outputs are matched by name. Outputs with new names are opened and outputs
+// whose names are no longer present are closed once their queued messages
+// have been written. Outputs present in both configurations keep running
+// unchanged, including their queue settings; to change the options of an
+// output, it must be renamed or the duplicator restarted. A warning is logged
+// for such outputs whose settings differ (see OutputConfig.SameSettings). The
+// new instances of these outputs are neither opened nor closed, so should not
+// hold resources until opened. Dead letter outputs of new retrying outputs
+// which refer to such an instance are pointed at the running output instead.
+// As kept outputs are unchanged, outputs which a kept retrying output uses as
+// its dead letter cannot be removed, and ErrDeadLetterRemoved is returned.
+//
+// Token, SpoolDir, CheckpointFile, Attachments and Cache cannot be changed
+// while running and any changes to them are ignored (see Config.KeepRunning). Matching by role or
+// nickname may be enabled, but changes to member roles and nicknames are only
+// noticed if such matching was enabled at startup. If the new configuration
+// fails Config.Validate or a new output fails to open, the
+// configuration is left unchanged and the error is returned.
+func (d Duplicator) Reconfigure(conf config.Config) error {
+	d.routes.reconf.Lock()
+	defer d.routes.reconf.Unlock()
+
+	old, oldq := d.current()
+	conf = conf.KeepRunning(old)
+	if err := conf.Validate(); err != nil {
+		return fmt.Errorf("duplicator: reconfigure: %w", err)
+	}
+	if conf.UsesRoles() && !old.UsesRoles() {
+		log.Println("[WARNING]: duplicator: reconfigure: role changes will not be seen until restart")
+	}
+	if conf.UsesNicknames() && !(old.UsesNicknames() || old.UsesRoles()) {
+		log.Println("[WARNING]: duplicator: reconfigure: nickname changes will not be seen until restart")
+	}
+
+	removed := make(map[string]int, len(old.Outputs))
+	for i, out := range old.Outputs {
+		removed[out.Name] = i
+	}
+
+	var added []config.OutputConfig
+	// New instances of the outputs kept, which are never opened, and the
+	// instances running in their place
+	var unused, running []output.Output
+	outs := make([]config.OutputConfig, len(conf.Outputs))
+	queues := make([]*queue, len(conf.Outputs))
+	for i, out := range conf.Outputs {
+		if j, ok := removed[out.Name]; ok {
+			outs[i], queues[i] = old.Outputs[j], oldq[j]
+			unused = append(unused, out.Output)
+			running = append(running, old.Outputs[j].Output)
+			delete(removed, out.Name)
+			if !out.SameSettings(old.Outputs[j]) {
+				log.Println("[WARNING]: duplicator: reconfigure: output", out.Name+": changes will not apply until restart")
+			}
+			continue
+		}
+
+		outs[i] = out
+		added = append(added, out)
+	}
+	for _, out := range running {
+		r, ok := out.(*output.Retry)
+		if !ok || r.DeadLetter == nil || r.OwnDeadLetter {
+			continue
+		}
+		for name, i := range removed {
+			if r.DeadLetter == old.Outputs[i].Output {
+				return fmt.Errorf("%w: %s", ErrDeadLetterRemoved, name)
+			}
+		}
+	}
+	for _, out := range added {
+		r, ok := out.Output.(*output.Retry)
+		if !ok || r.DeadLetter == nil {
+			continue
+		}
+		for k := range unused {
+			if r.DeadLetter == unused[k] {
+				r.DeadLetter = running[k]
+			}
+		}
+	}
+
+	if err := d.openOutputs(added); err != nil {
+		return err
+	}
+	var fresh []*queue
+	for i, out := range outs {
+		if queues[i] != nil {
+			continue
+		}
+
+		q, err := d.newQueue(out)
+		if err != nil {
+			for _, q := range fresh {
+				q.spool.Close()
+			}
+			for _, out := range added {
+				out.Output.Close()
+			}
+			return err
+		}
+		queues[i] = q
+		fresh = append(fresh, q)
+	}
+	for _, q := range fresh {
+		q.start()
+	}
+
+	conf.Outputs = outs
+	d.routes.mu.Lock()
+	d.routes.table = conf.Compile()
+	d.routes.queues = queues
+	d.routes.mu.Unlock()
+
+	for name, i := range removed {
+		oldq[i].close()
+		if err := old.Outputs[i].Output.Close(); err != nil {
+			log.Println("[WARNING]: duplicator: output", name+": close:", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package disdup
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	config "github.com/ejv2/disdup/conf"
+	"github.com/ejv2/disdup/output"
+)
+
+// tracker is an output which records how it is used. Writes fail if fail is
+// set.
+type tracker struct {
+	fail                    bool
+	opened, closed, unready int
+	got                     []output.Message
+}
+
+func (t *tracker) Open(s *discordgo.Session) error {
+	t.opened++
+	return nil
+}
+
+func (t *tracker) Write(m output.Message) {
+	if t.opened == 0 {
+		t.unready++
+	}
+	t.got = append(t.got, m)
+}
+
+func (t *tracker) WriteContext(ctx context.Context, m output.Message) error {
+	if t.fail {
+		return errFailing
+	}
+	t.Write(m)
+	return nil
+}
+
+func (t *tracker) Close() error {
+	t.closed++
+	return nil
+}
+
+func TestReconfigure(t *testing.T) {
+	kept, gone := &tracker{}, &tracker{}
+	conf := config.Config{Token: "test", Guilds: make(map[string]*config.GuildConfig)}
+	conf.Use("kept", kept).Use("gone", gone)
+
+	d := testDuplicator(t, conf, &fakeDiscord{})
+	if err := d.openOutputs(conf.Outputs); err != nil {
+		t.Fatal("Unexpected open error:", err)
+	}
+	for _, out := range conf.Outputs {
+		q, _ := d.newQueue(out)
+		d.routes.queues = append(d.routes.queues, q)
+		q.start()
+	}
+
+	// Rejected, so must change nothing
+	bad := config.Config{Guilds: make(map[string]*config.GuildConfig)}
+	bad.Use("kept", &tracker{})
+	bad.Rule(`dm -> [gone]`)
+	if err := d.Reconfigure(bad); !errors.Is(err, config.ErrUnknownOutput) {
+		t.Errorf("wrong error\nexpect: %v\ngot: %v", config.ErrUnknownOutput, err)
+	}
+	if c, _ := d.current(); len(c.Outputs) != 2 || c.Outputs[0].Output != kept {
+		t.Fatal("Configuration changed by failed reconfigure")
+	}
+
+	// New instance of kept output is the dead letter of an added output
+	keptNew, failing := &tracker{}, &tracker{fail: true}
+	next := config.Config{Guilds: make(map[string]*config.GuildConfig)}
+	next.Use("kept", keptNew).Use("retry", &output.Retry{
+		Output:      failing,
+		MaxAttempts: 1,
+		Backoff:     time.Millisecond,
+		DeadLetter:  keptNew,
+	})
+	next.Outputs[0].Source = "changed"
+	if err := d.Reconfigure(next); err != nil {
+		t.Fatal("Unexpected reconfigure error:", err)
+	}
+
+	c, queues := d.current()
+	if len(c.Outputs) != 2 || c.Outputs[0].Output != kept || c.Outputs[0].Source != "" {
+		t.Fatalf("Running output not kept: %+v", c.Outputs)
+	}
+	if retry := c.Outputs[1].Output.(*output.Retry); retry.DeadLetter != kept {
+		t.Error("Dead letter not pointed at running output")
+	}
+	if gone.closed != 1 || kept.closed != 0 {
+		t.Errorf("Wrong outputs closed: removed closed %d times, kept %d times", gone.closed, kept.closed)
+	}
+	if failing.opened != 1 || keptNew.opened != 0 || keptNew.closed != 0 {
+		t.Error("Expected only added output to be opened")
+	}
+
+	// Kept retry still dead letters to kept, so it cannot be removed
+	drop := config.Config{Guilds: make(map[string]*config.GuildConfig)}
+	drop.Use("retry", &output.Retry{Output: &tracker{}})
+	if err := d.Reconfigure(drop); !errors.Is(err, ErrDeadLetterRemoved) {
+		t.Errorf("wrong error\nexpect: %v\ngot: %v", ErrDeadLetterRemoved, err)
+	}
+	if c, _ := d.current(); len(c.Outputs) != 2 || kept.closed != 0 {
+		t.Fatal("Dead letter output removed")
+	}
+
+	queues[1].push(record(1))
+	for _, q := range queues {
+		q.close()
+	}
+	if len(kept.got) != 1 || kept.unready != 0 || len(keptNew.got) != 0 {
+		t.Errorf("Failed message not dead lettered to running output: got %d, %d unopened", len(kept.got), len(keptNew.got))
+	}
+}
@@ -0,0 +1,75 @@
+package disdup
+
+import "sync"
+
+// sequencer runs jobs in the background, one at a time and in the order in
+// which they were added for each key, such that jobs for different keys run
+// concurrently. A goroutine runs for each key only while it has jobs waiting,
+// so keys need not be known in advance.
+//
+// Gateway event handlers queue their work on a sequencer, keyed by guild, so
+// that slow work (such as downloads, lookups and backfill) does not hold up
+// the gateway connection, while events in each guild are still handled in the
+// order received.
+//
+// The zero value is ready for use. A sequencer must not be copied after first
+// use.
+type sequencer struct {
+	mu sync.Mutex
+	// Jobs waiting for each key with a running goroutine
+	pending map[string][]func()
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// do queues job to run after all other jobs queued with key. Jobs queued after
+// close are discarded.
+func (s *sequencer) do(key string, job func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	if jobs, ok := s.pending[key]; ok {
+		s.pending[key] = append(jobs, job)
+		return
+	}
+
+	if s.pending == nil {
+		s.pending = make(map[string][]func())
+	}
+	s.pending[key] = nil
+	s.wg.Add(1)
+	go s.run(key, job)
+}
+
+// run runs job, followed by every job queued with key, until none are left.
+func (s *sequencer) run(key string, job func()) {
+	defer s.wg.Done()
+
+	for {
+		job()
+
+		s.mu.Lock()
+		jobs := s.pending[key]
+		if len(jobs) == 0 {
+			delete(s.pending, key)
+			s.mu.Unlock()
+			return
+		}
+		job, jobs[0] = jobs[0], nil
+		s.pending[key] = jobs[1:]
+		s.mu.Unlock()
+	}
+}
+
+// close stops the sequencer from accepting new jobs and waits for those
+// already queued to finish.
+func (s *sequencer) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
@@ -0,0 +1,64 @@
+package disdup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSequencer_Order(t *testing.T) {
+	var s sequencer
+	keys := []string{"a", "b", ""}
+	got := make([][]int, len(keys))
+
+	for i := 0; i < 100; i++ {
+		for k, key := range keys {
+			i, ids := i, &got[k]
+			s.do(key, func() {
+				*ids = append(*ids, i)
+			})
+		}
+	}
+	s.close()
+
+	for k, ids := range got {
+		key := keys[k]
+		if len(ids) != 100 {
+			t.Fatalf("key %q: expected 100 jobs, got %d", key, len(ids))
+		}
+		for i, id := range ids {
+			if id != i {
+				t.Fatalf("key %q: job %d out of order: got %d", key, i, id)
+			}
+		}
+	}
+}
+
+func TestSequencer_Concurrent(t *testing.T) {
+	var s sequencer
+	block, done := make(chan struct{}), make(chan struct{})
+
+	s.do("slow", func() { <-block })
+	s.do("fast", func() { close(done) })
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Job held up by slow job with another key")
+	}
+	close(block)
+	s.close()
+}
+
+func TestSequencer_Close(t *testing.T) {
+	var s sequencer
+	ran := 0
+	s.do("a", func() { ran++ })
+	s.do("a", func() { ran++ })
+	s.close()
+
+	s.do("a", func() { ran++ })
+	s.close()
+	if ran != 2 {
+		t.Errorf("expected 2 jobs run before close and none after, got %d", ran)
+	}
+}
@@ -0,0 +1,330 @@
+// Package spool implements a durable write-ahead log of messages waiting to
+// be written to an output. Messages are appended to the spool before being
+// written and acknowledged once written, such that messages which were never
+// written (for instance, due to a crash) can be found and written again on
+// the next run.
+//
+// A spool is a directory of append-only segment files. Each segment contains
+// a sequence of JSON records, each being either a new entry or the
+// acknowledgement of an earlier entry. Once every entry in the oldest segment
+// has been acknowledged, the segment is removed.
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ejv2/disdup/output"
+)
+
+// Spool errors.
+var (
+	ErrClosed  = errors.New("spool: closed")
+	ErrUnknown = errors.New("spool: acknowledgement of unknown entry")
+	ErrIO      = errors.New("spool: I/O error")
+)
+
+// Segment constants.
+const (
+	// Size above which the current segment is closed and a new one
+	// started.
+	SegmentSize = 4 << 20
+	// File extension of segment files.
+	segmentExt = ".seg"
+)
+
+// An Entry is a single message recorded in the spool.
+type Entry struct {
+	// Seq is the sequence number of the entry, unique within its spool.
+	Seq uint64 `json:"seq"`
+	// Kind is an arbitrary kind of entry, recorded for use by the caller.
+	Kind int `json:"kind"`
+	// Message is the recorded message, including downloaded attachments.
+	Message output.Message `json:"message"`
+}
+
+// record is a single record in a segment file. Exactly one of Entry and Ack
+// is set.
+type record struct {
+	Entry *Entry `json:"entry,omitempty"`
+	Ack   uint64 `json:"ack,omitempty"`
+}
+
+// Spool is a durable log of messages for a single output. All methods are
+// safe for concurrent use.
+type Spool struct {
+	dir string
+
+	mu      sync.Mutex
+	seg     *os.File
+	segID   uint64
+	segSize int64
+	next    uint64
+	pending []Entry
+	// Segment of each unacknowledged entry
+	where map[uint64]uint64
+	// Number of unacknowledged entries in each segment
+	live map[uint64]int
+}
+
+// segmentName returns the file name of the segment with the given ID.
+func segmentName(id uint64) string {
+	return fmt.Sprintf("%016x%s", id, segmentExt)
+}
+
+// Open opens the spool in directory dir, creating it if it does not exist.
+// Existing segments are read to find entries which were never acknowledged,
+// which are available from Pending. New entries are always written to a new
+// segment, such that a record torn by a crash is never appended to.
+func Open(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrIO, err.Error())
+	}
+
+	s := &Spool{
+		dir:   dir,
+		next:  1,
+		where: make(map[uint64]uint64),
+		live:  make(map[uint64]int),
+	}
+
+	ids, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[uint64]Entry)
+	for _, id := range ids {
+		if err := s.replay(id, entries); err != nil {
+			return nil, err
+		}
+		s.segID = id
+	}
+	for seq := range entries {
+		s.pending = append(s.pending, entries[seq])
+	}
+	sort.Slice(s.pending, func(i, j int) bool {
+		return s.pending[i].Seq < s.pending[j].Seq
+	})
+
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+	s.trim()
+
+	return s, nil
+}
+
+// segments returns the IDs of all segments in the spool, oldest first.
+func (s *Spool) segments() ([]uint64, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrIO, err.Error())
+	}
+
+	var ids []uint64
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 16, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids, nil
+}
+
+// replay reads the records of segment id, adding new entries to entries and
+// removing those acknowledged. Reading stops at the first malformed record,
+// which can only be the result of a torn write.
+func (s *Spool) replay(id uint64, entries map[uint64]Entry) error {
+	f, err := os.Open(filepath.Join(s.dir, segmentName(id)))
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrIO, err.Error())
+	}
+	defer f.Close()
+
+	// Segment is tracked even if empty, so that it is removed by trim
+	s.live[id] = 0
+
+	dec := json.NewDecoder(f)
+	for {
+		var rec record
+		if err := dec.Decode(&rec); err != nil {
+			if err != io.EOF {
+				break
+			}
+			return nil
+		}
+
+		if rec.Entry != nil {
+			entries[rec.Entry.Seq] = *rec.Entry
+			s.where[rec.Entry.Seq] = id
+			s.live[id]++
+			if rec.Entry.Seq >= s.next {
+				s.next = rec.Entry.Seq + 1
+			}
+		} else if seg, ok := s.where[rec.Ack]; ok {
+			delete(entries, rec.Ack)
+			delete(s.where, rec.Ack)
+			s.live[seg]--
+		}
+	}
+
+	return nil
+}
+
+// rotate closes the current segment, if any, and starts a new one.
+func (s *Spool) rotate() error {
+	if s.seg != nil {
+		if err := s.seg.Close(); err != nil {
+			return fmt.Errorf("%w: %s", ErrIO, err.Error())
+		}
+	}
+
+	s.segID++
+	f, err := os.OpenFile(filepath.Join(s.dir, segmentName(s.segID)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrIO, err.Error())
+	}
+
+	s.seg = f
+	s.segSize = 0
+	s.live[s.segID] = 0
+	return nil
+}
+
+// trim removes the oldest segments for as long as all their entries have been
+// acknowledged. Only whole prefixes of the spool are removed, as segments
+// may contain acknowledgements for entries in older segments. The current
+// segment is never removed.
+func (s *Spool) trim() {
+	ids := make([]uint64, 0, len(s.live))
+	for id := range s.live {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		if id == s.segID || s.live[id] > 0 {
+			return
+		}
+
+		// Failure to remove only costs disk space and is retried on the
+		// next open
+		os.Remove(filepath.Join(s.dir, segmentName(id)))
+		delete(s.live, id)
+	}
+}
+
+// write appends rec to the current segment, rotating first if the segment is
+// full. If sync is set, the write is flushed to disk before returning.
+func (s *Spool) write(rec record, sync bool) error {
+	if s.seg == nil {
+		return ErrClosed
+	}
+	if s.segSize >= SegmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	n, err := s.seg.Write(buf)
+	s.segSize += int64(n)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrIO, err.Error())
+	}
+	if sync {
+		if err := s.seg.Sync(); err != nil {
+			return fmt.Errorf("%w: %s", ErrIO, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Pending returns the entries which had not been acknowledged when the spool
+// was opened, in the order in which they were appended. These must still be
+// acknowledged once written.
+func (s *Spool) Pending() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Entry(nil), s.pending...)
+}
+
+// Append records message m of the given kind in the spool and returns its
+// sequence number. The entry is flushed to disk before Append returns.
+func (s *Spool) Append(kind int, m output.Message) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ent := Entry{Seq: s.next, Kind: kind, Message: m}
+	if err := s.write(record{Entry: &ent}, true); err != nil {
+		return 0, err
+	}
+
+	s.next++
+	s.where[ent.Seq] = s.segID
+	s.live[s.segID]++
+	return ent.Seq, nil
+}
+
+// Ack acknowledges the entry with sequence number seq, such that it is not
+// pending when the spool is next opened. Acknowledgements are not flushed to
+// disk immediately, so an entry may be found pending after a crash despite
+// having been acknowledged.
+func (s *Spool) Ack(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seg, ok := s.where[seq]
+	if !ok {
+		return ErrUnknown
+	}
+	if err := s.write(record{Ack: seq}, false); err != nil {
+		return err
+	}
+
+	delete(s.where, seq)
+	s.live[seg]--
+	s.trim()
+	return nil
+}
+
+// Close closes the spool. Entries not yet acknowledged remain pending.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.seg == nil {
+		return ErrClosed
+	}
+
+	err := s.seg.Close()
+	s.seg = nil
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrIO, err.Error())
+	}
+	return nil
+}
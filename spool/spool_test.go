@@ -0,0 +1,131 @@
+package spool
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/ejv2/disdup/output"
+)
+
+func testMessage(id string) output.Message {
+	return output.Message{
+		Message: &discordgo.Message{
+			ID:     id,
+			Author: &discordgo.User{ID: "1234", Username: "user"},
+		},
+		PrettyContent: "Message " + id,
+		ChannelName:   "channel",
+		GuildName:     "guild",
+		Downloads: []output.Attachment{
+			{Filename: "a.txt", Type: "text/plain", Content: []byte("attachment " + id)},
+		},
+	}
+}
+
+func TestSpool_Replay(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal("Unexpected open error:", err)
+	}
+	if len(s.Pending()) != 0 {
+		t.Fatal("New spool has pending entries")
+	}
+
+	var seqs []uint64
+	for _, id := range []string{"1", "2", "3"} {
+		seq, err := s.Append(len(seqs), testMessage(id))
+		if err != nil {
+			t.Fatal("Unexpected append error:", err)
+		}
+		seqs = append(seqs, seq)
+	}
+	if err := s.Ack(seqs[1]); err != nil {
+		t.Fatal("Unexpected ack error:", err)
+	}
+	if err := s.Ack(seqs[1]); err != ErrUnknown {
+		t.Error("Expected ErrUnknown from double ack, got:", err)
+	}
+	s.Close()
+
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatal("Unexpected reopen error:", err)
+	}
+	defer s.Close()
+
+	pend := s.Pending()
+	if len(pend) != 2 {
+		t.Fatalf("Expected 2 pending entries, got %d", len(pend))
+	}
+	for i, expect := range []string{"1", "3"} {
+		if pend[i].Message.ID != expect {
+			t.Errorf("Wrong pending entry %d\nexpect: %s\ngot: %s", i, expect, pend[i].Message.ID)
+		}
+		if pend[i].Message.PrettyContent != "Message "+expect {
+			t.Errorf("Wrong content for entry %d: %s", i, pend[i].Message.PrettyContent)
+		}
+		if len(pend[i].Message.Downloads) != 1 || string(pend[i].Message.Downloads[0].Content) != "attachment "+expect {
+			t.Errorf("Attachment for entry %d not preserved", i)
+		}
+	}
+	if pend[1].Kind != 2 {
+		t.Errorf("Wrong kind for entry\nexpect: 2\ngot: %d", pend[1].Kind)
+	}
+
+	// Sequence numbers continue from before
+	seq, _ := s.Append(0, testMessage("4"))
+	if seq <= seqs[2] {
+		t.Errorf("Sequence number reused: %d", seq)
+	}
+}
+
+func TestSpool_Trim(t *testing.T) {
+	dir := t.TempDir()
+
+	s, _ := Open(dir)
+	seq, _ := s.Append(0, testMessage("1"))
+	s.Close()
+
+	// Reopened spool writes to a new segment, leaving the old one until
+	// its entry is acknowledged
+	s, _ = Open(dir)
+	defer s.Close()
+	segs, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(segs) != 2 {
+		t.Fatalf("Expected 2 segments, got %d", len(segs))
+	}
+
+	s.Ack(seq)
+	segs, _ = filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(segs) != 1 {
+		t.Fatalf("Expected acknowledged segment to be removed, got %d segments", len(segs))
+	}
+}
+
+func TestSpool_Torn(t *testing.T) {
+	dir := t.TempDir()
+
+	s, _ := Open(dir)
+	s.Append(0, testMessage("1"))
+	s.Close()
+
+	// Simulate a crash part way through writing a record
+	segs, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	f, _ := os.OpenFile(segs[0], os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString(`{"entry":{"seq":2,"ki`)
+	f.Close()
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal("Unexpected open error:", err)
+	}
+	defer s.Close()
+
+	if pend := s.Pending(); len(pend) != 1 || pend[0].Message.ID != "1" {
+		t.Errorf("Expected only the complete entry to be pending, got %v", pend)
+	}
+}